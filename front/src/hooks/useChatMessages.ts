@@ -118,7 +118,7 @@ export const useChatMessages = (conversationId: number) => {
       let updatedIsReasoning = isReasoningRef.current
 
       for (const data of bufferCopy) {
-        if (data.type === 'complete' || data.type === 'done') {
+        if (data.type === 'complete' || data.type === 'done' || data.type === 'stopped') {
           if (newList.length > 0) {
             const lastItem = { ...newList[newList.length - 1] } as Message
             if (lastItem.content === '') {
@@ -240,6 +240,8 @@ export const useChatMessages = (conversationId: number) => {
   const sendSSE = useCallback((data: object) => {
     return createSSE('/message/stream', {
       payload: data,
+      // 每次提交一个幂等键，网络重试时服务端不会重复生成
+      customHeaders: { 'Idempotency-Key': generateUniqueId() },
       onMessage,
       onError,
       onClose: () => {
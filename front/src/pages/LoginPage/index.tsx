@@ -16,14 +16,20 @@ export const LoginPage = () => {
   const onLogin = async (values: UserLoginBasic) => {
     console.log(values)
     const res = await loginApi(values)
-    useUserStore.setUserToken(res.token)
+    useUserStore.setTokens(res)
     message.success('登录成功')
     navigate('/chat')
   }
 
   const onRegister = async (values: UserLoginBasic) => {
     const res = await registerApi(values)
-    useUserStore.setUserToken(res.token)
+    // 服务端要求验证邮箱时不返回令牌，验证后再登录
+    if (res.email_verification_required) {
+      message.success('注册成功，请查收验证邮件，验证邮箱后登录')
+      setisLogin(true)
+      return
+    }
+    useUserStore.setTokens(res)
     message.success('注册成功')
     navigate('/chat')
   }
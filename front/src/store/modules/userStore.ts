@@ -1,19 +1,34 @@
 import { create } from "zustand"
 import { persist } from "zustand/middleware"
 
+export interface TokenPair {
+  token: string
+  refresh_token: string
+  expires_in: number
+}
+
 interface UserStoreType {
   userToken: string | null
-  setUserToken: (token: string) => void
+  refreshToken: string | null
+  // 访问令牌的过期时间（毫秒时间戳），临近过期时先刷新再请求
+  tokenExpiresAt: number | null
+  setTokens: (tokens: TokenPair) => void
   removeUserToken: () => void
 }
 
 export const userStore = create<UserStoreType>()(
   persist((set) => ({
       userToken: null as string | null,
-      setUserToken: (token: string) => set({ userToken: token }),
-      removeUserToken: () => set({ userToken: null }),
+      refreshToken: null as string | null,
+      tokenExpiresAt: null as number | null,
+      setTokens: (tokens: TokenPair) => set({
+        userToken: tokens.token,
+        refreshToken: tokens.refresh_token,
+        tokenExpiresAt: Date.now() + tokens.expires_in * 1000,
+      }),
+      removeUserToken: () => set({ userToken: null, refreshToken: null, tokenExpiresAt: null }),
     }),{
       name: 'user-token',
     }
   )
-)
\ No newline at end of file
+)
@@ -8,6 +8,9 @@ export interface UserLoginBasic {
 
 export interface UserInfo {
   token: string
+  refresh_token: string
+  expires_in: number
+  email_verification_required?: boolean
   user: User
 }
 
@@ -15,6 +18,7 @@ export interface User {
     avatar:     string
     created_at: number
     email:      string
+    email_verified_at: number
     id:         number
     nickname:   string
     username:   string
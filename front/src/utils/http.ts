@@ -1,4 +1,4 @@
-import { userStore } from '@/store'
+import { userStore, type TokenPair } from '@/store'
 import { message } from 'antd'
 import axios, { type AxiosInstance, type InternalAxiosRequestConfig, AxiosError } from 'axios'
 
@@ -12,10 +12,49 @@ const http: AxiosInstance = axios.create({
   }
 })
 
+// 同一时间只发起一次刷新，并发的请求共用结果
+let refreshing: Promise<string | null> | null = null
+
+// refreshAccessToken 凭刷新令牌换取新的访问令牌，刷新令牌失效时清除登录状态
+export const refreshAccessToken = (): Promise<string | null> => {
+  if (refreshing) {
+    return refreshing
+  }
+  const { refreshToken, setTokens, removeUserToken } = userStore.getState()
+  if (!refreshToken) {
+    return Promise.resolve(null)
+  }
+  refreshing = axios.post(baseURL + '/auth/refresh', { refresh_token: refreshToken })
+    .then(({ data: res }) => {
+      if (res.code !== 200) {
+        throw new Error(res.msg)
+      }
+      setTokens(res.data as TokenPair)
+      return (res.data as TokenPair).token
+    })
+    .catch(() => {
+      removeUserToken()
+      return null
+    })
+    .finally(() => {
+      refreshing = null
+    })
+  return refreshing
+}
+
+// ensureFreshToken 访问令牌即将过期时先刷新，返回可用的访问令牌
+export const ensureFreshToken = async (): Promise<string | null> => {
+  const { userToken, tokenExpiresAt } = userStore.getState()
+  if (userToken && tokenExpiresAt && tokenExpiresAt - Date.now() < 30 * 1000) {
+    return refreshAccessToken()
+  }
+  return userToken
+}
+
 http.interceptors.request.use(
   (config: InternalAxiosRequestConfig) => {
     const token = userStore.getState().userToken
-    const noAuthPaths = ['/auth/login', '/auth/register']
+    const noAuthPaths = ['/auth/login', '/auth/register', '/auth/refresh']
     if (token && config.headers && !noAuthPaths.includes(config.url || '')) {
       config.headers.Authorization = `Bearer ${token}`
     }
@@ -36,16 +75,33 @@ http.interceptors.response.use(
     }
     return res.data
   },
-  (error: AxiosError) => {
+  async (error: AxiosError) => {
     console.error('HTTP 错误：', error.response?.status, error.message)
     const status = error.response?.status
+    // 访问令牌过期时刷新后重试一次
+    const config = error.config as (InternalAxiosRequestConfig & { _retried?: boolean }) | undefined
+    if (status === 401 && config && !config._retried && !config.url?.startsWith('/auth/')) {
+      config._retried = true
+      const token = await refreshAccessToken()
+      if (token) {
+        config.headers.Authorization = `Bearer ${token}`
+        return http(config)
+      }
+    }
     switch (status) {
       case 401:
         message.error('未授权/登录过期，请重新登录')
         break
+      case 403:
+        message.error((error.response?.data as { msg?: string })?.msg || '没有权限')
+        break
       case 404:
         message.error('请求的接口不存在')
         break
+      case 429:
+        // 限流或登录失败次数过多，服务端返回具体的等待提示
+        message.error((error.response?.data as { msg?: string })?.msg || '请求过于频繁，请稍后再试')
+        break
       case 500:
         message.error('服务器内部错误')
         break
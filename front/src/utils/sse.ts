@@ -1,8 +1,15 @@
 import { userStore } from '@/store'
+import { ensureFreshToken } from '@/utils/http'
 import { SSE } from 'sse.js'
 
 const baseURL = import.meta.env.VITE_API_BASE_URL + '/api'
 
+// 服务端流式事件的结构版本，与后端 dto.StreamSchemaVersion 一致
+export const STREAM_SCHEMA_VERSION = 1
+
+// 服务端事件类型（SSE 的 event 字段），与事件数据中的 type 一致
+const STREAM_EVENT_TYPES = ['start', 'context_trimmed', 'reasoning', 'chunk', 'done', 'complete', 'stopped'] as const
+
 export const createSSE = (
   path: string,
   options: {
@@ -31,28 +38,61 @@ export const createSSE = (
     payload: options.payload ? JSON.stringify(options.payload) : undefined,
   })
 
-  if (options.onMessage) {
-    sse.addEventListener('message', (e: MessageEvent) => {
-      try {
-        const data = JSON.parse(e.data)
-        options.onMessage!(data)
-      } catch (err) {
-        console.error('SSE消息解析失败:', err, e.data)
-      }
-    })
+  const parse = (e: MessageEvent) => {
+    try {
+      return JSON.parse(e.data)
+    } catch (err) {
+      console.error('SSE消息解析失败:', err, e.data)
+      return undefined
+    }
+  }
+
+  const handleMessage = (e: MessageEvent) => {
+    const data = parse(e)
+    if (data === undefined) {
+      return
+    }
+    if (data.v > STREAM_SCHEMA_VERSION) {
+      console.warn('SSE事件版本高于客户端支持的版本:', data.v)
+    }
+    options.onMessage?.(data)
   }
 
-  if (options.onError) {
-    sse.addEventListener('error', options.onError)
+  if (options.onMessage) {
+    // 未带 event 字段的事件按 message 分发
+    sse.addEventListener('message', handleMessage)
+    STREAM_EVENT_TYPES.forEach(type => sse.addEventListener(type, handleMessage))
   }
 
+  // 服务端的错误事件（event: error）与连接失败共用 error 事件名，按数据中的 type 区分
+  sse.addEventListener('error', (e: any) => {
+    let data: any
+    try {
+      data = e.data ? JSON.parse(e.data) : undefined
+    } catch {
+      data = undefined
+    }
+    if (data?.type === 'error' && data.v !== undefined) {
+      options.onMessage?.(data)
+      return
+    }
+    options.onError?.(e)
+  })
+
   if (options.onClose) {
     sse.addEventListener('close', options.onClose)
   }
 
   return {
     sseInstance: sse,
-    connect: () => sse.stream(),
+    // 访问令牌即将过期时先刷新，再建立连接
+    connect: () => ensureFreshToken().then(token => {
+      if (token) {
+        // SSE 实例持有 headers 的引用，stream() 时读取
+        headers.Authorization = `Bearer ${token}`
+      }
+      sse.stream()
+    }),
     close: () => {
       sse.close()
       options.onClose?.() 
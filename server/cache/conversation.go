@@ -1,24 +1,14 @@
 package cache
 
 import (
-	"context"
-	"encoding/json"
-	"fmt"
 	"log"
 	"server/dto"
 	"server/model"
-	"time"
 
 	"github.com/redis/go-redis/v9"
 	"gorm.io/gorm"
 )
 
-const (
-	// 会话上下文缓存Key：conversation_ctx:{conversationID}
-	conversationCtxKeyPrefix = "conversation_ctx:%d"
-	conversationCtxExpire    = 7 * 24 * time.Hour
-)
-
 type ConversationCache struct {
 	RDB *redis.Client
 	DB  *gorm.DB // 降级时用到DB
@@ -26,74 +16,72 @@ type ConversationCache struct {
 
 type Message = dto.Message
 
-func (cc *ConversationCache) GetConversationCtxFromRedis(convID uint) ([]Message, error) {
-	ctx := context.Background()
-	// 构建Redis Key：conversation_ctx:{convID}
-	key := fmt.Sprintf(conversationCtxKeyPrefix, convID)
-
-	// 从Redis获取序列化的上下文
-	jsonStr, err := cc.RDB.Get(ctx, key).Result()
-	if err != nil {
-		if err == redis.Nil {
-			return []Message{}, fmt.Errorf("缓存未命中")
-		}
-		return nil, err
-	}
-
-	// 反序列化为消息列表
-	var conversationCtx []Message
-	if err := json.Unmarshal([]byte(jsonStr), &conversationCtx); err != nil {
-		return nil, err
-	}
-
-	return conversationCtx, nil
+// BuildConversationCtxFromDB 沿当前分支构建会话上下文
+func (cc *ConversationCache) BuildConversationCtxFromDB(convID uint, uid uint) []Message {
+	return cc.buildCtx(convID, uid, ActivePath)
 }
 
-func (cc *ConversationCache) SetConversationCtxToRedis(convID uint, ctx []Message) error {
-	ctxRedis := context.Background()
-	key := fmt.Sprintf(conversationCtxKeyPrefix, convID)
-
-	// 序列化上下文
-	jsonStr, err := json.Marshal(ctx)
-	if err != nil {
-		return err
-	}
-
-	// 写入Redis并设置过期时间
-	return cc.RDB.Set(ctxRedis, key, jsonStr, conversationCtxExpire).Err()
+// BuildConversationCtxUntil 构建从根到指定消息（含）的上下文，用于重新生成回复和编辑消息
+// 摘要不在该路径上时不使用摘要，从头构建，超出窗口的部分由上下文裁剪处理
+func (cc *ConversationCache) BuildConversationCtxUntil(convID uint, uid uint, messageID uint) []Message {
+	return cc.buildCtx(convID, uid, func(messages []model.Message) []model.Message {
+		return PathTo(messages, messageID)
+	})
 }
 
-func (cc *ConversationCache) BuildConversationCtxFromDB(convID uint, uid uint) []Message {
-	// 初始化system消息
+// buildCtx 按 pathOf 选出的消息路径构建上下文，摘要覆盖到的消息在路径上时以摘要替代其之前的消息
+func (cc *ConversationCache) buildCtx(convID uint, uid uint, pathOf func([]model.Message) []model.Message) []Message {
+	// 初始化system消息，使用会话设置的系统提示词；存在滚动摘要时紧随其后
+	systemPrompt := model.DefaultSystemPrompt
+	var conversation model.Conversation
+	if err := cc.DB.Select("system_prompt", "summary", "summary_until_id").Where("id = ? AND user_id = ?", convID, uid).
+		First(&conversation).Error; err != nil {
+		log.Printf("读取会话设置失败，使用默认系统提示词：convID=%d, err=%v", convID, err)
+	} else {
+		systemPrompt = conversation.Settings.SystemPromptOrDefault()
+	}
 	conversationCtx := []Message{
-		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "system", Content: systemPrompt},
 	}
 
-	// 从数据库查询该会话的历史消息（按创建时间升序）
-	var messages []model.Message
-	if err := cc.DB.Where("conversation_id = ? AND user_id = ?", convID, uid).
-		Order("created_at ASC").Find(&messages).Error; err != nil {
+	messages, err := cc.LoadMessageTree(convID, uid)
+	if err != nil {
 		log.Printf("从数据库构建上下文失败：convID=%d, err=%v", convID, err)
 		return conversationCtx
 	}
+	path, summarized := AfterSummary(pathOf(messages), conversation.SummaryUntilID)
+	if summarized && conversation.Summary != "" {
+		conversationCtx = append(conversationCtx, SummaryMessage(conversation.Summary))
+	}
 
 	// 转换为AI需要的Message格式
-	for _, msg := range messages {
-		var role string
-		switch msg.MessageRole {
-		case model.MessageRoleUser:
-			role = "user"
-		case model.MessageRoleAI:
-			role = "assistant"
-		default:
-			log.Printf("检测到未知的消息角色类型，跳过该消息 | msgID=%d, roleValue=%d, content=%s",
-				msg.ID, msg.MessageRole, msg.Content)
+	for _, msg := range path {
+		ctxMsg, ok := ToContextMessage(msg)
+		if !ok {
 			continue
 		}
-		conversationCtx = append(conversationCtx, Message{
-			Role:    role,
-			Content: msg.Content,
-		})
+		conversationCtx = append(conversationCtx, ctxMsg)
 	}
 	return conversationCtx
 }
+
+// SummaryMessage 将滚动摘要包装为上下文中的system消息
+func SummaryMessage(summary string) Message {
+	return Message{Role: "system", Content: "以下是此前对话的摘要：\n" + summary}
+}
+
+// ToContextMessage 将数据库消息转换为AI上下文消息，未知角色返回false
+func ToContextMessage(msg model.Message) (Message, bool) {
+	var role string
+	switch msg.MessageRole {
+	case model.MessageRoleUser:
+		role = "user"
+	case model.MessageRoleAI:
+		role = "assistant"
+	default:
+		log.Printf("检测到未知的消息角色类型，跳过该消息 | msgID=%d, roleValue=%d, content=%s",
+			msg.ID, msg.MessageRole, msg.Content)
+		return Message{}, false
+	}
+	return Message{Role: role, Content: msg.Content}, true
+}
@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// 会话上下文缓存的失效控制
+// 上下文按版本存放：conversation_ctx_version:{conversationID} 记录当前版本号，
+// 内容位于 conversation_ctx:{conversationID}:v{version}。
+// 删除消息、删除会话、编辑、重新生成、切换分支等修改路径都通过 InvalidateConversationCtx 递增版本；
+// 写入时校验读取上下文时的版本，期间发生过修改则放弃写入并清空缓存，
+// 避免并发生成的旧上下文把已删除或已切换掉的对话写回缓存。
+
+const (
+	conversationCtxVersionKeyPrefix = "conversation_ctx_version:%d"
+	conversationCtxKeyPrefix        = "conversation_ctx:%d:v"
+	conversationCtxExpire           = 7 * 24 * time.Hour
+)
+
+// ErrCtxCacheMiss 缓存中没有当前版本的上下文
+var ErrCtxCacheMiss = errors.New("缓存未命中")
+
+// ErrCtxVersionConflict 读取上下文后缓存已失效，本次写入被放弃
+var ErrCtxVersionConflict = errors.New("上下文缓存已变更")
+
+// 原子读取当前版本号及该版本的内容
+var getConversationCtxScript = redis.NewScript(`
+local version = redis.call("GET", KEYS[1]) or "0"
+return {version, redis.call("GET", ARGV[1] .. version)}
+`)
+
+// 版本号与预期一致时写入新版本；不一致说明期间缓存已失效，只清空不写入。两种情况都会递增版本号
+var setConversationCtxScript = redis.NewScript(`
+local current = redis.call("GET", KEYS[1]) or "0"
+redis.call("DEL", ARGV[1] .. current)
+local next = redis.call("INCR", KEYS[1])
+redis.call("EXPIRE", KEYS[1], ARGV[4])
+if current ~= ARGV[2] then
+	return 0
+end
+redis.call("SET", ARGV[1] .. next, ARGV[3], "EX", ARGV[4])
+return 1
+`)
+
+// 递增版本号并清空当前内容，返回新版本号
+var invalidateConversationCtxScript = redis.NewScript(`
+local current = redis.call("GET", KEYS[1]) or "0"
+redis.call("DEL", ARGV[1] .. current)
+local next = redis.call("INCR", KEYS[1])
+redis.call("EXPIRE", KEYS[1], ARGV[2])
+return next
+`)
+
+func ctxKeys(convID uint) (string, string) {
+	return fmt.Sprintf(conversationCtxVersionKeyPrefix, convID), fmt.Sprintf(conversationCtxKeyPrefix, convID)
+}
+
+// GetConversationCtxFromRedis 读取会话上下文及其版本号，未命中时返回 ErrCtxCacheMiss 和当前版本号
+func (cc *ConversationCache) GetConversationCtxFromRedis(convID uint) ([]Message, int64, error) {
+	versionKey, prefix := ctxKeys(convID)
+	result, err := getConversationCtxScript.Run(context.Background(), cc.RDB, []string{versionKey}, prefix).Slice()
+	if err != nil {
+		return nil, 0, err
+	}
+	var version int64
+	fmt.Sscan(fmt.Sprint(result[0]), &version)
+	if len(result) < 2 || result[1] == nil {
+		return []Message{}, version, ErrCtxCacheMiss
+	}
+
+	// 反序列化为消息列表
+	var conversationCtx []Message
+	if err := json.Unmarshal([]byte(fmt.Sprint(result[1])), &conversationCtx); err != nil {
+		return nil, version, err
+	}
+	return conversationCtx, version, nil
+}
+
+// SetConversationCtxToRedis 写入会话上下文，version 为构建上下文前读到的版本号
+// 期间缓存已失效时放弃写入并返回 ErrCtxVersionConflict，下次读取时从数据库重建
+func (cc *ConversationCache) SetConversationCtxToRedis(convID uint, version int64, ctx []Message) error {
+	jsonStr, err := json.Marshal(ctx)
+	if err != nil {
+		return err
+	}
+
+	versionKey, prefix := ctxKeys(convID)
+	written, err := setConversationCtxScript.Run(context.Background(), cc.RDB, []string{versionKey},
+		prefix, version, jsonStr, int64(conversationCtxExpire/time.Second)).Int()
+	if err != nil {
+		return err
+	}
+	if written == 0 {
+		return ErrCtxVersionConflict
+	}
+	return nil
+}
+
+// InvalidateConversationCtx 会话消息被修改后使上下文缓存失效，返回新的版本号
+// 修改后立即构建新上下文的调用方（如重新生成）以返回的版本号写回
+func (cc *ConversationCache) InvalidateConversationCtx(convID uint) (int64, error) {
+	versionKey, prefix := ctxKeys(convID)
+	return invalidateConversationCtxScript.Run(context.Background(), cc.RDB, []string{versionKey},
+		prefix, int64(conversationCtxExpire/time.Second)).Int64()
+}
+
+// RefreshConversationCtx 使上下文缓存失效后按当前分支重建
+func (cc *ConversationCache) RefreshConversationCtx(convID uint, uid uint) error {
+	version, err := cc.InvalidateConversationCtx(convID)
+	if err != nil {
+		return err
+	}
+	return cc.SetConversationCtxToRedis(convID, version, cc.BuildConversationCtxFromDB(convID, uid))
+}
+
+// LoadConversationCtx 读取会话上下文及其版本号，Redis未命中时降级从数据库构建
+// 返回的版本号在写回时用于校验，未命中时同样有效
+func (cc *ConversationCache) LoadConversationCtx(convID uint, uid uint) ([]Message, int64) {
+	conversationCtx, version, err := cc.GetConversationCtxFromRedis(convID)
+	if err != nil {
+		log.Printf("读取Redis上下文失败，降级从数据库查询：convID=%d, err=%v", convID, err)
+		conversationCtx = cc.BuildConversationCtxFromDB(convID, uid)
+	}
+	return conversationCtx, version
+}
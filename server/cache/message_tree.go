@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"server/model"
+)
+
+// 消息树：每条消息通过 parent_id 指向上一条消息，编辑用户消息或重新生成回复会在同一父消息下产生兄弟节点，
+// 兄弟节点中 inactive 为 false 的是当前分支。从根开始逐层选择当前分支得到的路径即为会话的当前内容。
+
+// LoadMessageTree 读取会话的全部消息（含已删除），按ID升序
+// 已删除的消息保留在树中以维持父子关系，构建路径后再过滤
+func (cc *ConversationCache) LoadMessageTree(convID uint, uid uint) ([]model.Message, error) {
+	var messages []model.Message
+	err := cc.DB.Unscoped().Where("conversation_id = ? AND user_id = ?", convID, uid).
+		Order("id ASC").Find(&messages).Error
+	return messages, err
+}
+
+// ActivePath 从根开始沿当前分支向下，返回路径上未删除的消息
+func ActivePath(messages []model.Message) []model.Message {
+	var path []model.Message
+	for _, msg := range activeNodes(messages) {
+		if !msg.DeletedAt.Valid {
+			path = append(path, msg)
+		}
+	}
+	return path
+}
+
+// activeNodes 从根开始沿当前分支向下经过的全部消息（含已删除）
+func activeNodes(messages []model.Message) []model.Message {
+	children := make(map[uint][]int, len(messages))
+	for i, msg := range messages {
+		children[msg.ParentID] = append(children[msg.ParentID], i)
+	}
+
+	var nodes []model.Message
+	parentID := uint(0)
+	for {
+		siblings := children[parentID]
+		if len(siblings) == 0 {
+			return nodes
+		}
+		// 优先选择当前分支；数据异常没有当前分支时取最新的一条
+		chosen := siblings[len(siblings)-1]
+		for _, i := range siblings {
+			if !messages[i].Inactive {
+				chosen = i
+			}
+		}
+		if messages[chosen].ID == parentID {
+			return nodes
+		}
+		nodes = append(nodes, messages[chosen])
+		parentID = messages[chosen].ID
+	}
+}
+
+// PathTo 返回从根到指定消息（含）的路径上未删除的消息
+func PathTo(messages []model.Message, messageID uint) []model.Message {
+	byID := make(map[uint]model.Message, len(messages))
+	for _, msg := range messages {
+		byID[msg.ID] = msg
+	}
+
+	var reversed []model.Message
+	seen := map[uint]bool{}
+	for id := messageID; id != 0 && !seen[id]; {
+		msg, ok := byID[id]
+		if !ok {
+			break
+		}
+		seen[id] = true
+		if !msg.DeletedAt.Valid {
+			reversed = append(reversed, msg)
+		}
+		id = msg.ParentID
+	}
+
+	path := make([]model.Message, 0, len(reversed))
+	for i := len(reversed) - 1; i >= 0; i-- {
+		path = append(path, reversed[i])
+	}
+	return path
+}
+
+// ActiveLeafID 当前分支最末一条消息的ID，新消息以它为父消息；会话为空时返回0
+func (cc *ConversationCache) ActiveLeafID(convID uint, uid uint) (uint, error) {
+	var messages []model.Message
+	if err := cc.DB.Unscoped().Select("id", "parent_id", "inactive", "deleted_at").
+		Where("conversation_id = ? AND user_id = ?", convID, uid).
+		Order("id ASC").Find(&messages).Error; err != nil {
+		return 0, err
+	}
+	nodes := activeNodes(messages)
+	if len(nodes) == 0 {
+		return 0, nil
+	}
+	return nodes[len(nodes)-1].ID, nil
+}
+
+// AfterSummary 摘要覆盖到的消息位于路径上时返回其后的消息和 true，否则返回完整路径和 false
+func AfterSummary(path []model.Message, summaryUntilID uint) ([]model.Message, bool) {
+	if summaryUntilID == 0 {
+		return path, false
+	}
+	for i, msg := range path {
+		if msg.ID == summaryUntilID {
+			return path[i+1:], true
+		}
+	}
+	return path, false
+}
@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"reflect"
+	"testing"
+
+	"server/model"
+
+	"gorm.io/gorm"
+)
+
+// msg 构造消息树中的一个节点
+func msg(id, parentID uint, inactive, deleted bool) model.Message {
+	m := model.Message{ParentID: parentID, Inactive: inactive}
+	m.ID = id
+	if deleted {
+		m.DeletedAt = gorm.DeletedAt{Valid: true}
+	}
+	return m
+}
+
+func ids(messages []model.Message) []uint {
+	out := []uint{}
+	for _, m := range messages {
+		out = append(out, m.ID)
+	}
+	return out
+}
+
+// 1 ─ 2 ─ 3(inactive) ─ 5
+//
+//	└ 4 ─ 6(deleted) ─ 7
+var branchedTree = []model.Message{
+	msg(1, 0, false, false),
+	msg(2, 1, false, false),
+	msg(3, 2, true, false),
+	msg(4, 2, false, false),
+	msg(5, 3, false, false),
+	msg(6, 4, false, true),
+	msg(7, 6, false, false),
+}
+
+func TestActiveNodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []model.Message
+		want     []uint
+	}{
+		{"空会话", nil, []uint{}},
+		{"单条消息", []model.Message{msg(1, 0, false, false)}, []uint{1}},
+		{"沿当前分支向下，含已删除节点", branchedTree, []uint{1, 2, 4, 6, 7}},
+		{
+			"没有当前分支时取最新的兄弟",
+			[]model.Message{msg(1, 0, false, false), msg(2, 1, true, false), msg(3, 1, true, false)},
+			[]uint{1, 3},
+		},
+		{
+			"多个当前分支时取最新的一条",
+			[]model.Message{msg(1, 0, false, false), msg(2, 1, false, false), msg(3, 1, false, false)},
+			[]uint{1, 3},
+		},
+		{"自引用的脏数据不会死循环", []model.Message{msg(1, 0, false, false), msg(2, 2, false, false)}, []uint{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ids(activeNodes(tt.messages)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("activeNodes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestActivePath(t *testing.T) {
+	if got, want := ids(ActivePath(branchedTree)), []uint{1, 2, 4, 7}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ActivePath = %v, want %v", got, want)
+	}
+}
+
+func TestPathTo(t *testing.T) {
+	tests := []struct {
+		name      string
+		messages  []model.Message
+		messageID uint
+		want      []uint
+	}{
+		{"当前分支上的消息", branchedTree, 4, []uint{1, 2, 4}},
+		{"非当前分支上的消息", branchedTree, 5, []uint{1, 2, 3, 5}},
+		{"跳过已删除的祖先", branchedTree, 7, []uint{1, 2, 4, 7}},
+		{"目标消息已删除", branchedTree, 6, []uint{1, 2, 4}},
+		{"消息不存在", branchedTree, 99, []uint{}},
+		{"环状的脏数据不会死循环", []model.Message{msg(1, 2, false, false), msg(2, 1, false, false)}, 2, []uint{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ids(PathTo(tt.messages, tt.messageID)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PathTo = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAfterSummary(t *testing.T) {
+	path := ActivePath(branchedTree)
+	tests := []struct {
+		name       string
+		untilID    uint
+		want       []uint
+		wantCovers bool
+	}{
+		{"没有摘要", 0, []uint{1, 2, 4, 7}, false},
+		{"摘要覆盖到路径中间", 2, []uint{4, 7}, true},
+		{"摘要覆盖到最后一条", 7, []uint{}, true},
+		{"摘要位于其他分支", 3, []uint{1, 2, 4, 7}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, covers := AfterSummary(path, tt.untilID)
+			if !reflect.DeepEqual(ids(got), tt.want) || covers != tt.wantCovers {
+				t.Errorf("AfterSummary = %v, %v, want %v, %v", ids(got), covers, tt.want, tt.wantCovers)
+			}
+		})
+	}
+}
@@ -1,17 +1,27 @@
 package controller
 
 import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
 	"net/http"
 	"server/middleware"
 	"server/model"
+	"server/services"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
 type AuthController struct {
-	DB *gorm.DB
+	DB     *gorm.DB
+	RDB    *redis.Client
+	Mailer services.Mailer
 }
 
 type RegisterRequest struct {
@@ -25,6 +35,46 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required,min=6,max=20"`
 }
 
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// ForgotPasswordRequest 重置密码和重新发送验证邮件共用
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=6,max=20"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// startSession 创建登录会话，签发访问令牌和该会话的第一个刷新令牌
+func (ac AuthController) startSession(c *gin.Context, userID uint, username string) (gin.H, error) {
+	refreshSvc := services.RefreshTokenService{DB: ac.DB}
+	session, refreshToken, err := refreshSvc.StartSession(userID, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		return nil, err
+	}
+	token, err := middleware.GenerateToken(userID, username, session.FamilyID)
+	if err != nil {
+		return nil, err
+	}
+	return gin.H{
+		"token":         token,
+		"refresh_token": refreshToken,
+		"expires_in":    int64(middleware.AccessTokenTTL().Seconds()),
+	}, nil
+}
+
 func (ac AuthController) Register(c *gin.Context) {
 	var req RegisterRequest
 
@@ -84,7 +134,22 @@ func (ac AuthController) Register(c *gin.Context) {
 		return
 	}
 
-	token, err := middleware.GenerateToken(newUser.ID, newUser.Username)
+	ac.sendVerificationMail(c, &newUser)
+
+	// 要求验证邮箱时不直接登录，验证后再登录
+	if services.RequireEmailVerified() {
+		c.JSON(http.StatusOK, gin.H{
+			"code": 200,
+			"msg":  "注册成功，请查收验证邮件，验证邮箱后登录",
+			"data": gin.H{
+				"email_verification_required": true,
+				"user":                        userResponse(&newUser),
+			},
+		})
+		return
+	}
+
+	tokens, err := ac.startSession(c, newUser.ID, newUser.Username)
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -99,19 +164,90 @@ func (ac AuthController) Register(c *gin.Context) {
 		"code": 200,
 		"msg":  "注册成功",
 		"data": gin.H{
-			"token": token,
-			"user": gin.H{
-				"id":         newUser.ID,
-				"username":   newUser.Username,
-				"email":      newUser.Email,
-				"nickname":   newUser.Nickname,
-				"avatar":     newUser.Avatar,
-				"created_at": newUser.CreatedAt,
-			},
+			"token":         tokens["token"],
+			"refresh_token": tokens["refresh_token"],
+			"expires_in":    tokens["expires_in"],
+			"user":          userResponse(&newUser),
 		},
 	})
 }
 
+// userResponse 返回给客户端的用户信息
+func userResponse(user *model.User) gin.H {
+	return gin.H{
+		"id":                user.ID,
+		"username":          user.Username,
+		"email":             user.Email,
+		"email_verified_at": user.EmailVerifiedAt,
+		"nickname":          user.Nickname,
+		"avatar":            user.Avatar,
+		"created_at":        user.CreatedAt,
+	}
+}
+
+// sendVerificationMail 在后台发送验证邮箱的邮件
+func (ac AuthController) sendVerificationMail(c *gin.Context, user *model.User) {
+	tokenSvc := services.EmailTokenService{RDB: ac.RDB}
+	if !tokenSvc.AllowSend(c.Request.Context(), services.EmailTokenVerify, user.ID) {
+		return
+	}
+	token, err := tokenSvc.Issue(services.EmailTokenVerify, user)
+	if err != nil {
+		log.Printf("签发邮箱验证令牌失败：user_id=%d, err=%v", user.ID, err)
+		return
+	}
+	services.SendMailAsync(ac.Mailer, services.Mail{
+		To:      user.Email,
+		Subject: "验证你的 MyChat 邮箱",
+		Body: fmt.Sprintf("%s，你好：\n\n请打开以下链接验证邮箱，链接%d小时内有效：\n%s\n\n如果这不是你的操作，请忽略本邮件。\n",
+			user.Nickname, int(services.EmailTokenTTL(services.EmailTokenVerify).Hours()), services.EmailLink("/verify-email", token)),
+		Secrets: []string{token},
+	})
+}
+
+// respondLoginBlocked 登录被防护拒绝时返回429和 Retry-After
+func respondLoginBlocked(c *gin.Context, block *services.LoginBlock) {
+	retryAfter := int64(math.Ceil(block.RetryAfter.Seconds()))
+	msg := "登录失败次数过多，请稍后再试"
+	if block.Locked {
+		msg = fmt.Sprintf("登录失败次数过多，账号已暂时锁定，请%d分钟后再试", (retryAfter+59)/60)
+	}
+	c.Header("Retry-After", strconv.FormatInt(retryAfter, 10))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"code": 429,
+		"msg":  msg,
+		"data": gin.H{
+			"locked":      block.Locked,
+			"retry_after": retryAfter,
+		},
+	})
+}
+
+// respondLoginFailed 用户名或密码错误；需要等待后才能再次尝试时带上 Retry-After
+func respondLoginFailed(c *gin.Context, block *services.LoginBlock) {
+	if block != nil && block.Locked {
+		respondLoginBlocked(c, block)
+		return
+	}
+	var data interface{}
+	if block != nil {
+		retryAfter := int64(math.Ceil(block.RetryAfter.Seconds()))
+		c.Header("Retry-After", strconv.FormatInt(retryAfter, 10))
+		data = gin.H{"retry_after": retryAfter}
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{
+		"code": 401,
+		"msg":  "用户名或密码错误",
+		"data": data,
+	})
+}
+
+/**
+ * Login 用户登录
+ * 1. 用户名或IP处于锁定或等待中时直接返回429，不校验密码
+ * 2. 失败时按用户名和IP分别计数，超过一定次数后每次失败需要等待更久，达到阈值后暂时锁定
+ * 3. 成功时清除该用户名的失败计数，创建登录会话；REQUIRE_EMAIL_VERIFIED=true 时邮箱未验证的账号不能登录
+ */
 func (ac AuthController) Login(c *gin.Context) {
 	var req LoginRequest
 
@@ -124,30 +260,116 @@ func (ac AuthController) Login(c *gin.Context) {
 		return
 	}
 
+	guard := services.LoginGuard{DB: ac.DB, RDB: ac.RDB}
+	ip := c.ClientIP()
+	if block := guard.Check(c.Request.Context(), req.Username, ip); block != nil {
+		respondLoginBlocked(c, block)
+		return
+	}
+
 	var user model.User
 
 	if err := ac.DB.Where("username = ?", req.Username).First(&user).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{
-			"code": 401,
-			"msg":  "用户名或密码错误",
+		respondLoginFailed(c, guard.RecordFailure(c.Request.Context(), 0, req.Username, ip))
+		return
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password))
+
+	if err != nil {
+		respondLoginFailed(c, guard.RecordFailure(c.Request.Context(), user.ID, req.Username, ip))
+		return
+	}
+
+	guard.RecordSuccess(c.Request.Context(), req.Username)
+
+	if services.RequireEmailVerified() && user.EmailVerifiedAt == 0 {
+		c.JSON(http.StatusForbidden, gin.H{
+			"code": 403,
+			"msg":  "邮箱尚未验证，请先查收验证邮件",
+			"data": gin.H{"email_verification_required": true},
+		})
+		return
+	}
+
+	tokens, err := ac.startSession(c, user.ID, user.Username)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "令牌生成失败",
 			"data": nil,
 		})
 		return
 	}
 
-	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password))
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "登录成功",
+		"data": gin.H{
+			"user":          userResponse(&user),
+			"token":         tokens["token"],
+			"refresh_token": tokens["refresh_token"],
+			"expires_in":    tokens["expires_in"],
+		},
+	})
+}
 
+/**
+ * Refresh 凭刷新令牌换取新的访问令牌
+ * 1. 刷新令牌每次使用后轮换，响应中返回新的刷新令牌，旧令牌随即失效
+ * 2. 已轮换的刷新令牌再次出现（可能已泄露）时，作废整个家族的刷新令牌和访问令牌，需要重新登录
+ */
+func (ac AuthController) Refresh(c *gin.Context) {
+	var req RefreshRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "请求参数错误",
+			"data": nil,
+		})
+		return
+	}
+
+	refreshSvc := services.RefreshTokenService{DB: ac.DB}
+	record, next, err := refreshSvc.Rotate(req.RefreshToken, c.ClientIP())
 	if err != nil {
+		if errors.Is(err, services.ErrRefreshTokenReused) {
+			log.Printf("检测到刷新令牌重用，已作废令牌家族：user_id=%d, family_id=%s", record.UserID, record.FamilyID)
+			if err := middleware.RevokeTokenFamily(c.Request.Context(), record.FamilyID); err != nil {
+				log.Printf("作废令牌家族的访问令牌失败：family_id=%s, err=%v", record.FamilyID, err)
+			}
+		}
+		if errors.Is(err, services.ErrRefreshTokenReused) || errors.Is(err, services.ErrRefreshTokenInvalid) {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"code": 401,
+				"msg":  err.Error(),
+				"data": nil,
+			})
+			return
+		}
+		log.Printf("刷新令牌失败：err=%v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "令牌刷新失败",
+			"data": nil,
+		})
+		return
+	}
+
+	var user model.User
+	if err := ac.DB.First(&user, record.UserID).Error; err != nil {
+		refreshSvc.RevokeFamily(record.FamilyID)
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"code": 401,
-			"msg":  "用户名或密码错误",
+			"msg":  "用户不存在",
 			"data": nil,
 		})
 		return
 	}
 
-	token, err := middleware.GenerateToken(user.ID, user.Username)
-
+	token, err := middleware.GenerateToken(user.ID, user.Username, record.FamilyID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"code": 500,
@@ -159,17 +381,434 @@ func (ac AuthController) Login(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{
 		"code": 200,
-		"msg":  "登录成功",
+		"msg":  "刷新成功",
 		"data": gin.H{
-			"user": gin.H{
-				"id":         user.ID,
-				"username":   user.Username,
-				"email":      user.Email,
-				"nickname":   user.Nickname,
-				"avatar":     user.Avatar,
-				"created_at": user.CreatedAt,
-			},
-			"token": token,
+			"token":         token,
+			"refresh_token": next,
+			"expires_in":    int64(middleware.AccessTokenTTL().Seconds()),
 		},
 	})
 }
+
+/**
+ * Logout 退出登录
+ * 1. 携带刷新令牌时作废其所在家族（本次登录签发的全部刷新令牌和访问令牌）
+ * 2. 携带有效的访问令牌时作废该访问令牌；访问令牌已过期时只需刷新令牌
+ */
+func (ac AuthController) Logout(c *gin.Context) {
+	var req LogoutRequest
+	c.ShouldBindJSON(&req)
+
+	revoked := false
+	if req.RefreshToken != "" {
+		refreshSvc := services.RefreshTokenService{DB: ac.DB}
+		record, err := refreshSvc.Revoke(req.RefreshToken)
+		if err != nil && !errors.Is(err, services.ErrRefreshTokenInvalid) {
+			log.Printf("作废刷新令牌失败：err=%v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"code": 500,
+				"msg":  "退出登录失败",
+				"data": nil,
+			})
+			return
+		}
+		if record != nil {
+			revoked = true
+			if err := middleware.RevokeTokenFamily(c.Request.Context(), record.FamilyID); err != nil {
+				log.Printf("作废令牌家族的访问令牌失败：family_id=%s, err=%v", record.FamilyID, err)
+			}
+		}
+	}
+
+	if tokenString, err := middleware.BearerToken(c); err == nil {
+		if claims, err := middleware.ParseToken(tokenString); err == nil {
+			revoked = true
+			if err := middleware.RevokeAccessToken(c.Request.Context(), claims); err != nil {
+				log.Printf("作废访问令牌失败：user_id=%d, err=%v", claims.UserID, err)
+			}
+		}
+	}
+
+	if !revoked {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code": 401,
+			"msg":  "未携带有效的令牌",
+			"data": nil,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "已退出登录",
+		"data": nil,
+	})
+}
+
+/**
+ * ListSessions 获取当前用户的登录会话（设备、IP、登录时间、最近活跃时间）
+ * 最近活跃时间在每次刷新访问令牌时更新；current 标记发起本次请求的会话
+ */
+func (ac AuthController) ListSessions(c *gin.Context) {
+	uid, ok := currentUID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code": 401,
+			"msg":  "用户未登录",
+			"data": nil,
+		})
+		return
+	}
+
+	refreshSvc := services.RefreshTokenService{DB: ac.DB}
+	sessions, err := refreshSvc.ListSessions(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "获取登录会话失败",
+			"data": nil,
+		})
+		return
+	}
+
+	familyID := c.GetString("tokenFamilyID")
+	list := make([]gin.H, 0, len(sessions))
+	for _, session := range sessions {
+		list = append(list, gin.H{
+			"id":           session.ID,
+			"user_agent":   session.UserAgent,
+			"ip":           session.IP,
+			"created_at":   session.CreatedAt,
+			"last_seen_at": session.LastSeenAt,
+			"expires_at":   session.ExpiresAt,
+			"current":      familyID != "" && session.FamilyID == familyID,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "获取成功",
+		"data": list,
+	})
+}
+
+/**
+ * RevokeSession 移除一个登录会话（在其他设备上退出登录）
+ * 作废该会话的刷新令牌，已签发的访问令牌随即被 JWTAuth 拒绝
+ */
+func (ac AuthController) RevokeSession(c *gin.Context) {
+	uid, ok := currentUID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code": 401,
+			"msg":  "用户未登录",
+			"data": nil,
+		})
+		return
+	}
+
+	sessionID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "会话ID格式错误",
+			"data": nil,
+		})
+		return
+	}
+
+	refreshSvc := services.RefreshTokenService{DB: ac.DB}
+	session, err := refreshSvc.RevokeSession(uid, uint(sessionID))
+	if err != nil {
+		if errors.Is(err, services.ErrSessionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"code": 404,
+				"msg":  err.Error(),
+				"data": nil,
+			})
+			return
+		}
+		log.Printf("移除登录会话失败：user_id=%d, session_id=%d, err=%v", uid, sessionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "移除登录会话失败",
+			"data": nil,
+		})
+		return
+	}
+
+	if err := middleware.RevokeTokenFamily(c.Request.Context(), session.FamilyID); err != nil {
+		log.Printf("作废登录会话的访问令牌失败：session_id=%d, err=%v", session.ID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "已移除登录会话",
+		"data": gin.H{"id": session.ID},
+	})
+}
+
+/**
+ * Unlock 解除当前账号的登录锁定
+ * 账号因他人猜测密码被锁定时，用户可在仍处于登录状态的设备上解除；锁定也会在 LOGIN_LOCKOUT_MINUTES 后自动解除
+ */
+func (ac AuthController) Unlock(c *gin.Context) {
+	uid, ok := currentUID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code": 401,
+			"msg":  "用户未登录",
+			"data": nil,
+		})
+		return
+	}
+
+	var user model.User
+	if err := ac.DB.First(&user, uid).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code": 404,
+			"msg":  "用户不存在",
+			"data": nil,
+		})
+		return
+	}
+
+	guard := services.LoginGuard{DB: ac.DB, RDB: ac.RDB}
+	if err := guard.Unlock(c.Request.Context(), user.ID, user.Username, c.ClientIP(), "用户在已登录的设备上解除"); err != nil {
+		log.Printf("解除登录锁定失败：user_id=%d, err=%v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "解除锁定失败",
+			"data": nil,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "已解除登录锁定",
+		"data": nil,
+	})
+}
+
+/**
+ * SendVerificationEmail 重新发送验证邮箱的邮件
+ * 要求验证邮箱时未验证的用户无法登录，因此按邮箱发送，不需要登录；
+ * 无论邮箱是否已注册、是否已验证都返回相同的结果，同一用户在 MAIL_COOLDOWN_SECONDS 内只发送一次
+ */
+func (ac AuthController) SendVerificationEmail(c *gin.Context) {
+	var req ForgotPasswordRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "请求参数错误",
+			"data": nil,
+		})
+		return
+	}
+
+	var user model.User
+	if err := ac.DB.Where("email = ?", req.Email).First(&user).Error; err == nil && user.EmailVerifiedAt == 0 {
+		ac.sendVerificationMail(c, &user)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "如果该邮箱已注册且尚未验证，验证邮件将发送到该邮箱",
+		"data": nil,
+	})
+}
+
+/**
+ * VerifyEmail 使用邮件中的令牌验证邮箱
+ * 令牌带签名和有效期，只能使用一次，邮箱变更后失效
+ */
+func (ac AuthController) VerifyEmail(c *gin.Context) {
+	var req VerifyEmailRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "请求参数错误",
+			"data": nil,
+		})
+		return
+	}
+
+	tokenSvc := services.EmailTokenService{RDB: ac.RDB}
+	user, err := ac.consumeEmailToken(c, &tokenSvc, services.EmailTokenVerify, req.Token)
+	if err != nil {
+		return
+	}
+
+	if user.EmailVerifiedAt == 0 {
+		user.EmailVerifiedAt = time.Now().Unix()
+		if err := ac.DB.Model(user).Update("email_verified_at", user.EmailVerifiedAt).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"code": 500,
+				"msg":  "邮箱验证失败",
+				"data": nil,
+			})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "邮箱验证成功",
+		"data": gin.H{"email_verified_at": user.EmailVerifiedAt},
+	})
+}
+
+/**
+ * ForgotPassword 发送重置密码的邮件
+ * 无论邮箱是否已注册都返回相同的结果，避免泄露注册信息
+ */
+func (ac AuthController) ForgotPassword(c *gin.Context) {
+	var req ForgotPasswordRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "请求参数错误",
+			"data": nil,
+		})
+		return
+	}
+
+	var user model.User
+	if err := ac.DB.Where("email = ?", req.Email).First(&user).Error; err == nil {
+		tokenSvc := services.EmailTokenService{RDB: ac.RDB}
+		if tokenSvc.AllowSend(c.Request.Context(), services.EmailTokenReset, user.ID) {
+			if token, err := tokenSvc.Issue(services.EmailTokenReset, &user); err != nil {
+				log.Printf("签发重置密码令牌失败：user_id=%d, err=%v", user.ID, err)
+			} else {
+				services.SendMailAsync(ac.Mailer, services.Mail{
+					To:      user.Email,
+					Subject: "重置你的 MyChat 密码",
+					Body: fmt.Sprintf("%s，你好：\n\n请打开以下链接重置密码，链接%d分钟内有效且只能使用一次：\n%s\n\n如果这不是你的操作，请忽略本邮件，你的密码不会改变。\n",
+						user.Nickname, int(services.EmailTokenTTL(services.EmailTokenReset).Minutes()), services.EmailLink("/reset-password", token)),
+					Secrets: []string{token},
+				})
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "如果该邮箱已注册，重置密码的邮件将发送到该邮箱",
+		"data": nil,
+	})
+}
+
+/**
+ * ResetPassword 使用邮件中的令牌重置密码
+ * 1. 令牌带签名和有效期，只能使用一次，密码变更后失效
+ * 2. 重置后作废该用户的所有登录会话，并解除登录锁定；能收到邮件即证明拥有该邮箱，同时标记邮箱已验证
+ */
+func (ac AuthController) ResetPassword(c *gin.Context) {
+	var req ResetPasswordRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "请求参数错误",
+			"data": nil,
+		})
+		return
+	}
+
+	tokenSvc := services.EmailTokenService{RDB: ac.RDB}
+	user, err := ac.consumeEmailToken(c, &tokenSvc, services.EmailTokenReset, req.Token)
+	if err != nil {
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "密码加密失败",
+			"data": nil,
+		})
+		return
+	}
+
+	updates := map[string]interface{}{"password": string(hashedPassword)}
+	if user.EmailVerifiedAt == 0 {
+		updates["email_verified_at"] = time.Now().Unix()
+	}
+	if err := ac.DB.Model(user).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "重置密码失败",
+			"data": nil,
+		})
+		return
+	}
+
+	refreshSvc := services.RefreshTokenService{DB: ac.DB}
+	familyIDs, err := refreshSvc.RevokeUser(user.ID)
+	if err != nil {
+		log.Printf("重置密码后作废登录会话失败：user_id=%d, err=%v", user.ID, err)
+	}
+	for _, familyID := range familyIDs {
+		if err := middleware.RevokeTokenFamily(c.Request.Context(), familyID); err != nil {
+			log.Printf("作废登录会话的访问令牌失败：family_id=%s, err=%v", familyID, err)
+		}
+	}
+
+	guard := services.LoginGuard{DB: ac.DB, RDB: ac.RDB}
+	if err := guard.Unlock(c.Request.Context(), user.ID, user.Username, c.ClientIP(), "通过邮件重置密码"); err != nil {
+		log.Printf("重置密码后解除登录锁定失败：user_id=%d, err=%v", user.ID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "密码已重置，请重新登录",
+		"data": nil,
+	})
+}
+
+// consumeEmailToken 校验并使用邮件令牌，返回令牌对应的用户；失败时已写入响应
+func (ac AuthController) consumeEmailToken(c *gin.Context, tokenSvc *services.EmailTokenService, purpose string, token string) (*model.User, error) {
+	claims, err := tokenSvc.Parse(purpose, token)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  err.Error(),
+			"data": nil,
+		})
+		return nil, err
+	}
+
+	var user model.User
+	if err := ac.DB.First(&user, claims.UserID).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  services.ErrEmailTokenInvalid.Error(),
+			"data": nil,
+		})
+		return nil, services.ErrEmailTokenInvalid
+	}
+
+	if err := tokenSvc.Consume(c.Request.Context(), claims, &user); err != nil {
+		if errors.Is(err, services.ErrEmailTokenInvalid) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code": 400,
+				"msg":  err.Error(),
+				"data": nil,
+			})
+			return nil, err
+		}
+		log.Printf("使用邮件令牌失败：user_id=%d, err=%v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "服务暂不可用，请稍后再试",
+			"data": nil,
+		})
+		return nil, err
+	}
+	return &user, nil
+}
@@ -4,14 +4,19 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"server/cache"
 	"server/model"
+	"server/services"
+	"server/utils"
 
 	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
 	"gorm.io/gorm"
 )
 
 type ConversationController struct {
-	DB *gorm.DB
+	DB  *gorm.DB
+	RDB *redis.Client
 }
 
 type CreateRequest struct {
@@ -23,6 +28,24 @@ type GetConversationListQuery struct {
 	PageSize int `form:"page_size"`
 }
 
+type ForkRequest struct {
+	ConversationID uint   `json:"conversation_id" binding:"required"`
+	MessageID      uint   `json:"message_id" binding:"required"`
+	Title          string `json:"title" binding:"max=255"`
+}
+
+type UpdateSettingsRequest struct {
+	Provider       string   `json:"provider" binding:"max=32"`
+	Model          string   `json:"model" binding:"max=64"`
+	Temperature    *float64 `json:"temperature" binding:"omitempty,min=0,max=2"`
+	TopP           *float64 `json:"top_p" binding:"omitempty,gt=0,max=1"`
+	MaxTokens      *int     `json:"max_tokens" binding:"omitempty,min=1"`
+	SystemPrompt   string   `json:"system_prompt" binding:"max=8000"`
+	EnableSearch   *bool    `json:"enable_search"`
+	EnableThinking *bool    `json:"enable_thinking"`
+	Fallbacks      string   `json:"fallbacks" binding:"max=512"`
+}
+
 func (cc *ConversationController) CreateConversation(c *gin.Context) {
 	var req CreateRequest
 
@@ -224,6 +247,11 @@ func (cc *ConversationController) DeleteConversation(c *gin.Context) {
 		return
 	}
 
+	conversationCache := cache.ConversationCache{DB: cc.DB, RDB: cc.RDB}
+	if _, err := conversationCache.InvalidateConversationCtx(conversation.ID); err != nil {
+		log.Printf("清除Redis上下文失败：convID=%d, err=%v", conversation.ID, err)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"code": 200,
 		"msg":  "删除对话成功",
@@ -231,3 +259,310 @@ func (cc *ConversationController) DeleteConversation(c *gin.Context) {
 	})
 
 }
+
+func (cc *ConversationController) GetSettings(c *gin.Context) {
+	var conversationID uint
+	if _, err := fmt.Sscanf(c.Param("conversation_id"), "%d", &conversationID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "请求参数错误",
+			"data": nil,
+		})
+		return
+	}
+
+	currentUserID, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{
+			"code": 403,
+			"msg":  "未获取到用户身份信息，无权限查看对话设置",
+			"data": nil,
+		})
+		return
+	}
+	uid, ok := currentUserID.(uint)
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{
+			"code": 403,
+			"msg":  "你没有权限查看该用户的对话设置",
+			"data": nil,
+		})
+		return
+	}
+
+	var conversation model.Conversation
+	if err := cc.DB.Where("id = ? AND user_id = ?", conversationID, uid).First(&conversation).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code": 404,
+			"msg":  "对话不存在",
+			"data": nil,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "获取对话设置成功",
+		"data": conversation.Settings,
+	})
+}
+
+func (cc *ConversationController) UpdateSettings(c *gin.Context) {
+	var conversationID uint
+	if _, err := fmt.Sscanf(c.Param("conversation_id"), "%d", &conversationID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "请求参数错误",
+			"data": nil,
+		})
+		return
+	}
+
+	var req UpdateSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "请求参数错误",
+			"data": nil,
+		})
+		return
+	}
+
+	provider, err := services.GetProvider(req.Provider)
+	if err != nil && req.Provider != "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  err.Error(),
+			"data": nil,
+		})
+		return
+	}
+
+	// 未指定模型时按提供方的默认模型校验
+	effectiveModel := req.Model
+	if effectiveModel == "" && provider != nil {
+		effectiveModel = provider.DefaultModel()
+	}
+	if err := services.ValidateMaxTokens(effectiveModel, req.MaxTokens); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  err.Error(),
+			"data": nil,
+		})
+		return
+	}
+
+	fallbacks, err := services.ParseModelTargets(req.Fallbacks)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  err.Error(),
+			"data": nil,
+		})
+		return
+	}
+	for _, target := range fallbacks {
+		if _, err := services.GetProvider(target.Provider); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code": 400,
+				"msg":  err.Error(),
+				"data": nil,
+			})
+			return
+		}
+	}
+
+	currentUserID, ok := c.Get("userID")
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{
+			"code": 403,
+			"msg":  "未获取到用户身份信息，无权限修改对话设置",
+			"data": nil,
+		})
+		return
+	}
+	uid, ok := currentUserID.(uint)
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{
+			"code": 403,
+			"msg":  "你没有权限修改该用户的对话设置",
+			"data": nil,
+		})
+		return
+	}
+
+	var conversation model.Conversation
+	if err := cc.DB.Where("id = ? AND user_id = ?", conversationID, uid).First(&conversation).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code": 404,
+			"msg":  "对话不存在",
+			"data": nil,
+		})
+		return
+	}
+
+	conversation.Settings = model.ConversationSettings{
+		Provider:       req.Provider,
+		Model:          req.Model,
+		Temperature:    req.Temperature,
+		TopP:           req.TopP,
+		MaxTokens:      req.MaxTokens,
+		SystemPrompt:   req.SystemPrompt,
+		EnableSearch:   req.EnableSearch,
+		EnableThinking: req.EnableThinking,
+		Fallbacks:      req.Fallbacks,
+	}
+
+	// 使用 Select 保证清空的字段（如置空的系统提示词）也会被写入
+	if err := cc.DB.Model(&conversation).
+		Select("provider", "model", "temperature", "top_p", "max_tokens", "system_prompt", "enable_search", "enable_thinking", "fallbacks").
+		Updates(&conversation).Error; err != nil {
+		log.Printf("更新对话设置失败：conversation_id=%d, err=%v", conversationID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "更新对话设置失败",
+			"data": nil,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "更新对话设置成功",
+		"data": conversation.Settings,
+	})
+}
+
+/**
+ * ForkConversation 从指定消息分叉出新会话
+ * 1. 复制从第一条消息到指定消息（含）这一路径上的消息到新会话，保留原有时间和父子关系
+ * 2. 沿用原会话的设置；摘要覆盖的消息都在复制范围内时一并沿用摘要
+ * 3. 为新会话初始化Redis上下文缓存
+ */
+func (cc *ConversationController) ForkConversation(c *gin.Context) {
+	var req ForkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "请求参数错误",
+			"data": nil,
+		})
+		return
+	}
+
+	uid, ok := currentUID(c)
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{
+			"code": 403,
+			"msg":  "未获取到用户身份信息，无权限复制对话",
+			"data": nil,
+		})
+		return
+	}
+
+	var source model.Conversation
+	if err := cc.DB.Where("id = ? AND user_id = ?", req.ConversationID, uid).First(&source).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code": 404,
+			"msg":  "对话不存在",
+			"data": nil,
+		})
+		return
+	}
+
+	conversationCache := cache.ConversationCache{DB: cc.DB, RDB: cc.RDB}
+	tree, err := conversationCache.LoadMessageTree(source.ID, uid)
+	if err != nil {
+		log.Printf("读取消息失败：conversation_id=%d, err=%v", source.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "复制对话失败",
+			"data": nil,
+		})
+		return
+	}
+	path := cache.PathTo(tree, req.MessageID)
+	if len(path) == 0 || path[len(path)-1].ID != req.MessageID {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "消息不存在或不属于该对话",
+			"data": nil,
+		})
+		return
+	}
+
+	title := req.Title
+	if title == "" {
+		title = source.Title + "（分支）"
+	}
+	last := path[len(path)-1]
+	fork := model.Conversation{
+		Title:     title,
+		UserID:    uid,
+		LastMsg:   utils.SafeTruncateStr(last.Content, 10),
+		LastMsgAt: &last.CreatedAt,
+		Settings:  source.Settings,
+	}
+
+	err = cc.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&fork).Error; err != nil {
+			return err
+		}
+
+		// 新会话中的消息依次相连，用量不重复计入
+		parentID := uint(0)
+		for _, msg := range path {
+			copied := model.Message{
+				CreatedAt:        msg.CreatedAt,
+				Content:          msg.Content,
+				ReasoningContent: msg.ReasoningContent,
+				Type:             msg.Type,
+				MessageRole:      msg.MessageRole,
+				UserID:           uid,
+				ConversationID:   fork.ID,
+				Provider:         msg.Provider,
+				Model:            msg.Model,
+				Interrupted:      msg.Interrupted,
+				ParentID:         parentID,
+				SourceID:         msg.ID,
+			}
+			if err := tx.Create(&copied).Error; err != nil {
+				return err
+			}
+			parentID = copied.ID
+			if msg.ID == source.SummaryUntilID && source.Summary != "" {
+				fork.Summary, fork.SummaryUntilID = source.Summary, copied.ID
+			}
+		}
+		if fork.SummaryUntilID == 0 {
+			return nil
+		}
+		return tx.Model(&fork).Updates(map[string]interface{}{
+			"summary":          fork.Summary,
+			"summary_until_id": fork.SummaryUntilID,
+		}).Error
+	})
+	if err != nil {
+		log.Printf("复制对话失败：conversation_id=%d, message_id=%d, err=%v", source.ID, req.MessageID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "复制对话失败",
+			"data": nil,
+		})
+		return
+	}
+
+	conversationCtx := conversationCache.BuildConversationCtxFromDB(fork.ID, uid)
+	if err := conversationCache.SetConversationCtxToRedis(fork.ID, 0, conversationCtx); err != nil {
+		log.Printf("初始化会话Redis上下文失败：convID=%d, err=%v", fork.ID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "复制对话成功",
+		"data": gin.H{
+			"conversation":  fork,
+			"message_count": len(path),
+		},
+	})
+}
@@ -0,0 +1,25 @@
+// DiagnosticsController 诊断控制器
+// 负责暴露AI提供方熔断器等运行状态，便于排查上游故障
+package controller
+
+import (
+	"net/http"
+	"server/services" // 服务包，包含AI提供方容错等业务逻辑
+
+	"github.com/gin-gonic/gin" // Gin框架
+)
+
+// DiagnosticsController 诊断控制器结构体
+type DiagnosticsController struct{}
+
+/**
+ * GetBreakers 获取各AI提供方的熔断器状态
+ * 返回状态（closed/open/half_open）、连续失败次数、最近错误以及熔断恢复时间；仅管理员可访问
+ */
+func (dc *DiagnosticsController) GetBreakers(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "获取熔断器状态成功",
+		"data": services.BreakerSnapshots(),
+	})
+}
@@ -3,45 +3,42 @@
 package controller
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"server/cache"     // 缓存包，用于对话上下文缓存
-	"server/config"    // 配置包，包含数据库连接等配置
-	"server/dto"       // 数据传输对象，定义请求和响应结构
-	"server/model"     // 模型包，包含数据模型定义
-	"server/services"  // 服务包，包含AI服务等业务逻辑
-	"server/utils"     // 工具包，包含SSE等工具函数
-	"strings"
+	"server/cache"    // 缓存包，用于对话上下文缓存
+	"server/dto"      // 数据传输对象，定义请求和响应结构
+	"server/model"    // 模型包，包含数据模型定义
+	"server/services" // 服务包，包含AI服务等业务逻辑
+	"server/utils"    // 工具包，包含SSE等工具函数
 	"time"
 
 	"github.com/gin-gonic/gin"     // Gin框架
-	"github.com/redis/go-redis/v9"  // Redis客户端
+	"github.com/redis/go-redis/v9" // Redis客户端
 	"gorm.io/gorm"                 // GORM数据库框架
 )
 
 // MessageController 消息控制器结构体
 type MessageController struct {
-	DB  *gorm.DB        // 数据库连接
-	RDB *redis.Client   // Redis连接
+	DB  *gorm.DB      // 数据库连接
+	RDB *redis.Client // Redis连接
 }
 
 /**
  * SendMessage 发送消息
  * 1. 解析请求参数
- * 2. 获取当前用户ID
- * 3. 处理对话逻辑（创建或获取现有对话）
- * 4. 保存用户消息
- * 5. 调用AI服务获取回复
- * 6. 保存AI消息
+ * 2. 获取当前用户ID并检查额度
+ * 3. 处理对话逻辑（创建或获取现有对话）并取得会话锁
+ * 4. 读取会话上下文并保存用户消息
+ * 5. 按会话设置调用AI服务获取回复
+ * 6. 保存AI消息并更新上下文缓存
  * 7. 更新对话信息
  * 8. 返回响应
  */
 func (mc *MessageController) SendMessage(c *gin.Context) {
+	cache := cache.ConversationCache{DB: mc.DB, RDB: mc.RDB}
 	// 解析请求参数
 	var req dto.SendRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -70,9 +67,46 @@ func (mc *MessageController) SendMessage(c *gin.Context) {
 			"msg":  "用户未登录",
 			"data": nil,
 		})
+		return
+	}
+
+	// 重复请求直接返回首次请求的结果
+	idem, record, idemErr := mc.beginIdempotency(c, uid, "send", &req)
+	if idemErr != nil {
+		c.JSON(idemErr.Status, gin.H{
+			"code": idemErr.Status,
+			"msg":  idemErr.Msg,
+			"data": nil,
+		})
+		return
+	}
+	if record != nil {
+		if record.Status != services.IdempotencyCompleted {
+			c.JSON(http.StatusConflict, gin.H{
+				"code": http.StatusConflict,
+				"msg":  "请求正在处理中，请稍后重试",
+				"data": nil,
+			})
+			return
+		}
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(record.StatusCode, "application/json; charset=utf-8", record.Response)
+		return
+	}
+	defer idem.Release()
+
+	quota := services.QuotaService{DB: mc.DB, RDB: mc.RDB}
+	if err := quota.Check(c.Request.Context(), uid); err != nil {
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"code": http.StatusTooManyRequests,
+			"msg":  err.Error(),
+			"data": err,
+		})
+		return
 	}
 
 	conversation := model.Conversation{}
+	var lockToken int64
 	if req.ConversationID > 0 {
 		if err := mc.DB.Where("id = ? AND user_id = ?", req.ConversationID, uid).First(&conversation).Error; err != nil {
 			log.Printf("获取对话列表失败：user_id=%d, err=%v", uid, err)
@@ -83,6 +117,16 @@ func (mc *MessageController) SendMessage(c *gin.Context) {
 			})
 			return
 		}
+		token, lockErr := mc.lockConversation(c, conversation.ID)
+		if lockErr != nil {
+			c.JSON(lockErr.Status, gin.H{
+				"code": lockErr.Status,
+				"msg":  lockErr.Msg,
+				"data": lockErr.Data,
+			})
+			return
+		}
+		lockToken = token
 	} else {
 		title := ""
 		if len(req.Content) > 10 {
@@ -95,26 +139,68 @@ func (mc *MessageController) SendMessage(c *gin.Context) {
 			UserID:    uid,
 			LastMsg:   "",
 			LastMsgAt: nil,
+			Settings: model.ConversationSettings{
+				Provider: req.Provider,
+				Model:    req.Model,
+			},
 		}
 
-		if err := mc.DB.Create(&conversation).Error; err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"code": 400,
-				"msg":  "创建会话失败",
-				"data": nil,
+		token, lockErr := mc.createLockedConversation(c, &conversation)
+		if lockErr != nil {
+			c.JSON(lockErr.Status, gin.H{
+				"code": lockErr.Status,
+				"msg":  lockErr.Msg,
+				"data": lockErr.Data,
 			})
 			return
 		}
+		lockToken = token
 	}
 
+	// 回复保存后立即释放会话锁，出错返回时兜底释放
+	release := (&services.ConversationLock{DB: mc.DB, RDB: mc.RDB}).Releaser(conversation.ID, lockToken)
+	defer release()
+
+	conversationCtx, ctxVersion := cache.LoadConversationCtx(conversation.ID, uid)
+
+	// 新消息接在当前分支的末尾
+	parentID, err := cache.ActiveLeafID(conversation.ID, uid)
+	if err != nil {
+		log.Printf("读取当前分支失败：convID=%d, err=%v", conversation.ID, err)
+	}
 	userMessage := model.Message{
 		Content:        req.Content,
 		Type:           req.Type,
 		MessageRole:    model.MessageRoleUser,
 		UserID:         uid,
 		ConversationID: conversation.ID,
+		ParentID:       parentID,
 	}
 
+	conversationCtx = append(conversationCtx, dto.Message{
+		Role:    "user",
+		Content: req.Content,
+	})
+
+	chatReq := buildChatRequest(&req, &conversation, conversationCtx)
+	// 受理时的额度检查不能阻止并发请求共同超额，保存用户消息前原子地预占，未保存回复时退还
+	reservation, err := quota.Reserve(c.Request.Context(), uid, services.EstimateRequestTokens(chatReq))
+	if err != nil {
+		// 本次新建的会话没有任何消息，一并删除
+		if req.ConversationID == 0 {
+			if err := mc.DB.Delete(&conversation).Error; err != nil {
+				log.Printf("删除未发送消息的会话失败：convID=%d, err=%v", conversation.ID, err)
+			}
+		}
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"code": http.StatusTooManyRequests,
+			"msg":  err.Error(),
+			"data": err,
+		})
+		return
+	}
+	defer reservation.Cancel(context.Background())
+
 	if err := mc.DB.Create(&userMessage).Error; err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"code": 400,
@@ -124,8 +210,18 @@ func (mc *MessageController) SendMessage(c *gin.Context) {
 		return
 	}
 
-	aiResponseContent, err := services.GetAIResponse(req.Content)
+	aiResp, err := services.GetAIResponse(c.Request.Context(), chatReq)
 	if err != nil {
+		log.Printf("获取 AI 回复失败：convID=%d, err=%v", conversation.ID, err)
+		var openErr *services.CircuitOpenError
+		if errors.As(err, &openErr) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"code": 503,
+				"msg":  openErr.Error(),
+				"data": nil,
+			})
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{
 			"code": 400,
 			"msg":  "获取 AI 回复失败",
@@ -133,16 +229,26 @@ func (mc *MessageController) SendMessage(c *gin.Context) {
 		})
 		return
 	}
+	aiResponseContent := aiResp.Content
 
-	aiMessage := model.Message{
-		Content:        aiResponseContent,
-		Type:           model.MessageTypeText,
-		MessageRole:    model.MessageRoleAI,
-		UserID:         uid,
-		ConversationID: conversation.ID,
-	}
+	aiMessage := newAIMessage(uid, conversation.ID, aiResp)
+	aiMessage.ParentID = userMessage.ID
 
-	if err := mc.DB.Create(&aiMessage).Error; err != nil {
+	err = mc.DB.Transaction(func(tx *gorm.DB) error {
+		if err := services.CheckFence(tx, conversation.ID, lockToken); err != nil {
+			return err
+		}
+		return tx.Create(&aiMessage).Error
+	})
+	if errors.Is(err, services.ErrLockLost) {
+		c.JSON(http.StatusConflict, gin.H{
+			"code": http.StatusConflict,
+			"msg":  err.Error(),
+			"data": nil,
+		})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"code": 400,
 			"msg":  "发送 AI 回复失败",
@@ -150,11 +256,26 @@ func (mc *MessageController) SendMessage(c *gin.Context) {
 		})
 		return
 	}
+	release()
+	reservation.Settle(context.Background(), aiMessage.TotalTokens)
+
+	conversationCtx = append(conversationCtx, dto.Message{
+		Role:    "assistant",
+		Content: aiResponseContent,
+	})
+	if err := cache.SetConversationCtxToRedis(conversation.ID, ctxVersion, conversationCtx); err != nil {
+		log.Printf("更新Redis上下文失败：convID=%d, err=%v", conversation.ID, err)
+	}
+	(&services.Summarizer{DB: mc.DB, Cache: &cache}).SummarizeAsync(conversation.ID, uid)
 
 	now := time.Now()
 	conversation.LastMsg = req.Content
 	conversation.LastMsgAt = &now
-	if err := mc.DB.Save(&conversation).Error; err != nil {
+	// 只更新最后消息，不覆盖保存回复时推进的 fence_token
+	if err := mc.DB.Model(&conversation).Updates(map[string]interface{}{
+		"last_msg":    conversation.LastMsg,
+		"last_msg_at": conversation.LastMsgAt,
+	}).Error; err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"code": 400,
 			"msg":  "更新会话失败",
@@ -166,45 +287,56 @@ func (mc *MessageController) SendMessage(c *gin.Context) {
 	userMessage.Conversation = &conversation
 	aiMessage.Conversation = &conversation
 
-	c.JSON(http.StatusOK, gin.H{
+	response := gin.H{
 		"code": 200,
 		"msg":  "发送消息成功",
 		"data": gin.H{
 			"conversation_id": conversation.ID,
 			"user_message":    userMessage,
 			"ai_message":      aiMessage,
+			"usage":           usageOf(&aiMessage),
+			"trim":            aiResp.Trim,
 		},
-	})
+	}
+	idem.Complete(c.Request.Context(), http.StatusOK, response)
+	c.JSON(http.StatusOK, response)
 
 }
 
-// SendMessageStream 发送消息流式响应
-func (mc *MessageController) SendMessageStream(c *gin.Context) {
-	cache := cache.ConversationCache{DB: config.DB, RDB: config.RDB}
-	var req dto.SendRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		utils.PushSSEError(c, "请求参数错误")
-		return
-	}
+// generationError 准备生成任务时的错误，Status 同时用作业务错误码
+type generationError struct {
+	Status int
+	Msg    string
+	Data   interface{}
+}
 
-	currentUserID, ok := c.Get("userID")
-	if !ok {
-		utils.PushSSEError(c, "用户未登录")
-		return
-	}
-	uid, ok := currentUserID.(uint)
-	if !ok {
-		utils.PushSSEError(c, "用户未登录")
-		return
+/**
+ * prepareGeneration 准备一次生成任务
+ * 1. 检查额度
+ * 2. 处理对话逻辑（创建或获取现有对话）并取得会话锁，由执行生成的worker释放
+ * 3. 读取会话上下文并保存用户消息
+ * 4. 按会话设置构建AI请求
+ */
+func (mc *MessageController) prepareGeneration(c *gin.Context, req *dto.SendRequest, uid uint) (*services.GenerationJob, *generationError) {
+	cache := cache.ConversationCache{DB: mc.DB, RDB: mc.RDB}
+
+	quota := services.QuotaService{DB: mc.DB, RDB: mc.RDB}
+	if err := quota.Check(c.Request.Context(), uid); err != nil {
+		return nil, &generationError{Status: http.StatusTooManyRequests, Msg: err.Error(), Data: err}
 	}
 
 	conversation := model.Conversation{}
+	var lockToken int64
 	if req.ConversationID > 0 {
 		if err := mc.DB.Where("id = ? AND user_id = ?", req.ConversationID, uid).First(&conversation).Error; err != nil {
 			log.Printf("获取对话列表失败：user_id=%d, err=%v", uid, err)
-			utils.PushSSEError(c, "会话不存在或用户无权访问")
-			return
+			return nil, &generationError{Status: http.StatusBadRequest, Msg: "会话不存在或用户无权访问"}
 		}
+		token, lockErr := mc.lockConversation(c, conversation.ID)
+		if lockErr != nil {
+			return nil, lockErr
+		}
+		lockToken = token
 	} else {
 		title := ""
 		if len(req.Content) > 10 {
@@ -217,40 +349,46 @@ func (mc *MessageController) SendMessageStream(c *gin.Context) {
 			UserID:    uid,
 			LastMsg:   "",
 			LastMsgAt: nil,
+			Settings: model.ConversationSettings{
+				Provider: req.Provider,
+				Model:    req.Model,
+			},
 		}
 
-		if err := mc.DB.Create(&conversation).Error; err != nil {
-			utils.PushSSEError(c, "创建会话失败")
-			return
+		token, lockErr := mc.createLockedConversation(c, &conversation)
+		if lockErr != nil {
+			return nil, lockErr
 		}
+		lockToken = token
 
 		initialCtx := []dto.Message{
-			{Role: "system", Content: "You are a helpful assistant."},
+			{Role: "system", Content: conversation.Settings.SystemPromptOrDefault()},
 		}
 
-		if err := cache.SetConversationCtxToRedis(conversation.ID, initialCtx); err != nil {
+		if err := cache.SetConversationCtxToRedis(conversation.ID, 0, initialCtx); err != nil {
 			log.Printf("初始化会话Redis上下文失败：convID=%d, err=%v", conversation.ID, err)
 			// 降级：不中断流程，后续从数据库补全
 		}
 	}
 
-	conversationCtx, err := cache.GetConversationCtxFromRedis(conversation.ID)
+	conversationCtx, ctxVersion := cache.LoadConversationCtx(conversation.ID, uid)
+
+	// 新消息接在当前分支的末尾
+	parentID, err := cache.ActiveLeafID(conversation.ID, uid)
 	if err != nil {
-		log.Printf("读取Redis上下文失败，降级从数据库查询：convID=%d, err=%v", conversation.ID, err)
-		// 降级逻辑：从数据库读取历史消息构建上下文（可选，增强健壮性）
-		conversationCtx = cache.BuildConversationCtxFromDB(conversation.ID, uid)
+		log.Printf("读取当前分支失败：convID=%d, err=%v", conversation.ID, err)
 	}
-
 	userMessage := model.Message{
 		Content:        req.Content,
 		Type:           req.Type,
 		MessageRole:    model.MessageRoleUser,
 		UserID:         uid,
 		ConversationID: conversation.ID,
+		ParentID:       parentID,
 	}
 	if err := mc.DB.Create(&userMessage).Error; err != nil {
-		utils.PushSSEError(c, "发送消息失败")
-		return
+		(&services.ConversationLock{DB: mc.DB, RDB: mc.RDB}).Release(conversation.ID, lockToken)
+		return nil, &generationError{Status: http.StatusBadRequest, Msg: "发送消息失败"}
 	}
 
 	conversationCtx = append(conversationCtx, dto.Message{
@@ -258,198 +396,280 @@ func (mc *MessageController) SendMessageStream(c *gin.Context) {
 		Content: req.Content,
 	})
 
-	c.Header("Content-Type", "text/event-stream")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
-	c.Header("X-Accel-Buffering", "no")
-	c.Status(http.StatusOK)
+	return &services.GenerationJob{
+		ID:                  services.NewStreamID(),
+		UserID:              uid,
+		ConversationID:      conversation.ID,
+		UserMessage:         userMessage,
+		Request:             buildChatRequest(req, &conversation, conversationCtx),
+		Context:             conversationCtx,
+		CtxVersion:          ctxVersion,
+		LockToken:           lockToken,
+		CreatedMessage:      true,
+		CreatedConversation: req.ConversationID == 0,
+	}, nil
+}
 
-	flusher, ok := c.Writer.(http.Flusher)
-	if !ok {
-		utils.PushSSEError(c, "当前环境不支持流式输出")
+/**
+ * SendMessageStream 发送消息流式响应
+ * 投递生成任务后直接订阅其事件；生成由后台worker执行，与本次连接解耦，
+ * 断线后可通过 /api/message/stream/:generation_id 续读。
+ * 携带 Idempotency-Key 的重复请求不会再次生成，而是订阅首次请求投递的生成（支持 Last-Event-ID）
+ */
+func (mc *MessageController) SendMessageStream(c *gin.Context) {
+	var req dto.SendRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.PushSSEError(c, "请求参数错误")
 		return
 	}
 
-	aiModel := os.Getenv("AI_MODEL")
-	aiApiKey := os.Getenv("AI_API_KEY")
-	aiApiUrl := os.Getenv("AI_API_URL")
-	if aiModel == "" || aiApiKey == "" || aiApiUrl == "" {
-		utils.PushSSEError(c, "AI环境变量未配置完整")
+	uid, ok := currentUID(c)
+	if !ok {
+		utils.PushSSEError(c, "用户未登录")
 		return
 	}
 
-	requestBody := dto.RequestBody{
-		Model:             aiModel,
-		Stream:            true,
-		EnableThinking:    req.ReasonModal,
-		EnableSearch:      true,
-		ResultFormat:      "message",
-		IncrementalOutput: true,
-		Messages:          conversationCtx,
+	idem, record, idemErr := mc.beginIdempotency(c, uid, "stream", &req)
+	if idemErr != nil {
+		utils.PushSSEErrorCode(c, idemErr.Status, idemErr.Msg, nil)
+		return
+	}
+	if record != nil {
+		if record.GenerationID == "" {
+			utils.PushSSEErrorCode(c, http.StatusConflict, "请求正在处理中，请稍后重试", nil)
+			return
+		}
+		c.Header("Idempotent-Replayed", "true")
+		w, ok := startSSE(c)
+		if !ok {
+			return
+		}
+		mc.tailGeneration(c, w, record.GenerationID, c.GetHeader("Last-Event-ID"), nil)
+		return
 	}
+	defer idem.Release()
 
-	jsonData, err := json.Marshal(requestBody)
-	if err != nil {
-		log.Printf("序列化请求体失败：%v", err)
-		utils.PushSSEError(c, "构建AI请求失败")
+	job, genErr := mc.prepareGeneration(c, &req, uid)
+	if genErr != nil {
+		pushGenerationError(c, genErr)
 		return
 	}
 
-	log.Printf("AI请求体（JSON）：%s", string(jsonData))
+	mc.streamGeneration(c, job, idem)
+}
 
-	reqAI, err := http.NewRequest("POST", aiApiUrl, bytes.NewBuffer(jsonData))
-	if err != nil {
-		log.Printf("创建AI请求失败：%v", err)
-		utils.PushSSEError(c, "构建AI请求失败")
-		return
+// pushGenerationError 以SSE推送准备生成任务时的错误，带详情的错误同时推送业务错误码
+func pushGenerationError(c *gin.Context, genErr *generationError) {
+	if genErr.Data != nil {
+		utils.PushSSEErrorCode(c, genErr.Status, genErr.Msg, genErr.Data)
+	} else {
+		utils.PushSSEError(c, genErr.Msg)
 	}
+}
 
-	reqAI.Header.Set("Authorization", "Bearer "+aiApiKey)
-	reqAI.Header.Set("Content-Type", "application/json")
-	reqAI.Header.Set("Accept", "text/event-stream")
+// startSSE 创建SSE写入器，当前环境不支持流式输出时推送错误并返回 false
+func startSSE(c *gin.Context) (*utils.SSEWriter, bool) {
+	w := utils.NewSSEWriter(c)
+	c.Status(http.StatusOK)
+	if !w.Streamable() {
+		utils.PushSSEError(c, "当前环境不支持流式输出")
+		return nil, false
+	}
+	return w, true
+}
 
-	client := &http.Client{Timeout: 5 * time.Minute}
-	respAI, err := client.Do(reqAI)
-	if err != nil {
-		log.Printf("调用AI接口失败：%v", err)
-		utils.PushSSEError(c, "调用AI接口失败")
+// streamGeneration 投递生成任务并以SSE推送其事件，投递成功后将生成记录到幂等键（可为 nil）
+func (mc *MessageController) streamGeneration(c *gin.Context, job *services.GenerationJob, idem *services.Idempotency) {
+	w, ok := startSSE(c)
+	if !ok {
+		(&services.ConversationLock{DB: mc.DB, RDB: mc.RDB}).Release(job.ConversationID, job.LockToken)
 		return
 	}
-	defer respAI.Body.Close()
 
-	if respAI.StatusCode != http.StatusOK {
-		log.Printf("AI请求失败：%s", respAI.Status)
-		utils.PushSSEError(c, fmt.Sprintf("AI接口返回错误：%s", respAI.Status))
+	gen := services.GenerationService{DB: mc.DB, RDB: mc.RDB}
+	if err := gen.Enqueue(c.Request.Context(), job); err != nil {
+		log.Printf("投递生成任务失败：generation_id=%s, err=%v", job.ID, err)
+		utils.PushSSEError(c, "提交生成任务失败")
 		return
 	}
+	idem.Attach(c.Request.Context(), job.ID)
 
-	scanner := bufio.NewScanner(respAI.Body)
-	reasoningContentBuffer := new(strings.Builder)
-	contentBuffer := new(strings.Builder)
-	ctx := c.Request.Context()
-
-	for scanner.Scan() {
-		select {
-		case <-ctx.Done():
-			log.Println("前端断开连接，终止流式推送")
+	mc.tailGeneration(c, w, job.ID, "", func() {
+		if !services.StopOnDisconnect() {
 			return
-		default:
-			line := scanner.Text()
-			if strings.HasPrefix(line, "data: ") {
-				dataStr := line[6:]
-
-				if dataStr == "[DONE]" {
-					utils.SendSSEData(c, flusher, map[string]interface{}{
-						"type":            "done",
-						"msg":             "流式响应结束",
-						"conversation_id": conversation.ID,
-					})
-					break
-				}
-
-				var chunk dto.QwenStreamChunk
-				if err := json.Unmarshal([]byte(dataStr), &chunk); err != nil {
-					log.Printf("解析AI分片失败：%v, 数据：%s", err, dataStr)
-					continue
-				}
+		}
+		if _, err := services.Streams.Stop(context.Background(), job.UserID, job.ConversationID, job.ID); err != nil {
+			log.Printf("客户端断开后停止生成失败：generation_id=%s, err=%v", job.ID, err)
+		}
+	})
+}
 
-				if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.ReasoningContent != "" {
-					reasoningContent := chunk.Choices[0].Delta.ReasoningContent
-					reasoningContentBuffer.WriteString(reasoningContent)
+/**
+ * GenerateMessage 异步发送消息
+ * 投递生成任务后立即返回生成ID，客户端（可以是多个标签页或设备）
+ * 通过 /api/message/stream/:generation_id 订阅生成事件
+ */
+func (mc *MessageController) GenerateMessage(c *gin.Context) {
+	var req dto.SendRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "请求参数错误",
+			"data": nil,
+		})
+		return
+	}
 
-					utils.SendSSEData(c, flusher, map[string]interface{}{
-						"type":              "reasoning",
-						"reasoning_content": reasoningContent,
-						"conversation_id":   conversation.ID,
-						"user_message_id":   userMessage.ID,
-					})
-				}
+	uid, ok := currentUID(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "用户未登录",
+			"data": nil,
+		})
+		return
+	}
 
-				if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
-					deltaContent := chunk.Choices[0].Delta.Content
-					contentBuffer.WriteString(deltaContent)
+	job, genErr := mc.prepareGeneration(c, &req, uid)
+	if genErr != nil {
+		c.JSON(genErr.Status, gin.H{
+			"code": genErr.Status,
+			"msg":  genErr.Msg,
+			"data": genErr.Data,
+		})
+		return
+	}
 
-					utils.SendSSEData(c, flusher, map[string]interface{}{
-						"type":            "chunk",
-						"content":         deltaContent,
-						"conversation_id": conversation.ID,
-						"user_message_id": userMessage.ID,
-					})
-				}
-			}
-		}
+	gen := services.GenerationService{DB: mc.DB, RDB: mc.RDB}
+	if err := gen.Enqueue(c.Request.Context(), job); err != nil {
+		log.Printf("投递生成任务失败：generation_id=%s, err=%v", job.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "提交生成任务失败",
+			"data": nil,
+		})
+		return
 	}
 
-	if err := scanner.Err(); err != nil {
-		log.Printf("读取AI流式响应失败：%v", err)
-		utils.PushSSEError(c, "读取AI响应失败")
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "生成任务已提交",
+		"data": gin.H{
+			"generation_id":   job.ID,
+			"conversation_id": job.ConversationID,
+			"user_message":    job.UserMessage,
+		},
+	})
+}
+
+/**
+ * ResumeMessageStream 断线重连，续读进行中或刚结束的生成
+ * 通过 Last-Event-ID 请求头（或 last_event_id 查询参数）指定最后收到的事件，
+ * 先回放其后缓冲的事件，再继续推送后续生成的内容
+ */
+func (mc *MessageController) ResumeMessageStream(c *gin.Context) {
+	generationID := c.Param("generation_id")
+	uid, ok := currentUID(c)
+	if !ok {
+		utils.PushSSEError(c, "用户未登录")
 		return
 	}
 
-	aiReasoningContent := reasoningContentBuffer.String()
-	aiResponseContent := contentBuffer.String()
-	if aiResponseContent == "" {
-		aiResponseContent = "AI未返回有效内容"
+	owner, _, err := services.Streams.Owner(c.Request.Context(), generationID)
+	if err != nil || owner != uid {
+		utils.PushSSEError(c, "生成不存在或已过期")
+		return
 	}
 
-	aiMessage := model.Message{
-		Content:          aiResponseContent,
-		ReasoningContent: aiReasoningContent,
-		Type:             model.MessageTypeText,
-		MessageRole:      model.MessageRoleAI,
-		UserID:           uid,
-		ConversationID:   conversation.ID,
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
 	}
-	if err := mc.DB.Create(&aiMessage).Error; err != nil {
-		log.Printf("保存AI消息失败：%v", err)
-		utils.SendSSEData(c, flusher, map[string]interface{}{
-			"type": "error",
-			"msg":  "保存AI回复失败",
-		})
+
+	w, ok := startSSE(c)
+	if !ok {
 		return
 	}
 
-	conversationCtx = append(conversationCtx, dto.Message{
-		Role:    "assistant", //
-		Content: aiResponseContent,
-	})
-	if err := cache.SetConversationCtxToRedis(conversation.ID, conversationCtx); err != nil {
-		log.Printf("更新Redis上下文失败：convID=%d, err=%v", conversation.ID, err)
-	}
+	mc.tailGeneration(c, w, generationID, lastEventID, nil)
+}
 
-	now := time.Now()
-	conversation.LastMsgAt = &now
+// tailGeneration 将生成事件带上事件ID推送给客户端，等待期间定时发送心跳
+// 写入失败（客户端断开）时停止推送并调用 onDisconnect（可为 nil），生成本身是否停止由调用方决定
+func (mc *MessageController) tailGeneration(c *gin.Context, w *utils.SSEWriter, generationID string, lastEventID string, onDisconnect func()) {
+	ctx, cancel := context.WithCancelCause(c.Request.Context())
+	defer cancel(nil)
+	w.OnFail(func(err error) {
+		cancel(err)
+		if onDisconnect != nil {
+			onDisconnect()
+		}
+	})
+	stop := w.KeepAlive()
+	defer stop()
 
-	var title string
-	if aiReasoningContent != "" {
-		title = utils.SafeTruncateStr(aiReasoningContent, 10)
-	} else {
-		title = utils.SafeTruncateStr(req.Content, 10)
+	gen := services.GenerationService{DB: mc.DB, RDB: mc.RDB}
+	err := gen.Tail(ctx, generationID, lastEventID, func(event services.GenerationEvent) error {
+		return w.WriteRaw(event.ID, event.Type, event.Data)
+	})
+	if err != nil && ctx.Err() == nil {
+		log.Printf("读取生成事件失败：generation_id=%s, err=%v", generationID, err)
+		w.Send(dto.ErrorEvent{EventHeader: dto.NewEventHeader(dto.EventError), Msg: "读取生成内容失败"})
+		w.Send(dto.DoneEvent{EventHeader: dto.NewEventHeader(dto.EventDone), Msg: "错误终止"})
 	}
-	if title == "" {
-		title = "无标题会话"
+}
+
+/**
+ * StopMessageStream 停止进行中的流式生成
+ * 按 stream_id 或会话ID定位生成，通过Redis发布停止指令，执行生成的实例取消上游请求、
+ * 保存已生成的部分内容（标记为 interrupted）并推送 stopped 事件
+ */
+func (mc *MessageController) StopMessageStream(c *gin.Context) {
+	var req dto.StopRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.StreamID == "" && req.ConversationID == 0) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "请求参数错误",
+			"data": nil,
+		})
+		return
 	}
-	conversation.Title = title
 
-	conversation.LastMsg = utils.SafeTruncateStr(aiResponseContent, 10)
-	if conversation.LastMsg == "" {
-		conversation.LastMsg = "无消息内容"
+	uid, ok := currentUID(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "用户未登录",
+			"data": nil,
+		})
+		return
 	}
-	if err := mc.DB.Save(&conversation).Error; err != nil {
-		log.Printf("更新会话失败：%v", err)
-		utils.SendSSEData(c, flusher, map[string]interface{}{
-			"type": "error",
-			"msg":  "更新会话失败",
+
+	streamID, err := services.Streams.Stop(c.Request.Context(), uid, req.ConversationID, req.StreamID)
+	if err != nil {
+		if errors.Is(err, services.ErrStreamNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"code": 404,
+				"msg":  err.Error(),
+				"data": nil,
+			})
+			return
+		}
+		log.Printf("停止生成失败：user_id=%d, err=%v", uid, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "停止生成失败",
+			"data": nil,
 		})
 		return
 	}
 
-	utils.SendSSEData(c, flusher, map[string]interface{}{
-		"type":            "complete",
-		"msg":             "操作成功",
-		"conversation_id": conversation.ID,
-		"user_message":    userMessage,
-		"ai_message":      aiMessage,
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "已发送停止指令",
+		"data": gin.H{
+			"stream_id": streamID,
+		},
 	})
 }
 
@@ -504,13 +724,10 @@ func (mc *MessageController) GetMessageList(c *gin.Context) {
 		return
 	}
 
-	var messages []model.Message
-
-	if err := mc.DB.Where("user_id = ? AND conversation_id = ?", uid, query.ConversationID).
-		Order("created_at DESC").
-		Offset((page - 1) * pageSize).
-		Limit(pageSize).Find(&messages).
-		Error; err != nil {
+	// 只返回当前分支上的消息，按时间倒序分页
+	cc := cache.ConversationCache{DB: mc.DB, RDB: mc.RDB}
+	tree, err := cc.LoadMessageTree(query.ConversationID, uid)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"code": 400,
 			"msg":  "获取消息失败",
@@ -518,6 +735,11 @@ func (mc *MessageController) GetMessageList(c *gin.Context) {
 		})
 		return
 	}
+	path := cache.ActivePath(tree)
+	messages := make([]model.Message, 0, pageSize)
+	for i := len(path) - 1 - (page-1)*pageSize; i >= 0 && len(messages) < pageSize; i-- {
+		messages = append(messages, path[i])
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"code": 200,
@@ -579,6 +801,12 @@ func (mc *MessageController) DeleteMessage(c *gin.Context) {
 		return
 	}
 
+	// 已删除的消息不能再出现在上下文中，下次读取时从数据库重建
+	cc := cache.ConversationCache{DB: mc.DB, RDB: mc.RDB}
+	if _, err := cc.InvalidateConversationCtx(message.ConversationID); err != nil {
+		log.Printf("清除Redis上下文失败：convID=%d, err=%v", message.ConversationID, err)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"code": 200,
 		"msg":  "删除消息成功",
@@ -586,3 +814,572 @@ func (mc *MessageController) DeleteMessage(c *gin.Context) {
 	})
 
 }
+
+/**
+ * RegenerateMessage 重新生成AI回复
+ * 1. 找到该回复所回答的用户消息
+ * 2. 从缓存层构建截止到该用户消息的上下文
+ * 3. 以流式方式生成新回复；新回复成为当前版本，原有回复及其后续对话保留为可切换的历史分支
+ */
+func (mc *MessageController) RegenerateMessage(c *gin.Context) {
+	var req dto.RegenerateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.PushSSEError(c, "请求参数错误")
+		return
+	}
+
+	uid, ok := currentUID(c)
+	if !ok {
+		utils.PushSSEError(c, "用户未登录")
+		return
+	}
+
+	job, genErr := mc.prepareRegeneration(c, &req, uid)
+	if genErr != nil {
+		pushGenerationError(c, genErr)
+		return
+	}
+
+	mc.streamGeneration(c, job, nil)
+}
+
+// prepareRegeneration 准备重新生成任务：切换到回复所在的分支，构建截止到对应用户消息的上下文
+func (mc *MessageController) prepareRegeneration(c *gin.Context, req *dto.RegenerateRequest, uid uint) (*services.GenerationJob, *generationError) {
+	var aiMessage model.Message
+	if err := mc.DB.Where("id = ? AND user_id = ? AND message_role = ?", req.MessageID, uid, model.MessageRoleAI).
+		First(&aiMessage).Error; err != nil {
+		return nil, &generationError{Status: http.StatusBadRequest, Msg: "消息不存在或用户无权访问"}
+	}
+
+	userMessage, err := mc.parentUserMessage(&aiMessage)
+	if err != nil {
+		log.Printf("查找回复对应的用户消息失败：message_id=%d, err=%v", aiMessage.ID, err)
+		return nil, &generationError{Status: http.StatusBadRequest, Msg: "找不到该回复对应的用户消息"}
+	}
+
+	var conversation model.Conversation
+	if err := mc.DB.Where("id = ? AND user_id = ?", aiMessage.ConversationID, uid).First(&conversation).Error; err != nil {
+		return nil, &generationError{Status: http.StatusBadRequest, Msg: "会话不存在或用户无权访问"}
+	}
+
+	quota := services.QuotaService{DB: mc.DB, RDB: mc.RDB}
+	if err := quota.Check(c.Request.Context(), uid); err != nil {
+		return nil, &generationError{Status: http.StatusTooManyRequests, Msg: err.Error(), Data: err}
+	}
+
+	lockToken, lockErr := mc.lockConversation(c, conversation.ID)
+	if lockErr != nil {
+		return nil, lockErr
+	}
+
+	// 用户消息可能位于非当前分支上，重新生成时切换到该分支
+	if err := mc.activatePath(conversation.ID, uid, userMessage.ID, func(tx *gorm.DB) error {
+		return services.CheckLease(tx, conversation.ID, lockToken)
+	}); err != nil {
+		(&services.ConversationLock{DB: mc.DB, RDB: mc.RDB}).Release(conversation.ID, lockToken)
+		if errors.Is(err, services.ErrLockLost) {
+			return nil, &generationError{Status: http.StatusConflict, Msg: err.Error()}
+		}
+		log.Printf("切换分支失败：message_id=%d, err=%v", userMessage.ID, err)
+		return nil, &generationError{Status: http.StatusInternalServerError, Msg: "切换分支失败"}
+	}
+
+	cc := cache.ConversationCache{DB: mc.DB, RDB: mc.RDB}
+	ctxVersion, err := cc.InvalidateConversationCtx(conversation.ID)
+	if err != nil {
+		log.Printf("清除Redis上下文失败：convID=%d, err=%v", conversation.ID, err)
+	}
+	conversationCtx := cc.BuildConversationCtxUntil(conversation.ID, uid, userMessage.ID)
+	sendReq := dto.SendRequest{Provider: req.Provider, Model: req.Model, ReasonModal: req.ReasonModal}
+
+	return &services.GenerationJob{
+		ID:             services.NewStreamID(),
+		UserID:         uid,
+		ConversationID: conversation.ID,
+		UserMessage:    *userMessage,
+		Request:        buildChatRequest(&sendReq, &conversation, conversationCtx),
+		Context:        conversationCtx,
+		CtxVersion:     ctxVersion,
+		LockToken:      lockToken,
+	}, nil
+}
+
+// parentUserMessage 查找AI回复对应的用户消息
+// 早期的回复没有记录 parent_id，取其之前最近的一条用户消息并回填
+func (mc *MessageController) parentUserMessage(aiMessage *model.Message) (*model.Message, error) {
+	var userMessage model.Message
+	if aiMessage.ParentID != 0 {
+		if err := mc.DB.Where("id = ? AND conversation_id = ?", aiMessage.ParentID, aiMessage.ConversationID).
+			First(&userMessage).Error; err != nil {
+			return nil, err
+		}
+		return &userMessage, nil
+	}
+
+	if err := mc.DB.Where("conversation_id = ? AND message_role = ? AND id < ?", aiMessage.ConversationID, model.MessageRoleUser, aiMessage.ID).
+		Order("id DESC").First(&userMessage).Error; err != nil {
+		return nil, err
+	}
+	if err := mc.DB.Model(aiMessage).Update("parent_id", userMessage.ID).Error; err != nil {
+		return nil, err
+	}
+	return &userMessage, nil
+}
+
+/**
+ * GetMessageVersions 获取一条消息的所有版本
+ * 返回同一父消息下的全部兄弟消息（重新生成的回复或编辑后的用户消息，按生成顺序），inactive 为 false 的是当前版本
+ */
+func (mc *MessageController) GetMessageVersions(c *gin.Context) {
+	var messageID uint
+	if _, err := fmt.Sscanf(c.Param("message_id"), "%d", &messageID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "请求参数错误",
+			"data": nil,
+		})
+		return
+	}
+
+	uid, ok := currentUID(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "用户未登录",
+			"data": nil,
+		})
+		return
+	}
+
+	var message model.Message
+	if err := mc.DB.Where("id = ? AND user_id = ?", messageID, uid).First(&message).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "消息不存在或用户无权访问",
+			"data": nil,
+		})
+		return
+	}
+
+	var versions []model.Message
+	if err := mc.DB.Where("conversation_id = ? AND parent_id = ? AND message_role = ?", message.ConversationID, message.ParentID, message.MessageRole).
+		Order("id ASC").Find(&versions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "获取消息版本失败",
+			"data": nil,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "获取消息版本成功",
+		"data": gin.H{
+			"parent_id": message.ParentID,
+			"versions":  versions,
+		},
+	})
+}
+
+/**
+ * SelectMessageVersion 切换当前版本（分支）
+ * 取得会话锁后，在同一事务中校验防护令牌并将指定消息及其所有祖先设为各自层级的当前版本，
+ * 其后沿该消息下原先的当前分支继续，并按新的当前分支重建上下文缓存
+ */
+func (mc *MessageController) SelectMessageVersion(c *gin.Context) {
+	var req dto.SelectVersionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "请求参数错误",
+			"data": nil,
+		})
+		return
+	}
+
+	uid, ok := currentUID(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "用户未登录",
+			"data": nil,
+		})
+		return
+	}
+
+	var message model.Message
+	if err := mc.DB.Where("id = ? AND user_id = ?", req.MessageID, uid).First(&message).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "消息不存在或用户无权访问",
+			"data": nil,
+		})
+		return
+	}
+
+	// 与发送消息共用会话锁，避免切换分支与正在保存的回复交错
+	lockToken, lockErr := mc.lockConversation(c, message.ConversationID)
+	if lockErr != nil {
+		c.JSON(lockErr.Status, gin.H{
+			"code": lockErr.Status,
+			"msg":  lockErr.Msg,
+			"data": lockErr.Data,
+		})
+		return
+	}
+	defer (&services.ConversationLock{DB: mc.DB, RDB: mc.RDB}).Release(message.ConversationID, lockToken)
+
+	err := mc.activatePath(message.ConversationID, uid, message.ID, func(tx *gorm.DB) error {
+		return services.CheckFence(tx, message.ConversationID, lockToken)
+	})
+	if err != nil {
+		if errors.Is(err, services.ErrLockLost) {
+			c.JSON(http.StatusConflict, gin.H{
+				"code": http.StatusConflict,
+				"msg":  err.Error(),
+				"data": nil,
+			})
+			return
+		}
+		log.Printf("切换消息版本失败：message_id=%d, err=%v", message.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "切换消息版本失败",
+			"data": nil,
+		})
+		return
+	}
+	message.Inactive = false
+
+	cc := cache.ConversationCache{DB: mc.DB, RDB: mc.RDB}
+	if err := cc.RefreshConversationCtx(message.ConversationID, uid); err != nil {
+		log.Printf("更新Redis上下文失败：convID=%d, err=%v", message.ConversationID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "切换消息版本成功",
+		"data": message,
+	})
+}
+
+/**
+ * EditMessage 编辑用户消息
+ * 在原消息的同一父消息下创建编辑后的新消息作为新分支（原消息及其后续对话保留为历史分支），
+ * 并以流式方式生成新回复
+ */
+func (mc *MessageController) EditMessage(c *gin.Context) {
+	var req dto.EditMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.PushSSEError(c, "请求参数错误")
+		return
+	}
+
+	uid, ok := currentUID(c)
+	if !ok {
+		utils.PushSSEError(c, "用户未登录")
+		return
+	}
+
+	var original model.Message
+	if err := mc.DB.Where("id = ? AND user_id = ? AND message_role = ?", req.MessageID, uid, model.MessageRoleUser).
+		First(&original).Error; err != nil {
+		utils.PushSSEError(c, "消息不存在或用户无权访问")
+		return
+	}
+
+	var conversation model.Conversation
+	if err := mc.DB.Where("id = ? AND user_id = ?", original.ConversationID, uid).First(&conversation).Error; err != nil {
+		utils.PushSSEError(c, "会话不存在或用户无权访问")
+		return
+	}
+
+	quota := services.QuotaService{DB: mc.DB, RDB: mc.RDB}
+	if err := quota.Check(c.Request.Context(), uid); err != nil {
+		utils.PushSSEErrorCode(c, http.StatusTooManyRequests, err.Error(), err)
+		return
+	}
+
+	lockToken, lockErr := mc.lockConversation(c, conversation.ID)
+	if lockErr != nil {
+		pushGenerationError(c, lockErr)
+		return
+	}
+	lock := services.ConversationLock{DB: mc.DB, RDB: mc.RDB}
+
+	checkLease := func(tx *gorm.DB) error {
+		return services.CheckLease(tx, conversation.ID, lockToken)
+	}
+	if original.ParentID != 0 {
+		if err := mc.activatePath(conversation.ID, uid, original.ParentID, checkLease); err != nil {
+			lock.Release(conversation.ID, lockToken)
+			if errors.Is(err, services.ErrLockLost) {
+				utils.PushSSEErrorCode(c, http.StatusConflict, err.Error(), nil)
+				return
+			}
+			log.Printf("切换分支失败：message_id=%d, err=%v", original.ParentID, err)
+			utils.PushSSEError(c, "切换分支失败")
+			return
+		}
+	}
+
+	userMessage := model.Message{
+		Content:        req.Content,
+		Type:           original.Type,
+		MessageRole:    model.MessageRoleUser,
+		UserID:         uid,
+		ConversationID: conversation.ID,
+		ParentID:       original.ParentID,
+	}
+	err := mc.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkLease(tx); err != nil {
+			return err
+		}
+		if err := tx.Model(&model.Message{}).
+			Where("conversation_id = ? AND parent_id = ?", conversation.ID, original.ParentID).
+			Update("inactive", true).Error; err != nil {
+			return err
+		}
+		return tx.Create(&userMessage).Error
+	})
+	if errors.Is(err, services.ErrLockLost) {
+		lock.Release(conversation.ID, lockToken)
+		utils.PushSSEErrorCode(c, http.StatusConflict, err.Error(), nil)
+		return
+	}
+	if err != nil {
+		log.Printf("保存编辑后的消息失败：message_id=%d, err=%v", original.ID, err)
+		lock.Release(conversation.ID, lockToken)
+		utils.PushSSEError(c, "编辑消息失败")
+		return
+	}
+
+	cc := cache.ConversationCache{DB: mc.DB, RDB: mc.RDB}
+	ctxVersion, err := cc.InvalidateConversationCtx(conversation.ID)
+	if err != nil {
+		log.Printf("清除Redis上下文失败：convID=%d, err=%v", conversation.ID, err)
+	}
+	conversationCtx := cc.BuildConversationCtxUntil(conversation.ID, uid, userMessage.ID)
+	sendReq := dto.SendRequest{Provider: req.Provider, Model: req.Model, ReasonModal: req.ReasonModal}
+
+	mc.streamGeneration(c, &services.GenerationJob{
+		ID:                services.NewStreamID(),
+		UserID:            uid,
+		ConversationID:    conversation.ID,
+		UserMessage:       userMessage,
+		Request:           buildChatRequest(&sendReq, &conversation, conversationCtx),
+		Context:           conversationCtx,
+		CtxVersion:        ctxVersion,
+		LockToken:         lockToken,
+		CreatedMessage:    true,
+		ReplacedMessageID: original.ID,
+	}, nil)
+}
+
+/**
+ * GetBranches 获取会话的消息树
+ * 返回全部消息（含 parent_id 和 inactive）以及当前分支上的消息ID，
+ * 前端据此展示分支切换，切换通过 /api/message/versions/select 完成
+ */
+func (mc *MessageController) GetBranches(c *gin.Context) {
+	var query dto.GetBranchesQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "请求参数错误",
+			"data": nil,
+		})
+		return
+	}
+
+	uid, ok := currentUID(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "用户未登录",
+			"data": nil,
+		})
+		return
+	}
+
+	var conversation model.Conversation
+	if err := mc.DB.Where("id = ? AND user_id = ?", query.ConversationID, uid).First(&conversation).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "会话不存在或用户无权访问",
+			"data": nil,
+		})
+		return
+	}
+
+	cc := cache.ConversationCache{DB: mc.DB, RDB: mc.RDB}
+	tree, err := cc.LoadMessageTree(conversation.ID, uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "获取消息树失败",
+			"data": nil,
+		})
+		return
+	}
+
+	messages := make([]model.Message, 0, len(tree))
+	for _, msg := range tree {
+		if !msg.DeletedAt.Valid {
+			messages = append(messages, msg)
+		}
+	}
+	activePath := []uint{}
+	for _, msg := range cache.ActivePath(tree) {
+		activePath = append(activePath, msg.ID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "获取消息树成功",
+		"data": gin.H{
+			"conversation_id": conversation.ID,
+			"messages":        messages,
+			"active_path":     activePath,
+		},
+	})
+}
+
+// beginIdempotency 处理 Idempotency-Key 请求头，未携带时均返回 nil
+// 首次请求返回 *services.Idempotency，重复请求返回首次请求的记录
+func (mc *MessageController) beginIdempotency(c *gin.Context, uid uint, scope string, req *dto.SendRequest) (*services.Idempotency, *services.IdempotencyRecord, *generationError) {
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		return nil, nil, nil
+	}
+	if len(key) > services.IdempotencyKeyMaxLen {
+		return nil, nil, &generationError{Status: http.StatusBadRequest, Msg: "Idempotency-Key 过长"}
+	}
+	idem, record, err := services.BeginIdempotency(c.Request.Context(), mc.RDB, uid, scope, key, services.RequestFingerprint(req))
+	if err != nil {
+		return nil, nil, &generationError{Status: http.StatusUnprocessableEntity, Msg: err.Error()}
+	}
+	return idem, record, nil
+}
+
+// lockConversation 获取会话锁，会话正在生成回复时返回 409，无法确认锁时返回 503
+func (mc *MessageController) lockConversation(c *gin.Context, convID uint) (int64, *generationError) {
+	lock := services.ConversationLock{DB: mc.DB, RDB: mc.RDB}
+	token, err := lock.Acquire(c.Request.Context(), convID)
+	if err != nil {
+		if errors.Is(err, services.ErrConversationBusy) {
+			return 0, &generationError{
+				Status: http.StatusConflict,
+				Msg:    services.ErrConversationBusy.Error(),
+				Data:   gin.H{"conversation_id": convID},
+			}
+		}
+		return 0, &generationError{Status: http.StatusServiceUnavailable, Msg: services.ErrLockUnavailable.Error()}
+	}
+	return token, nil
+}
+
+// createLockedConversation 创建会话并取得其会话锁，新会话同样以会话锁的令牌保存回复；加锁失败时删除刚创建的会话
+func (mc *MessageController) createLockedConversation(c *gin.Context, conversation *model.Conversation) (int64, *generationError) {
+	if err := mc.DB.Create(conversation).Error; err != nil {
+		return 0, &generationError{Status: http.StatusBadRequest, Msg: "创建会话失败"}
+	}
+	token, lockErr := mc.lockConversation(c, conversation.ID)
+	if lockErr != nil {
+		if err := mc.DB.Delete(conversation).Error; err != nil {
+			log.Printf("删除未能加锁的会话失败：convID=%d, err=%v", conversation.ID, err)
+		}
+		return 0, lockErr
+	}
+	return token, nil
+}
+
+// activatePath 将从根到指定消息路径上的每条消息设为其兄弟中的当前版本
+// check 不为空时先在同一事务中执行（如校验会话锁的防护令牌），返回错误时不做修改
+func (mc *MessageController) activatePath(convID uint, uid uint, messageID uint, check func(tx *gorm.DB) error) error {
+	cc := cache.ConversationCache{DB: mc.DB, RDB: mc.RDB}
+	tree, err := cc.LoadMessageTree(convID, uid)
+	if err != nil {
+		return err
+	}
+	byID := make(map[uint]model.Message, len(tree))
+	for _, msg := range tree {
+		byID[msg.ID] = msg
+	}
+
+	return mc.DB.Transaction(func(tx *gorm.DB) error {
+		if check != nil {
+			if err := check(tx); err != nil {
+				return err
+			}
+		}
+		for id := messageID; id != 0; {
+			msg, ok := byID[id]
+			if !ok {
+				return nil
+			}
+			if msg.Inactive {
+				if err := tx.Unscoped().Model(&model.Message{}).
+					Where("conversation_id = ? AND parent_id = ? AND id <> ?", convID, msg.ParentID, msg.ID).
+					Update("inactive", true).Error; err != nil {
+					return err
+				}
+				if err := tx.Unscoped().Model(&model.Message{}).Where("id = ?", msg.ID).
+					Update("inactive", false).Error; err != nil {
+					return err
+				}
+			}
+			id = msg.ParentID
+		}
+		return nil
+	})
+}
+
+// newAIMessage 根据模型回复构建AI消息，记录实际回答的模型和用量
+func newAIMessage(uid uint, convID uint, aiResp *services.ChatResponse) model.Message {
+	return model.Message{
+		Content:          aiResp.Content,
+		ReasoningContent: aiResp.ReasoningContent,
+		Type:             model.MessageTypeText,
+		MessageRole:      model.MessageRoleAI,
+		UserID:           uid,
+		ConversationID:   convID,
+		Provider:         aiResp.Provider,
+		Model:            aiResp.Model,
+		PromptTokens:     aiResp.Usage.PromptTokens,
+		CompletionTokens: aiResp.Usage.CompletionTokens,
+		TotalTokens:      aiResp.Usage.TotalTokens,
+		LatencyMs:        aiResp.LatencyMs,
+		Cost:             aiResp.Cost,
+	}
+}
+
+// usageOf 提取AI消息的用量信息，随完成事件返回
+func usageOf(msg *model.Message) dto.MessageUsage {
+	return dto.MessageUsage{
+		Provider:         msg.Provider,
+		Model:            msg.Model,
+		PromptTokens:     msg.PromptTokens,
+		CompletionTokens: msg.CompletionTokens,
+		TotalTokens:      msg.TotalTokens,
+		LatencyMs:        msg.LatencyMs,
+		Cost:             msg.Cost,
+	}
+}
+
+// buildChatRequest 按会话设置构建AI请求，请求参数中的提供方、模型和深度思考开关优先
+func buildChatRequest(req *dto.SendRequest, conversation *model.Conversation, conversationCtx []dto.Message) *services.ChatRequest {
+	chatReq := services.BuildChatRequest(conversation.Settings, conversationCtx)
+	chatReq.ConversationID = conversation.ID
+	if req.Provider != "" {
+		chatReq.Provider = req.Provider
+		chatReq.Model = req.Model
+	} else if req.Model != "" {
+		chatReq.Model = req.Model
+	}
+	if req.ReasonModal {
+		chatReq.EnableThinking = true
+	}
+	return chatReq
+}
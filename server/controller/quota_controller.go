@@ -0,0 +1,53 @@
+// QuotaController 额度控制器
+// 负责查询当前用户的套餐限额和剩余额度
+package controller
+
+import (
+	"log"
+	"net/http"
+	"server/services" // 服务包，包含额度服务等业务逻辑
+
+	"github.com/gin-gonic/gin"     // Gin框架
+	"github.com/redis/go-redis/v9" // Redis客户端
+	"gorm.io/gorm"                 // GORM数据库框架
+)
+
+// QuotaController 额度控制器结构体
+type QuotaController struct {
+	DB  *gorm.DB      // 数据库连接
+	RDB *redis.Client // Redis连接
+}
+
+/**
+ * GetQuota 获取当前用户的额度
+ * 返回生效的限额、当日/当月已用量、剩余量（-1 表示不限）以及重置时间
+ */
+func (qc *QuotaController) GetQuota(c *gin.Context) {
+	uid, ok := currentUID(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "用户未登录",
+			"data": nil,
+		})
+		return
+	}
+
+	quota := services.QuotaService{DB: qc.DB, RDB: qc.RDB}
+	status, err := quota.Status(c.Request.Context(), uid)
+	if err != nil {
+		log.Printf("获取额度失败：user_id=%d, err=%v", uid, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "获取额度失败",
+			"data": nil,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "获取额度成功",
+		"data": status,
+	})
+}
@@ -0,0 +1,315 @@
+// UsageController 用量控制器
+// 负责按用户、会话、模型汇总AI消息的token用量和费用
+package controller
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"server/dto"   // 数据传输对象，定义请求和响应结构
+	"server/model" // 模型包，包含数据模型定义
+	"time"
+
+	"github.com/gin-gonic/gin" // Gin框架
+	"gorm.io/gorm"             // GORM数据库框架
+)
+
+// UsageController 用量控制器结构体
+type UsageController struct {
+	DB *gorm.DB // 数据库连接
+}
+
+// 汇总字段，已删除的消息同样计入用量；请求次数只计AI消息，摘要等调用只计token和费用
+const usageSelect = "COALESCE(SUM(messages.requests), 0) AS requests, " +
+	"COALESCE(SUM(messages.prompt_tokens), 0) AS prompt_tokens, " +
+	"COALESCE(SUM(messages.completion_tokens), 0) AS completion_tokens, " +
+	"COALESCE(SUM(messages.total_tokens), 0) AS total_tokens, " +
+	"COALESCE(SUM(messages.cost), 0) AS cost"
+
+// parseUsageRange 解析日期范围，结束日期包含当天
+func parseUsageRange(query *dto.GetUsageQuery) (*time.Time, *time.Time, error) {
+	var from, to *time.Time
+	if query.From != "" {
+		t, err := time.ParseInLocation(time.DateOnly, query.From, time.Local)
+		if err != nil {
+			return nil, nil, err
+		}
+		from = &t
+	}
+	if query.To != "" {
+		t, err := time.ParseInLocation(time.DateOnly, query.To, time.Local)
+		if err != nil {
+			return nil, nil, err
+		}
+		t = t.AddDate(0, 0, 1)
+		to = &t
+	}
+	return from, to, nil
+}
+
+// 参与汇总的列，AI消息与用量记录取相同的列合并
+const usageColumns = "conversation_id, provider, model, prompt_tokens, completion_tokens, total_tokens, cost"
+
+// usageScope 用户在时间范围内的AI消息及摘要等调用的用量记录，合并后仍以 messages 为别名；
+// 分叉会话复制的消息不重复计入
+func (uc *UsageController) usageScope(uid uint, from, to *time.Time) *gorm.DB {
+	messages := uc.DB.Unscoped().Model(&model.Message{}).
+		Select("1 AS requests, "+usageColumns).
+		Where("user_id = ? AND message_role = ? AND source_id = 0", uid, model.MessageRoleAI)
+	records := uc.DB.Model(&model.UsageRecord{}).
+		Select("0 AS requests, "+usageColumns).
+		Where("user_id = ?", uid)
+	if from != nil {
+		messages = messages.Where("created_at >= ?", *from)
+		records = records.Where("created_at >= ?", *from)
+	}
+	if to != nil {
+		messages = messages.Where("created_at < ?", *to)
+		records = records.Where("created_at < ?", *to)
+	}
+	return uc.DB.Table("(? UNION ALL ?) AS messages", messages, records)
+}
+
+// currentUID 读取JWT中间件写入的用户ID
+func currentUID(c *gin.Context) (uint, bool) {
+	currentUserID, ok := c.Get("userID")
+	if !ok {
+		return 0, false
+	}
+	uid, ok := currentUserID.(uint)
+	return uid, ok
+}
+
+/**
+ * GetUsageSummary 获取当前用户的用量汇总
+ * 返回总计以及按模型分组的明细，可通过 from/to 限定日期范围
+ */
+func (uc *UsageController) GetUsageSummary(c *gin.Context) {
+	var query dto.GetUsageQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "请求参数错误",
+			"data": nil,
+		})
+		return
+	}
+	from, to, err := parseUsageRange(&query)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "日期格式错误",
+			"data": nil,
+		})
+		return
+	}
+
+	uid, ok := currentUID(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "用户未登录",
+			"data": nil,
+		})
+		return
+	}
+
+	var total dto.UsageStat
+	if err := uc.usageScope(uid, from, to).Select(usageSelect).Scan(&total).Error; err != nil {
+		log.Printf("汇总用量失败：user_id=%d, err=%v", uid, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "获取用量失败",
+			"data": nil,
+		})
+		return
+	}
+
+	var byModel []dto.ModelUsageStat
+	if err := uc.usageScope(uid, from, to).
+		Select("messages.provider, messages.model, " + usageSelect).
+		Group("messages.provider, messages.model").
+		Order("cost DESC").
+		Scan(&byModel).Error; err != nil {
+		log.Printf("按模型汇总用量失败：user_id=%d, err=%v", uid, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "获取用量失败",
+			"data": nil,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "获取用量成功",
+		"data": gin.H{
+			"total":    total,
+			"by_model": byModel,
+		},
+	})
+}
+
+/**
+ * GetConversationUsageList 按会话分页汇总当前用户的用量，按费用降序
+ */
+func (uc *UsageController) GetConversationUsageList(c *gin.Context) {
+	var query dto.GetConversationUsageListQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "请求参数错误",
+			"data": nil,
+		})
+		return
+	}
+	from, to, err := parseUsageRange(&query.GetUsageQuery)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "日期格式错误",
+			"data": nil,
+		})
+		return
+	}
+
+	page := query.Page
+	pageSize := query.PageSize
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 {
+		pageSize = 10
+	}
+	if pageSize > 50 {
+		pageSize = 50
+	}
+
+	uid, ok := currentUID(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "用户未登录",
+			"data": nil,
+		})
+		return
+	}
+
+	// 总数为范围内有用量的会话数，与分页查询使用相同的范围
+	var total int64
+	if err := uc.usageScope(uid, from, to).
+		Select("COUNT(DISTINCT messages.conversation_id)").
+		Scan(&total).Error; err != nil {
+		log.Printf("统计有用量的会话数失败：user_id=%d, err=%v", uid, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "获取用量失败",
+			"data": nil,
+		})
+		return
+	}
+
+	var stats []dto.ConversationUsageStat
+	if err := uc.usageScope(uid, from, to).
+		Select("messages.conversation_id, conversations.title, " + usageSelect).
+		Joins("LEFT JOIN conversations ON conversations.id = messages.conversation_id").
+		Group("messages.conversation_id, conversations.title").
+		Order("cost DESC").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Scan(&stats).Error; err != nil {
+		log.Printf("按会话汇总用量失败：user_id=%d, err=%v", uid, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "获取用量失败",
+			"data": nil,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "获取用量成功",
+		"data": gin.H{
+			"conversations": stats,
+			"page":          page,
+			"page_size":     pageSize,
+			"total":         total,
+		},
+	})
+}
+
+/**
+ * GetConversationUsage 获取单个会话的用量汇总及按模型明细
+ */
+func (uc *UsageController) GetConversationUsage(c *gin.Context) {
+	var conversationID uint
+	if _, err := fmt.Sscanf(c.Param("conversation_id"), "%d", &conversationID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "请求参数错误",
+			"data": nil,
+		})
+		return
+	}
+
+	uid, ok := currentUID(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code": 400,
+			"msg":  "用户未登录",
+			"data": nil,
+		})
+		return
+	}
+
+	var conversation model.Conversation
+	if err := uc.DB.Unscoped().Where("id = ? AND user_id = ?", conversationID, uid).First(&conversation).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"code": 404,
+			"msg":  "对话不存在",
+			"data": nil,
+		})
+		return
+	}
+
+	var total dto.UsageStat
+	if err := uc.usageScope(uid, nil, nil).
+		Where("messages.conversation_id = ?", conversationID).
+		Select(usageSelect).Scan(&total).Error; err != nil {
+		log.Printf("汇总会话用量失败：conversation_id=%d, err=%v", conversationID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "获取用量失败",
+			"data": nil,
+		})
+		return
+	}
+
+	var byModel []dto.ModelUsageStat
+	if err := uc.usageScope(uid, nil, nil).
+		Where("messages.conversation_id = ?", conversationID).
+		Select("messages.provider, messages.model, " + usageSelect).
+		Group("messages.provider, messages.model").
+		Order("cost DESC").
+		Scan(&byModel).Error; err != nil {
+		log.Printf("按模型汇总会话用量失败：conversation_id=%d, err=%v", conversationID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code": 500,
+			"msg":  "获取用量失败",
+			"data": nil,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 200,
+		"msg":  "获取用量成功",
+		"data": gin.H{
+			"conversation_id": conversation.ID,
+			"title":           conversation.Title,
+			"total":           total,
+			"by_model":        byModel,
+		},
+	})
+}
@@ -0,0 +1,359 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"server/dto"
+	"server/middleware"
+	"server/services"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const (
+	wsWriteWait    = 10 * time.Second
+	wsPongWait     = 60 * time.Second
+	wsPingPeriod   = 30 * time.Second
+	wsMaxMessageKB = 64
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// 令牌通过子协议携带时须回应该子协议，否则浏览器会拒绝连接
+	Subprotocols: []string{middleware.WSTokenProtocol},
+	// 与CORS配置一致，只接受前端地址发起的连接；非浏览器客户端不带 Origin
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || origin == os.Getenv("FRONT_URL")
+	},
+}
+
+// WSController WebSocket传输，与SSE接口共用生成流程
+type WSController struct {
+	DB  *gorm.DB
+	RDB *redis.Client
+}
+
+// wsSession 一条WebSocket连接，同一连接上可以同时进行多个会话的生成
+type wsSession struct {
+	conn     *websocket.Conn
+	messages *MessageController
+	gin      *gin.Context // 绑定到连接生命周期的请求上下文副本，供各请求的处理协程使用
+	uid      uint
+
+	authMu sync.Mutex
+	claims *middleware.CustomClaims // 连接当前使用的令牌，退出登录或移除登录会话后关闭连接
+	expiry *time.Timer              // 令牌过期时关闭连接，客户端发送 auth 换用新令牌后推迟
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	mu     sync.Mutex // gorilla/websocket 不支持并发写
+}
+
+/**
+ * ServeWS 建立WebSocket连接
+ * 1. 鉴权与HTTP接口相同（JWTAuth），浏览器通过子协议携带JWT（见 middleware.WSTokenProtocol）；
+ *    JWT过期前客户端刷新令牌后发送 auth 消息换用新令牌，未换用时在过期时关闭连接；
+ *    令牌被作废（退出登录、移除登录会话）后在下一条消息或下一次心跳时关闭连接
+ * 2. 客户端发送 send / regenerate / stop / auth / ping 消息，以 request_id 区分同一连接上的多个请求
+ * 3. 生成与SSE接口一样投递到生成队列，事件带上 request_id 推送；连接断开只停止推送，生成仍会完成并保存
+ */
+func (wc *WSController) ServeWS(c *gin.Context) {
+	uid, ok := currentUID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code": 401,
+			"msg":  "用户未登录",
+			"data": nil,
+		})
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("WebSocket握手失败：user_id=%d, err=%v", uid, err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	gc := c.Copy()
+	gc.Request = c.Request.WithContext(ctx)
+	s := &wsSession{
+		conn:     conn,
+		messages: &MessageController{DB: wc.DB, RDB: wc.RDB},
+		gin:      gc,
+		uid:      uid,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	if claims, ok := c.Get("tokenClaims"); ok {
+		s.claims, _ = claims.(*middleware.CustomClaims)
+	}
+	defer s.wg.Wait()
+	defer cancel()
+
+	if expiresAt, ok := c.Get("tokenExpiresAt"); ok {
+		if t, ok := expiresAt.(time.Time); ok {
+			s.expiry = time.AfterFunc(time.Until(t), func() {
+				s.close(websocket.ClosePolicyViolation, "Token 已过期，请重新登录")
+			})
+			defer s.expiry.Stop()
+		}
+	}
+
+	s.wg.Add(1)
+	go s.keepAlive()
+	s.readLoop()
+}
+
+// readLoop 读取客户端消息直到连接断开，生成类请求在独立协程中处理，不阻塞后续消息
+func (s *wsSession) readLoop() {
+	s.conn.SetReadLimit(wsMaxMessageKB * 1024)
+	s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, payload, err := s.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("WebSocket连接异常断开：user_id=%d, err=%v", s.uid, err)
+			}
+			return
+		}
+		s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		if s.revoked() {
+			return
+		}
+
+		var msg dto.WSClientMessage
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			s.sendError("", http.StatusBadRequest, "消息格式错误", nil)
+			continue
+		}
+
+		switch msg.Type {
+		case dto.WSSend, dto.WSRegenerate:
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.generate(msg)
+			}()
+		case dto.WSStop:
+			s.stop(msg)
+		case dto.WSAuth:
+			s.auth(msg)
+		case dto.WSPing:
+			s.write(dto.WSServerMessage{Type: "pong", RequestID: msg.RequestID})
+		default:
+			s.sendError(msg.RequestID, http.StatusBadRequest, "不支持的消息类型："+msg.Type, nil)
+		}
+	}
+}
+
+// keepAlive 定时发送ping；连接结束（如写入失败）时关闭底层连接，使读取循环退出
+func (s *wsSession) keepAlive() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			s.conn.Close()
+			return
+		case <-ticker.C:
+			if s.revoked() {
+				return
+			}
+			s.mu.Lock()
+			err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+			s.mu.Unlock()
+			if err != nil {
+				s.cancel()
+				return
+			}
+		}
+	}
+}
+
+// revoked 检查连接当前使用的令牌是否已被作废，已作废时关闭连接；Redis不可用时与 JWTAuth 一样放行
+func (s *wsSession) revoked() bool {
+	s.authMu.Lock()
+	claims := s.claims
+	s.authMu.Unlock()
+	if claims == nil {
+		return false
+	}
+	revoked, err := middleware.IsTokenRevoked(s.ctx, claims)
+	if err != nil {
+		log.Printf("检查令牌是否作废失败：user_id=%d, err=%v", s.uid, err)
+		return false
+	}
+	if revoked {
+		s.close(websocket.ClosePolicyViolation, "Token 已失效，请重新登录")
+	}
+	return revoked
+}
+
+// auth 处理 auth：校验新令牌与 JWTAuth 相同且须属于同一用户，通过后换用新令牌并推迟连接的过期时间；
+// 校验失败只返回错误，连接仍按原令牌的有效期关闭
+func (s *wsSession) auth(msg dto.WSClientMessage) {
+	var req dto.WSAuthRequest
+	if err := decodeWSData(msg.Data, &req); err != nil {
+		s.sendError(msg.RequestID, http.StatusBadRequest, "请求参数错误", nil)
+		return
+	}
+	claims, err := middleware.ParseToken(req.Token)
+	if err != nil {
+		s.sendError(msg.RequestID, http.StatusUnauthorized, "Token 验证失败："+err.Error(), nil)
+		return
+	}
+	if claims.UserID != s.uid {
+		s.sendError(msg.RequestID, http.StatusUnauthorized, "Token 不属于当前用户", nil)
+		return
+	}
+	if revoked, err := middleware.IsTokenRevoked(s.ctx, claims); err != nil {
+		log.Printf("检查令牌是否作废失败，放行本次请求：user_id=%d, err=%v", s.uid, err)
+	} else if revoked {
+		s.sendError(msg.RequestID, http.StatusUnauthorized, "Token 已失效，请重新登录", nil)
+		return
+	}
+
+	var expiresIn time.Duration
+	if claims.ExpiresAt != nil {
+		expiresIn = time.Until(claims.ExpiresAt.Time)
+	}
+	s.authMu.Lock()
+	s.claims = claims
+	if s.expiry != nil {
+		if claims.ExpiresAt != nil {
+			s.expiry.Reset(expiresIn)
+		} else {
+			s.expiry.Stop()
+		}
+	}
+	s.authMu.Unlock()
+
+	data, _ := json.Marshal(gin.H{"type": "auth_ok", "expires_in": int64(expiresIn.Seconds())})
+	s.write(dto.WSServerMessage{Type: "auth_ok", RequestID: msg.RequestID, Data: data})
+}
+
+// generate 处理 send / regenerate：准备并投递生成任务，订阅其事件推送给客户端
+func (s *wsSession) generate(msg dto.WSClientMessage) {
+	if result, err := middleware.CheckRateLimit(s.ctx, "stream", fmt.Sprintf("user:%d", s.uid)); err != nil {
+		log.Printf("限流检查失败，放行本次请求：user_id=%d, err=%v", s.uid, err)
+	} else if result != nil && !result.Allowed {
+		s.sendError(msg.RequestID, http.StatusTooManyRequests, "请求过于频繁，请稍后再试", nil)
+		return
+	}
+
+	var job *services.GenerationJob
+	var genErr *generationError
+	switch msg.Type {
+	case dto.WSSend:
+		var req dto.SendRequest
+		if err := decodeWSData(msg.Data, &req); err != nil {
+			s.sendError(msg.RequestID, http.StatusBadRequest, "请求参数错误", nil)
+			return
+		}
+		job, genErr = s.messages.prepareGeneration(s.gin, &req, s.uid)
+	case dto.WSRegenerate:
+		var req dto.RegenerateRequest
+		if err := decodeWSData(msg.Data, &req); err != nil {
+			s.sendError(msg.RequestID, http.StatusBadRequest, "请求参数错误", nil)
+			return
+		}
+		job, genErr = s.messages.prepareRegeneration(s.gin, &req, s.uid)
+	}
+	if genErr != nil {
+		s.sendError(msg.RequestID, genErr.Status, genErr.Msg, genErr.Data)
+		return
+	}
+
+	gen := services.GenerationService{DB: s.messages.DB, RDB: s.messages.RDB}
+	if err := gen.Enqueue(s.ctx, job); err != nil {
+		log.Printf("投递生成任务失败：generation_id=%s, err=%v", job.ID, err)
+		s.sendError(msg.RequestID, http.StatusInternalServerError, "提交生成任务失败", nil)
+		return
+	}
+
+	err := gen.Tail(s.ctx, job.ID, "", func(event services.GenerationEvent) error {
+		return s.write(dto.WSServerMessage{Type: event.Type, RequestID: msg.RequestID, ID: event.ID, Data: event.Data})
+	})
+	if err != nil && s.ctx.Err() == nil {
+		log.Printf("读取生成事件失败：generation_id=%s, err=%v", job.ID, err)
+		s.sendError(msg.RequestID, http.StatusInternalServerError, "读取生成内容失败", nil)
+	}
+}
+
+// stop 处理 stop：发布停止指令，对应生成随后推送 stopped 事件
+func (s *wsSession) stop(msg dto.WSClientMessage) {
+	var req dto.StopRequest
+	if err := decodeWSData(msg.Data, &req); err != nil || (req.StreamID == "" && req.ConversationID == 0) {
+		s.sendError(msg.RequestID, http.StatusBadRequest, "请求参数错误", nil)
+		return
+	}
+
+	streamID, err := services.Streams.Stop(s.ctx, s.uid, req.ConversationID, req.StreamID)
+	if err != nil {
+		if errors.Is(err, services.ErrStreamNotFound) {
+			s.sendError(msg.RequestID, http.StatusNotFound, err.Error(), nil)
+			return
+		}
+		log.Printf("停止生成失败：user_id=%d, err=%v", s.uid, err)
+		s.sendError(msg.RequestID, http.StatusInternalServerError, "停止生成失败", nil)
+		return
+	}
+	data, _ := json.Marshal(gin.H{"type": "stop_accepted", "stream_id": streamID})
+	s.write(dto.WSServerMessage{Type: "stop_accepted", RequestID: msg.RequestID, Data: data})
+}
+
+// decodeWSData 解析消息内容并按 binding 标签校验
+func decodeWSData(data json.RawMessage, req interface{}) error {
+	if err := json.Unmarshal(data, req); err != nil {
+		return err
+	}
+	return binding.Validator.ValidateStruct(req)
+}
+
+// sendError 推送错误事件，内容与SSE的错误事件一致
+func (s *wsSession) sendError(requestID string, code int, msg string, detail interface{}) {
+	data, _ := json.Marshal(dto.ErrorEvent{EventHeader: dto.NewEventHeader(dto.EventError), Code: code, Msg: msg, Data: detail})
+	s.write(dto.WSServerMessage{Type: dto.EventError, RequestID: requestID, Data: data})
+}
+
+// write 串行写入一条消息，写入失败时结束连接
+func (s *wsSession) write(msg dto.WSServerMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if err := s.conn.WriteJSON(msg); err != nil {
+		s.cancel()
+		return err
+	}
+	return nil
+}
+
+// close 发送关闭帧并结束连接
+func (s *wsSession) close(code int, reason string) {
+	s.mu.Lock()
+	s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteWait))
+	s.mu.Unlock()
+	s.cancel()
+	s.conn.Close()
+}
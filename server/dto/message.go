@@ -11,7 +11,9 @@ type SendRequest struct {
 	ConversationID uint              `json:"conversation_id"`
 	Content        string            `json:"content" binding:"required"`
 	Type           model.MessageType `json:"type" binding:"required"`
-	ReasonModal    bool            `json:"reason_modal" default:"false"`
+	ReasonModal    bool              `json:"reason_modal" default:"false"`
+	Provider       string            `json:"provider"` // 指定AI提供方，为空时使用会话或全局配置
+	Model          string            `json:"model"`    // 指定模型，为空时使用会话或提供方默认模型
 }
 
 type GetMessageListQuery struct {
@@ -20,14 +22,57 @@ type GetMessageListQuery struct {
 	PageSize       int  `form:"page_size"`
 }
 
+// RegenerateRequest 重新生成AI回复，可临时指定提供方、模型和深度思考
+type RegenerateRequest struct {
+	MessageID   uint   `json:"message_id" binding:"required"`
+	ReasonModal bool   `json:"reason_modal"`
+	Provider    string `json:"provider"`
+	Model       string `json:"model"`
+}
+
+// EditMessageRequest 编辑用户消息并在新分支上重新生成回复
+type EditMessageRequest struct {
+	MessageID   uint   `json:"message_id" binding:"required"`
+	Content     string `json:"content" binding:"required"`
+	ReasonModal bool   `json:"reason_modal"`
+	Provider    string `json:"provider"`
+	Model       string `json:"model"`
+}
+
+// GetBranchesQuery 获取会话消息树
+type GetBranchesQuery struct {
+	ConversationID uint `form:"conversation_id" binding:"required"`
+}
+
+// SelectVersionRequest 切换当前显示的回复版本
+type SelectVersionRequest struct {
+	MessageID uint `json:"message_id" binding:"required"`
+}
+
+// StopRequest 停止生成，指定 stream_id 或会话ID其一
+type StopRequest struct {
+	ConversationID uint   `json:"conversation_id"`
+	StreamID       string `json:"stream_id"`
+}
+
+// OpenAI 兼容接口（含 DashScope 扩展字段）的请求体
 type RequestBody struct {
-	Model             string    `json:"model"`
-	Messages          []Message `json:"messages"`
-	Stream            bool      `json:"stream"`
-	EnableThinking    bool      `json:"enable_thinking"`
-	EnableSearch      bool      `json:"enable_search"`
-	ResultFormat      string    `json:"result_format"`
-	IncrementalOutput bool      `json:"incremental_output"`
+	Model             string         `json:"model"`
+	Messages          []Message      `json:"messages"`
+	Stream            bool           `json:"stream"`
+	EnableThinking    bool           `json:"enable_thinking,omitempty"`
+	EnableSearch      bool           `json:"enable_search,omitempty"`
+	ResultFormat      string         `json:"result_format,omitempty"`
+	IncrementalOutput bool           `json:"incremental_output,omitempty"`
+	Temperature       *float64       `json:"temperature,omitempty"`
+	TopP              *float64       `json:"top_p,omitempty"`
+	MaxTokens         *int           `json:"max_tokens,omitempty"`
+	StreamOptions     *StreamOptions `json:"stream_options,omitempty"`
+}
+
+// 流式请求选项，include_usage 为 true 时最后一个分片携带用量
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type ChoiceItem struct {
@@ -69,4 +114,5 @@ type QwenStreamChunk struct {
 		} `json:"delta"`
 		FinishReason *string `json:"finish_reason,omitempty"`
 	} `json:"choices"`
+	Usage *UsageItem `json:"usage,omitempty"`
 }
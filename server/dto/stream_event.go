@@ -0,0 +1,97 @@
+package dto
+
+import "server/model"
+
+// StreamSchemaVersion 流式事件结构的版本，事件字段发生不兼容变化时递增，客户端据此判断能否解析
+const StreamSchemaVersion = 1
+
+// 流式事件类型：SSE 的 event 字段、WebSocket 消息的 type 以及事件内容中的 type 均取这些值
+const (
+	EventStart          = "start"           // 生成开始
+	EventContextTrimmed = "context_trimmed" // 上下文超出窗口被裁剪
+	EventReasoning      = "reasoning"       // 思考过程分片
+	EventChunk          = "chunk"           // 回复分片
+	EventDone           = "done"            // 输出结束（随后保存回复），或错误后的结束标记
+	EventComplete       = "complete"        // 回复已保存，最后一条事件
+	EventStopped        = "stopped"         // 用户停止生成，最后一条事件
+	EventError          = "error"           // 出错，随后是 done
+)
+
+// StreamEvent 流式事件，SSE 和 WebSocket 共用
+type StreamEvent interface {
+	EventType() string
+}
+
+// EventHeader 所有流式事件共有的字段
+type EventHeader struct {
+	Version        int    `json:"v"`
+	Type           string `json:"type"`
+	StreamID       string `json:"stream_id,omitempty"`
+	ConversationID uint   `json:"conversation_id,omitempty"`
+	UserMessageID  uint   `json:"user_message_id,omitempty"`
+}
+
+func (h EventHeader) EventType() string {
+	return h.Type
+}
+
+// NewEventHeader 创建当前版本的事件头
+func NewEventHeader(eventType string) EventHeader {
+	return EventHeader{Version: StreamSchemaVersion, Type: eventType}
+}
+
+// TrimReport 上下文裁剪结果
+type TrimReport struct {
+	Model           string `json:"model"`
+	Limit           int    `json:"limit"`            // 可用于输入的token上限（已扣除输出预留）
+	OriginalTokens  int    `json:"original_tokens"`  // 裁剪前估算的token数
+	PromptTokens    int    `json:"prompt_tokens"`    // 裁剪后估算的token数
+	DroppedMessages int    `json:"dropped_messages"` // 被丢弃的历史消息条数
+	Overflow        bool   `json:"overflow"`         // 仅保留系统提示和最新消息仍超出上限
+}
+
+// StartEvent 生成开始
+type StartEvent struct {
+	EventHeader
+}
+
+// ContextTrimmedEvent 上下文被裁剪
+type ContextTrimmedEvent struct {
+	EventHeader
+	Trim *TrimReport `json:"trim"`
+}
+
+// ReasoningEvent 思考过程分片
+type ReasoningEvent struct {
+	EventHeader
+	ReasoningContent string `json:"reasoning_content"`
+}
+
+// ChunkEvent 回复分片
+type ChunkEvent struct {
+	EventHeader
+	Content string `json:"content"`
+}
+
+// DoneEvent 输出结束
+type DoneEvent struct {
+	EventHeader
+	Msg string `json:"msg"`
+}
+
+// ResultEvent 生成结果（complete 或 stopped），停止时没有任何内容则 ai_message 为空
+type ResultEvent struct {
+	EventHeader
+	Msg         string         `json:"msg"`
+	UserMessage model.Message  `json:"user_message"`
+	AIMessage   *model.Message `json:"ai_message"`
+	Usage       *MessageUsage  `json:"usage,omitempty"`
+}
+
+// ErrorEvent 错误，Code 为业务错误码（如额度超限429），Data 为错误详情
+type ErrorEvent struct {
+	EventHeader
+	Code int         `json:"code,omitempty"`
+	Msg  string      `json:"msg"`
+	Data interface{} `json:"data,omitempty"`
+}
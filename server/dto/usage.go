@@ -0,0 +1,46 @@
+package dto
+
+// 单条AI消息的用量
+type MessageUsage struct {
+	Provider         string  `json:"provider"`
+	Model            string  `json:"model"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	LatencyMs        int64   `json:"latency_ms"`
+	Cost             float64 `json:"cost"`
+}
+
+// 用量汇总
+type UsageStat struct {
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+// 按模型分组的用量汇总
+type ModelUsageStat struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	UsageStat
+}
+
+// 按会话分组的用量汇总
+type ConversationUsageStat struct {
+	ConversationID uint   `json:"conversation_id"`
+	Title          string `json:"title"`
+	UsageStat
+}
+
+type GetUsageQuery struct {
+	From string `form:"from"` // 起始日期（含），格式 2006-01-02
+	To   string `form:"to"`   // 结束日期（含），格式 2006-01-02
+}
+
+type GetConversationUsageListQuery struct {
+	GetUsageQuery
+	Page     int `form:"page"`
+	PageSize int `form:"page_size"`
+}
@@ -0,0 +1,34 @@
+package dto
+
+import "encoding/json"
+
+// WebSocket 客户端消息类型
+const (
+	WSSend       = "send"       // 发送消息，data 同 SendRequest
+	WSStop       = "stop"       // 停止生成，data 同 StopRequest
+	WSRegenerate = "regenerate" // 重新生成回复，data 同 RegenerateRequest
+	WSPing       = "ping"       // 应用层心跳，服务端回复 pong
+	WSAuth       = "auth"       // 换用刷新后的访问令牌，data 同 WSAuthRequest，服务端回复 auth_ok
+)
+
+// WSAuthRequest 连接使用的访问令牌过期前，客户端通过 /api/auth/refresh 取得新令牌后发送
+type WSAuthRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// WSClientMessage 客户端通过 /api/ws 发送的消息
+type WSClientMessage struct {
+	Type      string          `json:"type"`
+	RequestID string          `json:"request_id"` // 客户端生成，服务端推送的事件原样带回，用于在同一连接上区分多个请求
+	Data      json.RawMessage `json:"data"`
+}
+
+// WSServerMessage 服务端通过 /api/ws 推送的消息
+// 生成事件的 type 与SSE事件一致（start/chunk/reasoning/context_trimmed/done/complete/stopped/error），
+// data 为与SSE相同的事件内容；此外还有 stop_accepted、auth_ok 和 pong
+type WSServerMessage struct {
+	Type      string          `json:"type"`
+	RequestID string          `json:"request_id,omitempty"`
+	ID        string          `json:"id,omitempty"` // 生成事件ID，可用于 /api/message/stream/:generation_id 续读
+	Data      json.RawMessage `json:"data,omitempty"`
+}
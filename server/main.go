@@ -5,9 +5,10 @@ package main
 import (
 	"log"
 	"os"
-	"server/config"     // 配置包，包含数据库连接等配置
-	"server/model"      // 模型包，包含数据模型定义
-	"server/router"     // 路由包，包含HTTP路由定义
+	"server/config"   // 配置包，包含数据库连接等配置
+	"server/model"    // 模型包，包含数据模型定义
+	"server/router"   // 路由包，包含HTTP路由定义
+	"server/services" // 服务包，包含AI提供方等业务逻辑
 
 	"github.com/joho/godotenv" // 环境变量加载库
 )
@@ -17,8 +18,9 @@ import (
  * 1. 加载环境变量
  * 2. 初始化数据库连接
  * 3. 自动迁移表结构
- * 4. 设置路由
- * 5. 启动HTTP服务
+ * 4. 注册AI提供方，订阅停止生成指令并启动生成worker
+ * 5. 设置路由
+ * 6. 启动HTTP服务
  */
 func main() {
 	// 加载 .env 文件中的环境变量
@@ -31,13 +33,27 @@ func main() {
 	// 初始化数据库连接
 	config.InitDB()
 
-	// 自动迁移表结构，创建或更新 User、Conversation、Message 表
-	err = config.DB.AutoMigrate(&model.User{},&model.Conversation{},&model.Message{})
+	// 自动迁移表结构，创建或更新 User、Conversation、Message、UserQuota、SchemaMigration 表
+	err = config.DB.AutoMigrate(&model.User{}, &model.Conversation{}, &model.Message{}, &model.UserQuota{}, &model.RefreshToken{}, &model.UserSession{}, &model.AuthAuditLog{}, &model.UsageRecord{}, &model.SchemaMigration{})
 
 	if err != nil {
 		log.Fatal("表结构迁移失败", err) // 表结构迁移失败，程序终止
 	}
 
+	// 一次性数据迁移：为已有消息补全消息树的 parent_id
+	err = model.ApplyMigration(config.DB, "backfill_message_parents", model.BackfillMessageParents)
+
+	if err != nil {
+		log.Fatal("数据迁移失败", err) // 数据迁移失败，程序终止
+	}
+
+	// 注册AI提供方
+	services.InitProviders()
+
+	// 订阅停止生成指令，启动生成worker
+	services.InitStreamRegistry(config.RDB)
+	services.StartGenerationWorkers(config.DB, config.RDB)
+
 	// 设置路由
 	r := router.SetupRouter()
 
@@ -50,4 +66,4 @@ func main() {
 	if err != nil {
 		log.Fatal("后端服务启动失败", err) // 服务启动失败，程序终止
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+
+	"server/config"
+	"server/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireAdmin 仅允许管理员访问，须在 JWTAuth 之后使用
+// 角色每次从数据库读取而不是写入令牌，撤销管理员后立即生效；数据库不可用时拒绝
+func RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid, ok := c.Get("userID")
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"code": 401,
+				"msg":  "用户未登录",
+				"data": nil,
+			})
+			c.Abort()
+			return
+		}
+
+		var user model.User
+		if err := config.DB.Select("id", "role").Where("id = ?", uid).First(&user).Error; err != nil {
+			log.Printf("读取用户角色失败：user_id=%v, err=%v", uid, err)
+			c.JSON(http.StatusForbidden, gin.H{
+				"code": 403,
+				"msg":  "没有权限",
+				"data": nil,
+			})
+			c.Abort()
+			return
+		}
+		if user.Role != model.UserRoleAdmin {
+			c.JSON(http.StatusForbidden, gin.H{
+				"code": 403,
+				"msg":  "没有权限",
+				"data": nil,
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -1,21 +1,36 @@
 package middleware
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
+	"server/config"
+
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v4"
 )
 
+const (
+	// 已作废的访问令牌：revoked_jti:{jti}，保留到令牌过期
+	revokedJTIKeyPrefix = "revoked_jti:%s"
+	// 已作废的令牌家族：revoked_token_family:{familyID}，该家族此前签发的访问令牌全部失效，保留一个访问令牌有效期
+	revokedFamilyKeyPrefix = "revoked_token_family:%s"
+)
+
+// CustomClaims 访问令牌的声明，RegisteredClaims.ID 为令牌ID（jti），FamilyID 为签发时所属的刷新令牌家族
 type CustomClaims struct {
 	UserID   uint
 	Username string
+	FamilyID string `json:",omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -29,27 +44,38 @@ func getJWTSecret() string {
 	return secret
 }
 
-func getJWTExpireHours() int {
-	expireHours := os.Getenv("JWT_EXPIRES_IN")
-	if expireHours == "" {
-		return 24
+// AccessTokenTTL 访问令牌的有效期，由 JWT_ACCESS_TTL_MINUTES 配置，过期后凭刷新令牌换取
+func AccessTokenTTL() time.Duration {
+	minutes := os.Getenv("JWT_ACCESS_TTL_MINUTES")
+	if n, err := strconv.Atoi(minutes); err == nil && n > 0 {
+		return time.Duration(n) * time.Minute
 	}
+	return 15 * time.Minute
+}
 
-	if hours, err := strconv.Atoi(expireHours); err == nil {
-		return hours
+// newTokenID 生成随机的令牌ID（jti）
+func newTokenID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
 	}
-
-	return 24
+	return hex.EncodeToString(buf), nil
 }
 
-func GenerateToken(userID uint, username string) (string, error) {
-	expireHours := getJWTExpireHours()
+// GenerateToken 签发访问令牌，familyID 为同时签发的刷新令牌所属的家族
+func GenerateToken(userID uint, username string, familyID string) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
 
 	claims := CustomClaims{
 		UserID:   userID,
 		Username: username,
+		FamilyID: familyID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Duration(expireHours) * time.Hour)),
+			ID:        jti,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(AccessTokenTTL())),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 			Issuer:    "my-chat",
@@ -93,27 +119,91 @@ func ParseToken(tokenString string) (*CustomClaims, error) {
 	return nil, errors.New("token无效")
 }
 
-func JWTAuth() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"code": 401,
-				"msg":  "未携带token",
-				"data": nil,
-			})
-			c.Abort()
-			return
+// RevokeAccessToken 作废访问令牌直到其过期（退出登录）
+func RevokeAccessToken(ctx context.Context, claims *CustomClaims) error {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+	ttl := time.Until(claims.ExpiresAt.Time)
+	if ttl <= 0 {
+		return nil
+	}
+	return config.RDB.Set(ctx, fmt.Sprintf(revokedJTIKeyPrefix, claims.ID), 1, ttl).Err()
+}
+
+// RevokeTokenFamily 作废家族（登录会话）此前签发的所有访问令牌；刷新令牌由 services.RefreshTokenService 作废
+func RevokeTokenFamily(ctx context.Context, familyID string) error {
+	if familyID == "" {
+		return nil
+	}
+	return config.RDB.Set(ctx, fmt.Sprintf(revokedFamilyKeyPrefix, familyID), 1, AccessTokenTTL()).Err()
+}
+
+// IsTokenRevoked 访问令牌本身或其所属家族是否已作废
+func IsTokenRevoked(ctx context.Context, claims *CustomClaims) (bool, error) {
+	keys := make([]string, 0, 2)
+	if claims.ID != "" {
+		keys = append(keys, fmt.Sprintf(revokedJTIKeyPrefix, claims.ID))
+	}
+	if claims.FamilyID != "" {
+		keys = append(keys, fmt.Sprintf(revokedFamilyKeyPrefix, claims.FamilyID))
+	}
+	if len(keys) == 0 {
+		return false, nil
+	}
+	n, err := config.RDB.Exists(ctx, keys...).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// WSTokenProtocol 浏览器建立WebSocket连接时无法设置请求头，在子协议中携带令牌：
+// new WebSocket(url, ["mychat.bearer", token])，服务端选定 mychat.bearer 作为子协议。
+// 不使用查询参数，避免令牌随请求地址写入访问日志
+const WSTokenProtocol = "mychat.bearer"
+
+// wsProtocolToken 从 Sec-WebSocket-Protocol 请求头中读取紧跟在 WSTokenProtocol 之后的令牌
+func wsProtocolToken(c *gin.Context) string {
+	var protocols []string
+	for _, value := range c.Request.Header.Values("Sec-WebSocket-Protocol") {
+		for _, item := range strings.Split(value, ",") {
+			protocols = append(protocols, strings.TrimSpace(item))
+		}
+	}
+	for i := 0; i+1 < len(protocols); i++ {
+		if protocols[i] == WSTokenProtocol {
+			return protocols[i+1]
 		}
+	}
+	return ""
+}
 
-		var tokenString string
-		parts := strings.SplitN(authHeader, " ", 2)
-		if parts[0] == "Bearer" && len(parts) == 2 {
-			tokenString = parts[1]
-		} else {
+// BearerToken 读取 Authorization 请求头中的令牌；WebSocket连接可通过子协议携带（见 WSTokenProtocol）
+func BearerToken(c *gin.Context) (string, error) {
+	authHeader := c.GetHeader("Authorization")
+	if authHeader == "" && c.IsWebsocket() {
+		if token := wsProtocolToken(c); token != "" {
+			authHeader = "Bearer " + token
+		}
+	}
+	if authHeader == "" {
+		return "", errors.New("未携带token")
+	}
+	parts := strings.SplitN(authHeader, " ", 2)
+	if parts[0] != "Bearer" || len(parts) != 2 {
+		return "", errors.New("token格式错误")
+	}
+	return parts[1], nil
+}
+
+func JWTAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString, err := BearerToken(c)
+		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"code": 401,
-				"msg":  "token格式错误",
+				"msg":  err.Error(),
 				"data": nil,
 			})
 			c.Abort()
@@ -139,9 +229,27 @@ func JWTAuth() gin.HandlerFunc {
 			return
 		}
 
+		// 已退出登录、所属登录会话已被移除或因刷新令牌重用而作废；Redis不可用时放行，令牌仍会按有效期过期
+		if revoked, err := IsTokenRevoked(c.Request.Context(), claims); err != nil {
+			log.Printf("检查令牌是否作废失败，放行本次请求：user_id=%d, err=%v", claims.UserID, err)
+		} else if revoked {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"code": 401,
+				"msg":  "Token 已失效，请重新登录",
+				"data": nil,
+			})
+			c.Abort()
+			return
+		}
+
 		// Token 验证通过，将 Claim 中的用户信息存入 Gin 上下文（供后续接口使用）
 		c.Set("userID", claims.UserID)
 		c.Set("username", claims.Username)
+		c.Set("tokenFamilyID", claims.FamilyID)
+		c.Set("tokenClaims", claims)
+		if claims.ExpiresAt != nil {
+			c.Set("tokenExpiresAt", claims.ExpiresAt.Time)
+		}
 
 		c.Next()
 
@@ -0,0 +1,205 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"server/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// 限流计数Key：rate_limit:{规则名}:{user:ID 或 ip:地址}
+const rateLimitKeyPrefix = "rate_limit:%s:%s"
+
+// RateLimitRule 限流规则：Window 时间窗口内最多 Limit 次请求
+type RateLimitRule struct {
+	Limit  int
+	Window time.Duration
+}
+
+// 各路由的默认限流规则，可通过 RATE_LIMITS="login:10:1m,stream:30:1m" 覆盖
+var defaultRateLimitRules = map[string]RateLimitRule{
+	"default":  {Limit: 120, Window: time.Minute},
+	"login":    {Limit: 10, Window: time.Minute},
+	"register": {Limit: 5, Window: time.Hour},
+	"refresh":  {Limit: 30, Window: time.Minute},
+	"mail":     {Limit: 5, Window: time.Hour},
+	"send":     {Limit: 30, Window: time.Minute},
+	"stream":   {Limit: 30, Window: time.Minute},
+}
+
+var (
+	rateLimitRules     map[string]RateLimitRule
+	rateLimitRulesOnce sync.Once
+)
+
+// 滑动窗口：有序集合中保存窗口内每次请求的时间戳
+// 返回 {是否放行, 剩余次数, 距离可再次请求的毫秒数}
+var slidingWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], 0, now - window)
+local count = redis.call("ZCARD", KEYS[1])
+if count < limit then
+	redis.call("ZADD", KEYS[1], now, ARGV[4])
+	redis.call("PEXPIRE", KEYS[1], window)
+	return {1, limit - count - 1, 0}
+end
+local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+return {0, 0, tonumber(oldest[2]) + window - now}
+`)
+
+// loadRateLimitRules 合并默认规则与 RATE_LIMITS 配置，格式为 名称:次数:窗口
+func loadRateLimitRules() map[string]RateLimitRule {
+	rules := make(map[string]RateLimitRule, len(defaultRateLimitRules))
+	for name, rule := range defaultRateLimitRules {
+		rules[name] = rule
+	}
+
+	env := os.Getenv("RATE_LIMITS")
+	if env == "" {
+		return rules
+	}
+	for _, item := range strings.Split(env, ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) != 3 {
+			log.Printf("RATE_LIMITS 配置格式错误：%s", item)
+			continue
+		}
+		limit, err1 := strconv.Atoi(parts[1])
+		window, err2 := time.ParseDuration(parts[2])
+		if err1 != nil || err2 != nil || window <= 0 {
+			log.Printf("RATE_LIMITS 配置格式错误：%s", item)
+			continue
+		}
+		rules[parts[0]] = RateLimitRule{Limit: limit, Window: window}
+	}
+	return rules
+}
+
+// GetRateLimitRule 读取指定名称的限流规则，未配置时使用 default
+func GetRateLimitRule(name string) RateLimitRule {
+	rateLimitRulesOnce.Do(func() {
+		rateLimitRules = loadRateLimitRules()
+	})
+	if rule, ok := rateLimitRules[name]; ok {
+		return rule
+	}
+	return rateLimitRules["default"]
+}
+
+// 按IP限流的规则：登录、注册等未登录接口，即使请求携带了令牌也按IP计数，避免换用令牌绕过
+var ipScopedRateLimitRules = map[string]bool{
+	"login":    true,
+	"register": true,
+	"refresh":  true,
+	"mail":     true,
+}
+
+/**
+ * rateLimitSubject 限流主体：已登录时按用户ID，否则按客户端IP
+ * default 规则挂在 /api 分组上，先于 JWTAuth 执行，此时从请求携带的令牌中解析用户；
+ * 令牌无效时按IP限流，由随后的 JWTAuth 拒绝请求
+ */
+func rateLimitSubject(c *gin.Context, name string) string {
+	if !ipScopedRateLimitRules[name] {
+		if userID, ok := c.Get("userID"); ok {
+			return fmt.Sprintf("user:%v", userID)
+		}
+		if tokenString, err := BearerToken(c); err == nil {
+			if claims, err := ParseToken(tokenString); err == nil {
+				return fmt.Sprintf("user:%d", claims.UserID)
+			}
+		}
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// RateLimitResult 一次限流检查的结果
+type RateLimitResult struct {
+	Limit        int
+	Allowed      bool
+	Remaining    int64
+	ResetSeconds int64 // 窗口重置（超限时为可重试）的剩余秒数
+}
+
+/**
+ * CheckRateLimit 按规则检查并记录一次请求，subject 为限流主体（如 user:1、ip:127.0.0.1）
+ * 规则关闭时返回 nil；Redis不可用时返回错误，由调用方放行
+ */
+func CheckRateLimit(ctx context.Context, name string, subject string) (*RateLimitResult, error) {
+	rule := GetRateLimitRule(name)
+	if rule.Limit <= 0 {
+		return nil, nil
+	}
+
+	now := time.Now().UnixMilli()
+	key := fmt.Sprintf(rateLimitKeyPrefix, name, subject)
+	member := fmt.Sprintf("%d-%d", now, rand.Int63())
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	result, err := slidingWindowScript.Run(ctx, config.RDB, []string{key},
+		now, rule.Window.Milliseconds(), rule.Limit, member).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	allowed, remaining, retryAfterMs := result[0] == 1, result[1], result[2]
+	resetSeconds := int64(rule.Window.Seconds())
+	if !allowed {
+		resetSeconds = (retryAfterMs + 999) / 1000
+	}
+	return &RateLimitResult{Limit: rule.Limit, Allowed: allowed, Remaining: remaining, ResetSeconds: resetSeconds}, nil
+}
+
+/**
+ * RateLimit 基于Redis滑动窗口的限流中间件
+ * 携带有效令牌时按用户ID限流（登录、注册等规则除外），否则按客户端IP限流；
+ * 响应携带 X-RateLimit-Limit / X-RateLimit-Remaining / X-RateLimit-Reset，超限时返回429和 Retry-After；
+ * Limit 为0表示关闭该规则，Redis不可用时放行
+ */
+func RateLimit(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		result, err := CheckRateLimit(c.Request.Context(), name, rateLimitSubject(c, name))
+		if err != nil {
+			log.Printf("限流检查失败，放行本次请求：rule=%s, err=%v", name, err)
+			c.Next()
+			return
+		}
+		if result == nil {
+			c.Next()
+			return
+		}
+
+		c.Header("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+		c.Header("X-RateLimit-Remaining", strconv.FormatInt(result.Remaining, 10))
+		c.Header("X-RateLimit-Reset", strconv.FormatInt(result.ResetSeconds, 10))
+
+		if !result.Allowed {
+			c.Header("Retry-After", strconv.FormatInt(result.ResetSeconds, 10))
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"code": 429,
+				"msg":  "请求过于频繁，请稍后再试",
+				"data": gin.H{
+					"retry_after": result.ResetSeconds,
+				},
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
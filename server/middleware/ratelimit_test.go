@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"server/config"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// useTestRedis 将 config.RDB 指向内存Redis，并以 rules 替换限流规则
+func useTestRedis(t *testing.T, rules map[string]RateLimitRule) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1, DialerRetries: 1})
+
+	oldRDB, oldRules := config.RDB, rateLimitRules
+	rateLimitRulesOnce.Do(func() {})
+	config.RDB, rateLimitRules = rdb, rules
+	t.Cleanup(func() {
+		rdb.Close()
+		config.RDB, rateLimitRules = oldRDB, oldRules
+	})
+	return mr
+}
+
+func TestCheckRateLimit(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("达到上限后拒绝", func(t *testing.T) {
+		useTestRedis(t, map[string]RateLimitRule{"default": {Limit: 3, Window: time.Minute}})
+		for i, wantRemaining := range []int64{2, 1, 0} {
+			result, err := CheckRateLimit(ctx, "default", "user:1")
+			if err != nil || !result.Allowed || result.Remaining != wantRemaining {
+				t.Fatalf("第 %d 次：result = %+v, err = %v", i+1, result, err)
+			}
+		}
+		result, err := CheckRateLimit(ctx, "default", "user:1")
+		if err != nil || result.Allowed {
+			t.Fatalf("超限后应拒绝：result = %+v, err = %v", result, err)
+		}
+		if result.ResetSeconds < 1 || result.ResetSeconds > 60 {
+			t.Errorf("ResetSeconds = %d, want 1..60", result.ResetSeconds)
+		}
+	})
+
+	t.Run("不同主体与规则分别计数", func(t *testing.T) {
+		useTestRedis(t, map[string]RateLimitRule{
+			"default": {Limit: 1, Window: time.Minute},
+			"send":    {Limit: 1, Window: time.Minute},
+		})
+		for _, call := range []struct{ name, subject string }{
+			{"default", "user:1"}, {"default", "user:2"}, {"send", "user:1"},
+		} {
+			if result, err := CheckRateLimit(ctx, call.name, call.subject); err != nil || !result.Allowed {
+				t.Errorf("%s %s：result = %+v, err = %v", call.name, call.subject, result, err)
+			}
+		}
+	})
+
+	t.Run("窗口滑过后恢复", func(t *testing.T) {
+		useTestRedis(t, map[string]RateLimitRule{"default": {Limit: 1, Window: 100 * time.Millisecond}})
+		CheckRateLimit(ctx, "default", "user:1")
+		if result, _ := CheckRateLimit(ctx, "default", "user:1"); result.Allowed {
+			t.Fatal("窗口内应拒绝")
+		}
+		time.Sleep(150 * time.Millisecond)
+		if result, err := CheckRateLimit(ctx, "default", "user:1"); err != nil || !result.Allowed {
+			t.Fatalf("窗口滑过后应放行：result = %+v, err = %v", result, err)
+		}
+	})
+
+	t.Run("规则关闭时不限流", func(t *testing.T) {
+		useTestRedis(t, map[string]RateLimitRule{"default": {Limit: 0, Window: time.Minute}})
+		if result, err := CheckRateLimit(ctx, "default", "user:1"); result != nil || err != nil {
+			t.Fatalf("result = %+v, err = %v, want nil", result, err)
+		}
+	})
+
+	t.Run("Redis不可用时返回错误", func(t *testing.T) {
+		mr := useTestRedis(t, map[string]RateLimitRule{"default": {Limit: 1, Window: time.Minute}})
+		mr.Close()
+		if _, err := CheckRateLimit(ctx, "default", "user:1"); err == nil {
+			t.Fatal("want error")
+		}
+	})
+}
+
+func TestRateLimitSubject(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	token, err := GenerateToken(7, "alice", "family")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		rule   string
+		auth   string
+		userID any
+		want   string
+	}{
+		{"未登录按IP", "default", "", nil, "ip:192.0.2.1"},
+		{"已通过认证按用户", "send", "", uint(7), "user:7"},
+		{"认证前从令牌解析用户", "default", "Bearer " + token, nil, "user:7"},
+		{"无效令牌按IP", "default", "Bearer invalid", nil, "ip:192.0.2.1"},
+		{"登录规则始终按IP", "login", "Bearer " + token, nil, "ip:192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/api/test", nil)
+			c.Request.RemoteAddr = "192.0.2.1:1234"
+			if tt.auth != "" {
+				c.Request.Header.Set("Authorization", tt.auth)
+			}
+			if tt.userID != nil {
+				c.Set("userID", tt.userID)
+			}
+			if got := rateLimitSubject(c, tt.rule); got != tt.want {
+				t.Errorf("rateLimitSubject = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package model
+
+import "time"
+
+// 认证审计事件
+const (
+	AuditLoginLocked   = "login_locked"   // 用户名连续登录失败达到阈值，暂时锁定
+	AuditIPLocked      = "ip_locked"      // 同一IP连续登录失败达到阈值，暂时锁定
+	AuditLoginUnlocked = "login_unlocked" // 锁定被解除
+)
+
+// AuthAuditLog 认证相关的审计记录
+type AuthAuditLog struct {
+	ID        uint      `json:"id" gorm:"primary_key"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+	UserID    uint      `json:"user_id" gorm:"index"` // 用户名不存在时为0
+	Username  string    `json:"username" gorm:"size:64;index"`
+	IP        string    `json:"ip" gorm:"size:64"`
+	Event     string    `json:"event" gorm:"size:32"`
+	Detail    string    `json:"detail" gorm:"size:255"`
+}
+
+func (AuthAuditLog) TableName() string {
+	return "auth_audit_logs"
+}
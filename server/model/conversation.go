@@ -7,15 +7,45 @@ import (
 )
 
 type Conversation struct {
-	ID        uint           `json:"id" gorm:"primary_key"`
-	CreatedAt time.Time      `json:"created_at" gorm:"autoCreateTime"`
-	UpdatedAt time.Time      `json:"updated_at" gorm:"autoUpdateTime"`
-	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
-	Title     string         `json:"title"`
-	UserID    uint           `json:"user_id" gorm:"index"`
-	LastMsg   string         `json:"last_msg"`
-	LastMsgAt *time.Time     `json:"last_msg_at" gorm:"default:null"`
-	Messages  []Message      `json:"messages" gorm:"foreignKey:ConversationID"`
+	ID             uint                 `json:"id" gorm:"primary_key"`
+	CreatedAt      time.Time            `json:"created_at" gorm:"autoCreateTime"`
+	UpdatedAt      time.Time            `json:"updated_at" gorm:"autoUpdateTime"`
+	DeletedAt      gorm.DeletedAt       `gorm:"index" json:"-"`
+	Title          string               `json:"title"`
+	UserID         uint                 `json:"user_id" gorm:"index"`
+	LastMsg        string               `json:"last_msg"`
+	LastMsgAt      *time.Time           `json:"last_msg_at" gorm:"default:null"`
+	Settings       ConversationSettings `json:"settings" gorm:"embedded"`
+	Summary        string               `json:"summary" gorm:"type:text"`          // 早期对话的滚动摘要
+	SummaryUntilID uint                 `json:"summary_until_id" gorm:"default:0"` // 摘要已覆盖到的最后一条消息ID
+	FenceToken     int64                `json:"-" gorm:"default:0"`                // 最近一次保存回复时持有的会话锁令牌，拒绝锁过期后的旧写入
+	LockToken      int64                `json:"-" gorm:"default:0"`                // 最近一次取得会话锁的令牌
+	LockExpiresAt  *time.Time           `json:"-" gorm:"default:null"`             // 会话锁租约的过期时间，释放后为空
+	Messages       []Message            `json:"messages" gorm:"foreignKey:ConversationID"`
+}
+
+// DefaultSystemPrompt 未设置系统提示词时使用的默认值
+const DefaultSystemPrompt = "You are a helpful assistant."
+
+// ConversationSettings 会话级模型与参数设置，指针字段为空表示使用默认值
+type ConversationSettings struct {
+	Provider       string   `json:"provider" gorm:"size:32"`             // AI提供方，为空时使用全局默认
+	Model          string   `json:"model" gorm:"size:64"`                // 模型，为空时使用提供方默认模型
+	Temperature    *float64 `json:"temperature" gorm:"default:null"`     // 采样温度
+	TopP           *float64 `json:"top_p" gorm:"default:null"`           // 核采样概率
+	MaxTokens      *int     `json:"max_tokens" gorm:"default:null"`      // 最大输出token数
+	SystemPrompt   string   `json:"system_prompt" gorm:"type:text"`      // 系统提示词
+	EnableSearch   *bool    `json:"enable_search" gorm:"default:null"`   // 是否开启联网搜索，默认开启
+	EnableThinking *bool    `json:"enable_thinking" gorm:"default:null"` // 是否默认开启深度思考
+	Fallbacks      string   `json:"fallbacks" gorm:"size:512"`           // 降级链，格式为 provider:model,provider:model，为空时使用全局配置
+}
+
+// SystemPromptOrDefault 返回生效的系统提示词
+func (s ConversationSettings) SystemPromptOrDefault() string {
+	if s.SystemPrompt == "" {
+		return DefaultSystemPrompt
+	}
+	return s.SystemPrompt
 }
 
 func (Conversation) TableName() string {
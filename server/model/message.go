@@ -30,17 +30,28 @@ const (
 
 // Message 消息模型结构体
 type Message struct {
-	ID               uint           `gorm:"primary_key" json:"id"`               // 消息ID，主键
-	CreatedAt        time.Time      `json:"created_at"`                             // 创建时间
-	UpdatedAt        time.Time      `json:"updated_at"`                             // 更新时间
-	DeletedAt        gorm.DeletedAt `gorm:"index" json:"-"`                        // 软删除时间，不在JSON中返回
-	Content          string         `json:"content" gorm:"type:text;not null"`     // 消息内容，文本类型，非空
+	ID               uint           `gorm:"primary_key" json:"id"`                       // 消息ID，主键
+	CreatedAt        time.Time      `json:"created_at"`                                  // 创建时间
+	UpdatedAt        time.Time      `json:"updated_at"`                                  // 更新时间
+	DeletedAt        gorm.DeletedAt `gorm:"index" json:"-"`                              // 软删除时间，不在JSON中返回
+	Content          string         `json:"content" gorm:"type:text;not null"`           // 消息内容，文本类型，非空
 	ReasoningContent string         `json:"reasoning_content" gorm:"type:text;not null"` // AI推理内容，文本类型，非空
-	Type             MessageType    `gorm:"default:1" json:"type"`                 // 消息类型，默认文本
-	MessageRole      MessageRole    `gorm:"default:1" json:"message_role"`         // 消息角色，默认AI消息
-	UserID           uint           `json:"user_id"`                                // 用户ID
-	ConversationID   uint           `json:"conversation_id" gorm:"index"`          // 对话ID，索引
-	Conversation     *Conversation  `json:"conversation"`                          // 关联的对话对象
+	Type             MessageType    `gorm:"default:1" json:"type"`                       // 消息类型，默认文本
+	MessageRole      MessageRole    `gorm:"default:1" json:"message_role"`               // 消息角色，默认AI消息
+	UserID           uint           `json:"user_id" gorm:"index"`                        // 用户ID，索引
+	ConversationID   uint           `json:"conversation_id" gorm:"index"`                // 对话ID，索引
+	Conversation     *Conversation  `json:"conversation"`                                // 关联的对话对象
+	Provider         string         `json:"provider" gorm:"size:32"`                     // 实际回答的AI提供方，仅AI消息
+	Model            string         `json:"model" gorm:"size:64"`                        // 实际回答的模型，仅AI消息
+	PromptTokens     int            `json:"prompt_tokens"`                               // 输入token数
+	CompletionTokens int            `json:"completion_tokens"`                           // 输出token数
+	TotalTokens      int            `json:"total_tokens"`                                // 总token数
+	LatencyMs        int64          `json:"latency_ms"`                                  // 生成耗时（毫秒）
+	Cost             float64        `json:"cost" gorm:"type:decimal(12,6)"`              // 按模型单价计算的费用
+	Interrupted      bool           `json:"interrupted" gorm:"default:false"`            // 生成被停止或中断，内容不完整
+	ParentID         uint           `json:"parent_id" gorm:"index;default:0"`            // 父消息ID，指向上一条消息，会话的第一条消息为0
+	Inactive         bool           `json:"inactive" gorm:"default:false"`               // 非当前分支（被编辑或重新生成替换的版本）
+	SourceID         uint           `json:"source_id" gorm:"default:0"`                  // 分叉会话时复制来源的消息ID，复制的消息不计入用量
 }
 
 // TableName 指定表名
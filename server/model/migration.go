@@ -0,0 +1,47 @@
+package model
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SchemaMigration 已执行的一次性数据迁移记录
+type SchemaMigration struct {
+	Name      string    `json:"name" gorm:"primary_key;size:128"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// ApplyMigration 执行一次性数据迁移，已执行过的迁移直接跳过
+func ApplyMigration(db *gorm.DB, name string, migrate func(tx *gorm.DB) error) error {
+	var applied SchemaMigration
+	err := db.Where("name = ?", name).First(&applied).Error
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := migrate(tx); err != nil {
+			return err
+		}
+		return tx.Create(&SchemaMigration{Name: name, AppliedAt: time.Now()}).Error
+	})
+}
+
+// BackfillMessageParents 为启用消息树之前的消息补全 parent_id，指向同一会话中紧邻的上一条消息
+func BackfillMessageParents(tx *gorm.DB) error {
+	return tx.Exec(`UPDATE messages m JOIN (
+		SELECT c.id, (SELECT MAX(p.id) FROM messages p WHERE p.conversation_id = c.conversation_id AND p.id < c.id) AS pid
+		FROM messages c WHERE c.parent_id = 0
+	) t ON t.id = m.id
+	SET m.parent_id = t.pid
+	WHERE t.pid IS NOT NULL`).Error
+}
@@ -0,0 +1,21 @@
+package model
+
+import "time"
+
+// UserQuota 用户额度配置
+// Plan 指定所属套餐，限额字段不为空时覆盖套餐的默认值，0 表示不限
+type UserQuota struct {
+	ID                  uint      `json:"id" gorm:"primary_key"`
+	CreatedAt           time.Time `json:"created_at"`
+	UpdatedAt           time.Time `json:"updated_at"`
+	UserID              uint      `json:"user_id" gorm:"uniqueIndex"`
+	Plan                string    `json:"plan" gorm:"size:32"`
+	DailyTokenLimit     *int64    `json:"daily_token_limit" gorm:"default:null"`
+	MonthlyTokenLimit   *int64    `json:"monthly_token_limit" gorm:"default:null"`
+	DailyRequestLimit   *int64    `json:"daily_request_limit" gorm:"default:null"`
+	MonthlyRequestLimit *int64    `json:"monthly_request_limit" gorm:"default:null"`
+}
+
+func (UserQuota) TableName() string {
+	return "user_quotas"
+}
@@ -0,0 +1,22 @@
+package model
+
+import "time"
+
+// RefreshToken 刷新令牌，只保存令牌的SHA-256摘要
+// 每次刷新都会换发新令牌并标记旧令牌已使用，同一次登录换发出的令牌属于同一个 FamilyID；
+// 已使用的令牌再次出现视为泄露，整个家族作废
+type RefreshToken struct {
+	ID        uint       `json:"id" gorm:"primary_key"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	UserID    uint       `json:"user_id" gorm:"index"`
+	FamilyID  string     `json:"family_id" gorm:"size:64;index"`
+	TokenHash string     `json:"-" gorm:"size:64;uniqueIndex"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at" gorm:"default:null"`    // 已换发新令牌的时间
+	RevokedAt *time.Time `json:"revoked_at" gorm:"default:null"` // 退出登录或检测到重用而作废的时间
+}
+
+func (RefreshToken) TableName() string {
+	return "refresh_tokens"
+}
@@ -0,0 +1,28 @@
+package model
+
+import "time"
+
+// UsageRecord 不对应消息的模型调用（如会话摘要）的用量，与AI消息一起计入用量统计和token额度
+type UsageRecord struct {
+	ID               uint      `json:"id" gorm:"primary_key"`
+	CreatedAt        time.Time `json:"created_at" gorm:"index"`
+	UserID           uint      `json:"user_id" gorm:"index"`
+	ConversationID   uint      `json:"conversation_id" gorm:"index"`
+	Kind             string    `json:"kind" gorm:"size:32"` // 调用用途
+	Provider         string    `json:"provider" gorm:"size:32"`
+	Model            string    `json:"model" gorm:"size:64"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	TotalTokens      int       `json:"total_tokens"`
+	LatencyMs        int64     `json:"latency_ms"`
+	Cost             float64   `json:"cost" gorm:"type:decimal(12,6)"`
+}
+
+// 调用用途
+const (
+	UsageKindSummary = "summary" // 会话滚动摘要
+)
+
+func (UsageRecord) TableName() string {
+	return "usage_records"
+}
@@ -3,17 +3,25 @@ package model
 import "gorm.io/gorm"
 
 type User struct {
-	ID        uint           `gorm:"primaryKey" json:"id"`
-	CreatedAt int64          `json:"created_at"`
-	UpdatedAt int64          `json:"updated_at"`
-	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
-	Username  string         `gorm:"uniqueIndex;size:64;not null" json:"username"`
-	Password  string         `gorm:"size:128;not null" json:"-"`
-	Email     string         `gorm:"uniqueIndex;size:128;not null" json:"email"`
-	Nickname  string         `gorm:"size:64" json:"nickname"`
-	Avatar    string         `gorm:"size:256" json:"avatar"`
+	ID              uint           `gorm:"primaryKey" json:"id"`
+	CreatedAt       int64          `json:"created_at"`
+	UpdatedAt       int64          `json:"updated_at"`
+	DeletedAt       gorm.DeletedAt `gorm:"index" json:"-"`
+	Username        string         `gorm:"uniqueIndex;size:64;not null" json:"username"`
+	Password        string         `gorm:"size:128;not null" json:"-"`
+	Email           string         `gorm:"uniqueIndex;size:128;not null" json:"email"`
+	EmailVerifiedAt int64          `gorm:"default:0" json:"email_verified_at"` // 邮箱验证时间（秒级时间戳），0为未验证
+	Nickname        string         `gorm:"size:64" json:"nickname"`
+	Avatar          string         `gorm:"size:256" json:"avatar"`
+	Role            string         `gorm:"size:16;not null;default:user" json:"role"` // 角色，管理员须在数据库中手动设置为 admin
 }
 
+// 用户角色
+const (
+	UserRoleUser  = "user"  // 普通用户
+	UserRoleAdmin = "admin" // 管理员，可访问诊断等管理接口
+)
+
 func (User) TableName() string {
 	return "users"
 }
@@ -0,0 +1,22 @@
+package model
+
+import "time"
+
+// UserSession 登录会话，每次登录创建一条，对应一个刷新令牌家族
+// 刷新访问令牌时更新最近活跃时间和IP；退出登录或在其他设备上移除后 RevokedAt 不为空
+type UserSession struct {
+	ID         uint       `json:"id" gorm:"primary_key"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	UserID     uint       `json:"user_id" gorm:"index"`
+	FamilyID   string     `json:"-" gorm:"size:64;uniqueIndex"`
+	UserAgent  string     `json:"user_agent" gorm:"size:512"`
+	IP         string     `json:"ip" gorm:"size:64"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"` // 最新一个刷新令牌的过期时间，之后需要重新登录
+	RevokedAt  *time.Time `json:"revoked_at" gorm:"default:null"`
+}
+
+func (UserSession) TableName() string {
+	return "user_sessions"
+}
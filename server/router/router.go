@@ -1,10 +1,13 @@
 package router
 
 import (
+	"log"
 	"os"
 	"server/config"
 	"server/controller"
 	"server/middleware"
+	"server/services"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -14,25 +17,50 @@ import (
 func SetupRouter() *gin.Engine {
 	r := gin.Default()
 
+	// 只信任 TRUSTED_PROXIES 中的代理转发的 X-Forwarded-For / X-Real-IP，未配置时不信任任何代理，
+	// ClientIP 即为连接的对端地址；否则客户端可伪造请求头绕过按IP的限流和登录防护
+	if err := r.SetTrustedProxies(trustedProxies()); err != nil {
+		log.Fatalf("TRUSTED_PROXIES 配置错误：%v", err)
+	}
+
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{os.Getenv("FRONT_URL")}, // 前端地址
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "cache-control"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "cache-control", "Idempotency-Key", "Last-Event-ID"},
+		ExposeHeaders:    []string{"Content-Length", "Retry-After", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Idempotent-Replayed"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
 
-	authCtrl := controller.AuthController{DB: config.DB}
-	conversationCtrl := controller.ConversationController{DB: config.DB}
+	mailer, err := services.NewMailer()
+	if err != nil {
+		log.Fatalf("邮件配置错误：%v", err)
+	}
+
+	authCtrl := controller.AuthController{DB: config.DB, RDB: config.RDB, Mailer: mailer}
+	conversationCtrl := controller.ConversationController{DB: config.DB, RDB: config.RDB}
 	messageCtrl := controller.MessageController{DB: config.DB, RDB: config.RDB}
+	usageCtrl := controller.UsageController{DB: config.DB}
+	quotaCtrl := controller.QuotaController{DB: config.DB, RDB: config.RDB}
+	wsCtrl := controller.WSController{DB: config.DB, RDB: config.RDB}
+	diagnosticsCtrl := controller.DiagnosticsController{}
 
-	apiGroup := r.Group("/api")
+	// 限流规则统一在 middleware.RateLimit 中配置，按规则名引用
+	apiGroup := r.Group("/api", middleware.RateLimit("default"))
 	{
 		auth := apiGroup.Group("/auth")
 		{
-			auth.POST("/register", authCtrl.Register)
-			auth.POST("/login", authCtrl.Login)
+			auth.POST("/register", middleware.RateLimit("register"), authCtrl.Register)
+			auth.POST("/login", middleware.RateLimit("login"), authCtrl.Login)
+			auth.POST("/refresh", middleware.RateLimit("refresh"), authCtrl.Refresh)
+			auth.POST("/logout", authCtrl.Logout)
+			auth.GET("/sessions", middleware.JWTAuth(), authCtrl.ListSessions)
+			auth.DELETE("/sessions/:id", middleware.JWTAuth(), authCtrl.RevokeSession)
+			auth.POST("/unlock", middleware.JWTAuth(), authCtrl.Unlock)
+			auth.POST("/verify-email/send", middleware.RateLimit("mail"), authCtrl.SendVerificationEmail)
+			auth.POST("/verify-email", authCtrl.VerifyEmail)
+			auth.POST("/password/forgot", middleware.RateLimit("mail"), authCtrl.ForgotPassword)
+			auth.POST("/password/reset", middleware.RateLimit("login"), authCtrl.ResetPassword)
 		}
 
 		conversation := apiGroup.Group("/conversation")
@@ -40,16 +68,55 @@ func SetupRouter() *gin.Engine {
 			conversation.POST("/create", middleware.JWTAuth(), conversationCtrl.CreateConversation)
 			conversation.GET("/list", middleware.JWTAuth(), conversationCtrl.GetConversations)
 			conversation.DELETE("/delete/:conversation_id", middleware.JWTAuth(), conversationCtrl.DeleteConversation)
+			conversation.GET("/settings/:conversation_id", middleware.JWTAuth(), conversationCtrl.GetSettings)
+			conversation.PUT("/settings/:conversation_id", middleware.JWTAuth(), conversationCtrl.UpdateSettings)
+			conversation.POST("/fork", middleware.JWTAuth(), conversationCtrl.ForkConversation)
 		}
 
 		message := apiGroup.Group("/message")
 		{
-			message.POST("/send", middleware.JWTAuth(), messageCtrl.SendMessage)
+			message.POST("/send", middleware.JWTAuth(), middleware.RateLimit("send"), messageCtrl.SendMessage)
 			message.GET("/list", middleware.JWTAuth(), messageCtrl.GetMessageList)
 			message.DELETE("/delete/:message_id", middleware.JWTAuth(), messageCtrl.DeleteMessage)
-			message.POST("/stream", middleware.JWTAuth(), messageCtrl.SendMessageStream)
+			message.POST("/stream", middleware.JWTAuth(), middleware.RateLimit("stream"), messageCtrl.SendMessageStream)
+			message.POST("/generate", middleware.JWTAuth(), middleware.RateLimit("stream"), messageCtrl.GenerateMessage)
+			message.POST("/stop", middleware.JWTAuth(), messageCtrl.StopMessageStream)
+			message.POST("/regenerate", middleware.JWTAuth(), middleware.RateLimit("stream"), messageCtrl.RegenerateMessage)
+			message.GET("/versions/:message_id", middleware.JWTAuth(), messageCtrl.GetMessageVersions)
+			message.POST("/versions/select", middleware.JWTAuth(), messageCtrl.SelectMessageVersion)
+			message.POST("/edit", middleware.JWTAuth(), middleware.RateLimit("stream"), messageCtrl.EditMessage)
+			message.GET("/branches", middleware.JWTAuth(), messageCtrl.GetBranches)
+			message.GET("/stream/:generation_id", middleware.JWTAuth(), messageCtrl.ResumeMessageStream)
+		}
+
+		usage := apiGroup.Group("/usage")
+		{
+			usage.GET("/summary", middleware.JWTAuth(), usageCtrl.GetUsageSummary)
+			usage.GET("/conversations", middleware.JWTAuth(), usageCtrl.GetConversationUsageList)
+			usage.GET("/conversation/:conversation_id", middleware.JWTAuth(), usageCtrl.GetConversationUsage)
+		}
+
+		apiGroup.GET("/quota", middleware.JWTAuth(), quotaCtrl.GetQuota)
+
+		// WebSocket：send / stop / regenerate 及生成事件，与SSE接口共用生成流程
+		apiGroup.GET("/ws", middleware.JWTAuth(), wsCtrl.ServeWS)
+
+		diagnostics := apiGroup.Group("/diagnostics")
+		{
+			diagnostics.GET("/breakers", middleware.JWTAuth(), middleware.RequireAdmin(), diagnosticsCtrl.GetBreakers)
 		}
 	}
 
 	return r
 }
+
+// trustedProxies 读取 TRUSTED_PROXIES（逗号分隔的IP或CIDR），未配置时返回 nil
+func trustedProxies() []string {
+	var proxies []string
+	for _, item := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			proxies = append(proxies, item)
+		}
+	}
+	return proxies
+}
@@ -3,116 +3,180 @@
 package services
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"io"
+	"context"
 	"log"
-	"net/http"
-	"os"
 	"time"
 
-	"server/dto" // 数据传输对象，定义请求和响应结构
+	"server/dto"   // 数据传输对象，定义请求和响应结构
+	"server/model" // 模型包，包含会话设置定义
 )
 
 /**
  * GetAIResponse 获取AI响应
- * 1. 检查环境变量配置
- * 2. 创建HTTP客户端
- * 3. 构建请求体
- * 4. 发送HTTP请求到AI API
- * 5. 处理响应
- * 6. 解析AI回复
- * 7. 返回AI回复内容
+ * 按主模型、降级链的顺序依次尝试，某个模型不可用（限流、5xx、超时、熔断）时自动切换到下一个，
+ * 返回结果中的 Provider/Model 为实际回答的模型
  */
-func GetAIResponse(content string) (string, error) {
-	// 添加短暂延迟，模拟处理时间
-	time.Sleep(500 * time.Millisecond)
+func GetAIResponse(ctx context.Context, req *ChatRequest) (*ChatResponse, error) {
+	var lastErr error
+	for i, candidate := range candidates(req) {
+		if i > 0 {
+			log.Printf("AI请求降级：provider=%s, model=%s, 上一次错误：%v", candidate.Provider, candidate.Model, lastErr)
+		}
+		resp, err := completeWith(ctx, candidate)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+		if !shouldFallback(ctx, err) {
+			break
+		}
+	}
+	return nil, lastErr
+}
 
-	// 获取环境变量配置
-	aiModel := os.Getenv("AI_MODEL")
-	if aiModel == "" {
-		return "", fmt.Errorf("AI_MODEL 环境变量未设置")
+/**
+ * completeWith 使用单个模型获取AI响应
+ * 1. 根据请求选择提供方
+ * 2. 补全默认模型
+ * 3. 按模型上下文窗口裁剪历史消息
+ * 4. 检查提供方熔断状态，在 AI_REQUEST_TIMEOUT_MS 内阻塞式调用提供方获取完整回复
+ * 5. 记录耗时，补全用量和费用
+ */
+func completeWith(ctx context.Context, req *ChatRequest) (*ChatResponse, error) {
+	p, resolved, err := resolve(req)
+	if err != nil {
+		return nil, err
 	}
-	aiApiKey := os.Getenv("AI_API_KEY")
-	if aiApiKey == "" {
-		return "", fmt.Errorf("AI_API_KEY 环境变量未设置")
+	trim := applyContextBudget(resolved)
+
+	breaker := breakerFor(p.Name())
+	if err := breaker.Allow(); err != nil {
+		return nil, err
 	}
-	aiApiUrl := os.Getenv("AI_API_URL")
-	if aiApiUrl == "" {
-		return "", fmt.Errorf("AI_API_URL 环境变量未设置")
+	ctx, cancel := withRequestTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := p.Complete(ctx, resolved)
+	breaker.Record(err)
+	if err != nil {
+		return nil, err
 	}
-	
-	// 创建 HTTP 客户端
-	client := &http.Client{}
-	
-	// 构建请求体
-	requestBody := dto.RequestBody{
-		Model: aiModel,
-		Messages: []dto.Message{
-			{
-				Role:    "system",
-				Content: "You are a helpful assistant.", // 系统提示，定义AI角色
-			},
-			{
-				Role:    "user",
-				Content: content, // 用户输入内容
-			},
-		},
+	resp.Trim = trim
+	resp.LatencyMs = time.Since(start).Milliseconds()
+	fillUsage(resolved, resp)
+	return resp, nil
+}
+
+/**
+ * StreamAIResponse 流式获取AI响应
+ * 与 GetAIResponse 相同的降级顺序，只在尚未输出任何内容时切换模型，已开始输出后出错直接返回部分回复
+ */
+func StreamAIResponse(ctx context.Context, req *ChatRequest, onDelta DeltaHandler) (*ChatResponse, error) {
+	started := false
+	tracked := func(delta StreamDelta) error {
+		if delta.Content != "" || delta.ReasoningContent != "" {
+			started = true
+		}
+		return onDelta(delta)
 	}
-	
-	// 序列化请求体为JSON
-	jsonData, err := json.Marshal(requestBody)
-	if err != nil {
-		log.Printf("JSON序列化失败：%v", err)
-		return "", err
+
+	var lastResp *ChatResponse
+	var lastErr error
+	for i, candidate := range candidates(req) {
+		if i > 0 {
+			log.Printf("AI流式请求降级：provider=%s, model=%s, 上一次错误：%v", candidate.Provider, candidate.Model, lastErr)
+		}
+		resp, err := streamWith(ctx, candidate, tracked)
+		if err == nil || started || !shouldFallback(ctx, err) {
+			return resp, err
+		}
+		lastResp, lastErr = resp, err
 	}
-	
-	// 创建 POST 请求
-	req, err := http.NewRequest("POST", aiApiUrl, bytes.NewBuffer(jsonData))
+	return lastResp, lastErr
+}
+
+/**
+ * streamWith 使用单个模型流式获取AI响应
+ * 分片通过 onDelta 回调推送，发生裁剪时先推送一次带 Trim 的分片；中途出错时返回的部分回复同样带有用量和耗时。
+ * 整体耗时受 AI_STREAM_TIMEOUT_MS 限制，结果计入提供方熔断器
+ */
+func streamWith(ctx context.Context, req *ChatRequest, onDelta DeltaHandler) (*ChatResponse, error) {
+	p, resolved, err := resolve(req)
 	if err != nil {
-		log.Printf("创建HTTP请求失败：%v", err)
-		return "", err
+		return nil, err
 	}
-	
-	// 设置请求头
-	// 若没有配置环境变量，请用阿里云百炼API Key将下行替换为：apiKey := "sk-xxx"
-	// 新加坡和北京地域的API Key不同。获取API Key：https://help.aliyun.com/model-studio/get-api-key
-	req.Header.Set("Authorization", "Bearer "+aiApiKey) // 认证头
-	req.Header.Set("Content-Type", "application/json") // 内容类型
-	
-	// 发送请求
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("发送HTTP请求失败：%v", err)
-		return "", err
+	trim := applyContextBudget(resolved)
+
+	breaker := breakerFor(p.Name())
+	if err := breaker.Allow(); err != nil {
+		return nil, err
+	}
+	if trim != nil {
+		if err := onDelta(StreamDelta{Trim: trim}); err != nil {
+			breaker.Record(err)
+			return nil, err
+		}
 	}
-	defer resp.Body.Close() // 延迟关闭响应体
+	ctx, cancel := withStreamTimeout(ctx)
+	defer cancel()
 
-	// 检查响应状态码
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("请求失败：%s", resp.Status)
-		return "", fmt.Errorf("请求失败：%s", resp.Status)
+	start := time.Now()
+	resp, err := p.Stream(ctx, resolved, onDelta)
+	breaker.Record(err)
+	if resp != nil {
+		resp.Trim = trim
+		resp.LatencyMs = time.Since(start).Milliseconds()
+		fillUsage(resolved, resp)
 	}
+	return resp, err
+}
 
-	// 读取响应体
-	bodyText, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("读取响应体失败：%v", err)
-		return "", err
+/**
+ * BuildChatRequest 根据会话设置构建AI请求
+ * 1. 使用会话配置的提供方、模型和采样参数
+ * 2. 将上下文中的system消息替换为会话当前的系统提示词
+ * 3. 未设置联网搜索时默认开启
+ * 4. 会话配置了降级链时优先于全局 AI_FALLBACKS
+ */
+func BuildChatRequest(settings model.ConversationSettings, messages []dto.Message) *ChatRequest {
+	var fallbacks []ModelTarget
+	if settings.Fallbacks != "" {
+		targets, err := ParseModelTargets(settings.Fallbacks)
+		if err != nil {
+			log.Printf("会话降级链配置错误，使用全局配置：%v", err)
+		} else {
+			fallbacks = targets
+		}
+	}
+	enableSearch := true
+	if settings.EnableSearch != nil {
+		enableSearch = *settings.EnableSearch
+	}
+	enableThinking := false
+	if settings.EnableThinking != nil {
+		enableThinking = *settings.EnableThinking
 	}
-	
-	// 打印响应内容（调试用）
-	fmt.Printf("%s\n", bodyText)
 
-	// 解析响应内容
-	var qwenResp dto.QwenResponse
-	if err := json.Unmarshal(bodyText, &qwenResp); err != nil {
-		log.Printf("解析响应体失败：%v", err)
-		return "", err
+	return &ChatRequest{
+		Provider:       settings.Provider,
+		Model:          settings.Model,
+		Messages:       withSystemPrompt(messages, settings.SystemPromptOrDefault()),
+		EnableThinking: enableThinking,
+		EnableSearch:   enableSearch,
+		Temperature:    settings.Temperature,
+		TopP:           settings.TopP,
+		MaxTokens:      settings.MaxTokens,
+		Fallbacks:      fallbacks,
 	}
+}
 
-	// 提取AI回复内容
-	aiReply := qwenResp.Choices[0].Message.Content
-	return aiReply, nil
+// withSystemPrompt 返回替换（或补充）了首条system消息的上下文副本
+func withSystemPrompt(messages []dto.Message, prompt string) []dto.Message {
+	result := make([]dto.Message, 0, len(messages)+1)
+	if len(messages) > 0 && messages[0].Role == "system" {
+		messages = messages[1:]
+	}
+	result = append(result, dto.Message{Role: "system", Content: prompt})
+	return append(result, messages...)
 }
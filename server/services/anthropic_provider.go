@@ -0,0 +1,186 @@
+// services 包
+// Anthropic Messages API 风格提供方
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"server/dto" // 数据传输对象，定义请求和响应结构
+)
+
+// AnthropicProvider Anthropic 风格接口提供方
+type AnthropicProvider struct {
+	apiURL         string
+	apiKey         string
+	model          string
+	maxTokens      int
+	thinkingBudget int
+	client         *http.Client
+}
+
+// NewAnthropicProvider 从 ANTHROPIC_* 环境变量创建提供方
+func NewAnthropicProvider() *AnthropicProvider {
+	return &AnthropicProvider{
+		apiURL:         envOrDefault("ANTHROPIC_API_URL", "https://api.anthropic.com/v1/messages"),
+		apiKey:         os.Getenv("ANTHROPIC_API_KEY"),
+		model:          os.Getenv("ANTHROPIC_MODEL"),
+		maxTokens:      envInt("ANTHROPIC_MAX_TOKENS", 4096),
+		thinkingBudget: envInt("ANTHROPIC_THINKING_BUDGET", 2048),
+		client:         defaultHTTPClient(),
+	}
+}
+
+func (p *AnthropicProvider) Name() string {
+	return "anthropic"
+}
+
+func (p *AnthropicProvider) DefaultModel() string {
+	return p.model
+}
+
+func (p *AnthropicProvider) buildBody(req *ChatRequest, stream bool) dto.AnthropicRequest {
+	// Anthropic 的系统提示词是独立字段，不放在 messages 中
+	var systemParts []string
+	messages := make([]dto.Message, 0, len(req.Messages))
+	for _, msg := range req.Messages {
+		if msg.Role == "system" {
+			systemParts = append(systemParts, msg.Content)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+
+	body := dto.AnthropicRequest{
+		Model:       req.Model,
+		System:      strings.Join(systemParts, "\n\n"),
+		Messages:    messages,
+		MaxTokens:   p.maxTokens,
+		Stream:      stream,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+	}
+	if req.MaxTokens != nil {
+		body.MaxTokens = *req.MaxTokens
+	}
+	if req.EnableThinking && p.thinkingBudget < body.MaxTokens {
+		body.Thinking = &dto.AnthropicThinking{Type: "enabled", BudgetTokens: p.thinkingBudget}
+	}
+	return body
+}
+
+func (p *AnthropicProvider) headers() map[string]string {
+	return map[string]string{
+		"x-api-key":         p.apiKey,
+		"anthropic-version": "2023-06-01",
+	}
+}
+
+func (p *AnthropicProvider) Complete(ctx context.Context, req *ChatRequest) (*ChatResponse, error) {
+	if p.apiKey == "" {
+		return nil, fmt.Errorf("ANTHROPIC_API_KEY 环境变量未设置")
+	}
+
+	resp, err := postJSON(ctx, p.Name(), p.client, p.apiURL, p.headers(), p.buildBody(req, false))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var anthropicResp dto.AnthropicResponse
+	if err := json.NewDecoder(resp.Body).Decode(&anthropicResp); err != nil {
+		log.Printf("解析响应体失败：%v", err)
+		return nil, err
+	}
+
+	result := &ChatResponse{
+		Provider:     p.Name(),
+		Model:        req.Model,
+		FinishReason: anthropicResp.StopReason,
+		Usage: dto.UsageItem{
+			PromptTokens:     anthropicResp.Usage.InputTokens,
+			CompletionTokens: anthropicResp.Usage.OutputTokens,
+			TotalTokens:      anthropicResp.Usage.InputTokens + anthropicResp.Usage.OutputTokens,
+		},
+	}
+	for _, block := range anthropicResp.Content {
+		switch block.Type {
+		case "text":
+			result.Content += block.Text
+		case "thinking":
+			result.ReasoningContent += block.Thinking
+		}
+	}
+	return result, nil
+}
+
+func (p *AnthropicProvider) Stream(ctx context.Context, req *ChatRequest, onDelta DeltaHandler) (*ChatResponse, error) {
+	if p.apiKey == "" {
+		return nil, fmt.Errorf("ANTHROPIC_API_KEY 环境变量未设置")
+	}
+
+	resp, err := postJSON(ctx, p.Name(), p.client, p.apiURL, p.headers(), p.buildBody(req, true))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &ChatResponse{Provider: p.Name(), Model: req.Model}
+	contentBuffer := new(strings.Builder)
+	reasoningContentBuffer := new(strings.Builder)
+
+	err = scanSSE(resp.Body, func(_ string, dataStr string) error {
+		var event dto.AnthropicStreamEvent
+		if err := json.Unmarshal([]byte(dataStr), &event); err != nil {
+			log.Printf("解析AI分片失败：%v, 数据：%s", err, dataStr)
+			return nil
+		}
+
+		switch event.Type {
+		case "message_start":
+			if event.Message != nil {
+				result.Usage.PromptTokens = event.Message.Usage.InputTokens
+			}
+		case "content_block_delta":
+			delta := StreamDelta{}
+			switch event.Delta.Type {
+			case "text_delta":
+				delta.Content = event.Delta.Text
+			case "thinking_delta":
+				delta.ReasoningContent = event.Delta.Thinking
+			default:
+				return nil
+			}
+			contentBuffer.WriteString(delta.Content)
+			reasoningContentBuffer.WriteString(delta.ReasoningContent)
+			return onDelta(delta)
+		case "message_delta":
+			if event.Usage != nil {
+				result.Usage.CompletionTokens = event.Usage.OutputTokens
+			}
+			if event.Delta.StopReason != "" {
+				result.FinishReason = event.Delta.StopReason
+				return onDelta(StreamDelta{FinishReason: event.Delta.StopReason})
+			}
+		case "error":
+			if event.Error != nil {
+				return fmt.Errorf("AI接口返回错误：%s", event.Error.Message)
+			}
+		}
+		return nil
+	})
+
+	result.Content = contentBuffer.String()
+	result.ReasoningContent = reasoningContentBuffer.String()
+	result.Usage.TotalTokens = result.Usage.PromptTokens + result.Usage.CompletionTokens
+	if err != nil {
+		log.Printf("读取AI流式响应失败：%v", err)
+		return result, err
+	}
+	return result, nil
+}
@@ -0,0 +1,150 @@
+// services 包
+// 上下文窗口预算：按模型的token上限裁剪发送给模型的历史消息
+package services
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"server/dto"   // 数据传输对象，定义请求和响应结构
+	"server/utils" // 工具包，包含token估算
+)
+
+// TrimReport 上下文裁剪结果，通过流式事件告知前端
+type TrimReport = dto.TrimReport
+
+// ContextTokenLimit 模型的上下文窗口大小
+// 通过 MODEL_CONTEXT_LIMITS="qwen-plus:131072,llama3:8192" 按模型配置，未配置的模型使用 DEFAULT_CONTEXT_LIMIT
+func ContextTokenLimit(model string) int {
+	for _, item := range strings.Split(os.Getenv("MODEL_CONTEXT_LIMITS"), ",") {
+		name, limitStr, ok := strings.Cut(strings.TrimSpace(item), ":")
+		if !ok || name != model {
+			continue
+		}
+		if limit, err := strconv.Atoi(limitStr); err == nil && limit > 0 {
+			return limit
+		}
+		log.Printf("MODEL_CONTEXT_LIMITS 配置格式错误：%s", item)
+	}
+	return envInt("DEFAULT_CONTEXT_LIMIT", 32768)
+}
+
+// ValidateMaxTokens 校验会话设置的最大输出token数须小于模型的上下文窗口，否则没有余量容纳输入
+func ValidateMaxTokens(model string, maxTokens *int) error {
+	if maxTokens == nil {
+		return nil
+	}
+	if limit := ContextTokenLimit(model); *maxTokens >= limit {
+		return fmt.Errorf("max_tokens 须小于模型 %s 的上下文窗口（%d）", model, limit)
+	}
+	return nil
+}
+
+/**
+ * inputTokenBudget 扣除输出预留和安全余量后可用于输入的token数
+ * 1. 输出预留为会话的 max_tokens，未设置时为 CONTEXT_OUTPUT_RESERVE；预留不超过窗口的一半，
+ *    避免配置过大时预算为负，裁剪掉全部历史
+ * 2. token数由 utils.EstimateTokens 按字符估算，并非模型的分词结果，
+ *    因此再扣除 CONTEXT_SAFETY_MARGIN_PERCENT（默认10%）作为估算误差的余量
+ */
+func inputTokenBudget(req *ChatRequest) int {
+	limit := ContextTokenLimit(req.Model)
+	reserve := envInt("CONTEXT_OUTPUT_RESERVE", 2048)
+	if req.MaxTokens != nil {
+		reserve = *req.MaxTokens
+	}
+	if reserve > limit/2 {
+		log.Printf("输出预留超过上下文窗口的一半，按一半计算：model=%s, limit=%d, reserve=%d", req.Model, limit, reserve)
+		reserve = limit / 2
+	}
+	if reserve < 0 {
+		reserve = 0
+	}
+
+	margin := envInt("CONTEXT_SAFETY_MARGIN_PERCENT", 10)
+	if margin < 0 || margin >= 100 {
+		margin = 10
+	}
+	return (limit - reserve) * (100 - margin) / 100
+}
+
+// EstimateRequestTokens 预估一次请求的token用量，用于预占额度：按预算裁剪后的输入估算值加上设置的 max_tokens
+func EstimateRequestTokens(req *ChatRequest) int {
+	input := 0
+	for _, msg := range req.Messages {
+		input += utils.EstimateMessageTokens(msg.Role, msg.Content)
+	}
+	tokens := min(input, inputTokenBudget(req))
+	if req.MaxTokens != nil && *req.MaxTokens > 0 {
+		tokens += *req.MaxTokens
+	}
+	return tokens
+}
+
+// applyContextBudget 按请求模型的预算裁剪上下文，发生裁剪时返回报告
+func applyContextBudget(req *ChatRequest) *TrimReport {
+	messages, report := TrimMessages(req.Messages, inputTokenBudget(req))
+	if report == nil {
+		return nil
+	}
+	report.Model = req.Model
+	req.Messages = messages
+	log.Printf("上下文超出预算已裁剪：model=%s, limit=%d, tokens=%d->%d, dropped=%d",
+		report.Model, report.Limit, report.OriginalTokens, report.PromptTokens, report.DroppedMessages)
+	return report
+}
+
+/**
+ * TrimMessages 将上下文裁剪到token上限内
+ * 1. 始终保留开头的system消息（系统提示、摘要）和最后一条消息
+ * 2. 从最新的历史消息向前保留，直到放不下为止，更早的消息全部丢弃
+ * 3. 保证保留的历史以user消息开头，避免出现孤立的assistant回复
+ * 未超出上限时返回原上下文和nil
+ */
+func TrimMessages(messages []dto.Message, limit int) ([]dto.Message, *TrimReport) {
+	total := 0
+	costs := make([]int, len(messages))
+	for i, msg := range messages {
+		costs[i] = utils.EstimateMessageTokens(msg.Role, msg.Content)
+		total += costs[i]
+	}
+	if total <= limit || len(messages) == 0 {
+		return messages, nil
+	}
+
+	head := 0
+	for head < len(messages)-1 && messages[head].Role == "system" {
+		head++
+	}
+	last := len(messages) - 1
+
+	used := costs[last]
+	for i := 0; i < head; i++ {
+		used += costs[i]
+	}
+
+	start := last
+	for start > head && used+costs[start-1] <= limit {
+		start--
+		used += costs[start]
+	}
+	for start < last && messages[start].Role != "user" {
+		used -= costs[start]
+		start++
+	}
+
+	trimmed := make([]dto.Message, 0, head+last-start+1)
+	trimmed = append(trimmed, messages[:head]...)
+	trimmed = append(trimmed, messages[start:]...)
+
+	return trimmed, &TrimReport{
+		Limit:           limit,
+		OriginalTokens:  total,
+		PromptTokens:    used,
+		DroppedMessages: len(messages) - len(trimmed),
+		Overflow:        used > limit,
+	}
+}
@@ -0,0 +1,157 @@
+package services
+
+import (
+	"strings"
+	"testing"
+
+	"server/dto"
+	"server/utils"
+)
+
+func intPtr(v int) *int { return &v }
+
+func TestInputTokenBudget(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		req    ChatRequest
+		budget int
+	}{
+		{"默认预留和余量", nil, ChatRequest{Model: "m"}, (32768 - 2048) * 90 / 100},
+		{"按会话的 max_tokens 预留", nil, ChatRequest{Model: "m", MaxTokens: intPtr(4096)}, (32768 - 4096) * 90 / 100},
+		{"预留超过窗口一半时按一半计算", map[string]string{"MODEL_CONTEXT_LIMITS": "small:8192"}, ChatRequest{Model: "small", MaxTokens: intPtr(100000)}, 4096 * 90 / 100},
+		{"负数预留按0计算", nil, ChatRequest{Model: "m", MaxTokens: intPtr(-10)}, 32768 * 90 / 100},
+		{"关闭安全余量", map[string]string{"CONTEXT_SAFETY_MARGIN_PERCENT": "0"}, ChatRequest{Model: "m"}, 32768 - 2048},
+		{"无效的安全余量使用默认值", map[string]string{"CONTEXT_SAFETY_MARGIN_PERCENT": "100"}, ChatRequest{Model: "m"}, (32768 - 2048) * 90 / 100},
+		{"CONTEXT_OUTPUT_RESERVE 配置预留", map[string]string{"CONTEXT_OUTPUT_RESERVE": "1000"}, ChatRequest{Model: "m"}, (32768 - 1000) * 90 / 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			budget := inputTokenBudget(&tt.req)
+			if budget != tt.budget {
+				t.Errorf("inputTokenBudget = %d, want %d", budget, tt.budget)
+			}
+			if budget < 0 {
+				t.Errorf("预算不应为负：%d", budget)
+			}
+		})
+	}
+}
+
+func TestTrimMessages(t *testing.T) {
+	msg := func(role, content string) dto.Message { return dto.Message{Role: role, Content: content} }
+	cost := func(m dto.Message) int { return utils.EstimateMessageTokens(m.Role, m.Content) }
+	long := strings.Repeat("长", 100)
+
+	system := msg("system", "你是助手")
+	u1, a1 := msg("user", long), msg("assistant", long)
+	u2, a2 := msg("user", long), msg("assistant", long)
+	u3 := msg("user", "最新的问题")
+
+	tests := []struct {
+		name     string
+		messages []dto.Message
+		limit    int
+		want     []dto.Message
+		dropped  int
+		overflow bool
+	}{
+		{
+			name:     "未超出上限时不裁剪",
+			messages: []dto.Message{system, u1, a1, u3},
+			limit:    1000,
+			want:     []dto.Message{system, u1, a1, u3},
+		},
+		{
+			name:     "从最早的历史开始丢弃",
+			messages: []dto.Message{system, u1, a1, u2, a2, u3},
+			limit:    cost(system) + cost(u2) + cost(a2) + cost(u3),
+			want:     []dto.Message{system, u2, a2, u3},
+			dropped:  2,
+		},
+		{
+			name:     "保留的历史以user消息开头",
+			messages: []dto.Message{system, u1, a1, u2, a2, u3},
+			limit:    cost(system) + cost(a2) + cost(u3),
+			want:     []dto.Message{system, u3},
+			dropped:  4,
+		},
+		{
+			name:     "最后一条消息超出上限时仍保留并标记溢出",
+			messages: []dto.Message{system, u1, a1, msg("user", long)},
+			limit:    10,
+			want:     []dto.Message{system, msg("user", long)},
+			dropped:  2,
+			overflow: true,
+		},
+		{
+			name:     "空上下文",
+			messages: nil,
+			limit:    0,
+			want:     nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, report := TrimMessages(tt.messages, tt.limit)
+			if len(got) != len(tt.want) {
+				t.Fatalf("保留 %d 条消息，want %d：%v", len(got), len(tt.want), got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("第 %d 条消息 = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+			if tt.dropped == 0 {
+				if report != nil {
+					t.Errorf("未裁剪时应返回nil报告，got %+v", report)
+				}
+				return
+			}
+			if report == nil {
+				t.Fatal("裁剪后应返回报告")
+			}
+			if report.DroppedMessages != tt.dropped {
+				t.Errorf("DroppedMessages = %d, want %d", report.DroppedMessages, tt.dropped)
+			}
+			if report.Overflow != tt.overflow {
+				t.Errorf("Overflow = %v, want %v", report.Overflow, tt.overflow)
+			}
+			if !tt.overflow && report.PromptTokens > tt.limit {
+				t.Errorf("PromptTokens = %d 超出上限 %d", report.PromptTokens, tt.limit)
+			}
+		})
+	}
+}
+
+func TestEstimateRequestTokens(t *testing.T) {
+	messages := []dto.Message{{Role: "user", Content: strings.Repeat("字", 50)}}
+	input := utils.EstimateMessageTokens("user", messages[0].Content)
+
+	tests := []struct {
+		name string
+		req  ChatRequest
+		want int
+	}{
+		{"只有输入", ChatRequest{Model: "m", Messages: messages}, input},
+		{"加上 max_tokens", ChatRequest{Model: "m", Messages: messages, MaxTokens: intPtr(500)}, input + 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EstimateRequestTokens(&tt.req); got != tt.want {
+				t.Errorf("EstimateRequestTokens = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("输入不超过预算", func(t *testing.T) {
+		t.Setenv("MODEL_CONTEXT_LIMITS", "tiny:100")
+		req := ChatRequest{Model: "tiny", Messages: []dto.Message{{Role: "user", Content: strings.Repeat("字", 1000)}}}
+		if got, budget := EstimateRequestTokens(&req), inputTokenBudget(&req); got != budget {
+			t.Errorf("EstimateRequestTokens = %d, want %d", got, budget)
+		}
+	})
+}
@@ -0,0 +1,232 @@
+// services 包
+// 会话锁：同一会话同一时间只进行一次生成，避免并发发送互相覆盖上下文
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"server/model"
+
+	"github.com/redis/go-redis/v9" // Redis客户端
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// 会话锁：conversation_lock:{conversationID} -> 持有者的令牌
+	conversationLockKeyPrefix = "conversation_lock:%d"
+	// 令牌计数器：conversation_lock_token:{conversationID}，每次加锁递增，作为防护令牌（fencing token）
+	conversationLockTokenKeyPrefix = "conversation_lock_token:%d"
+)
+
+// ErrConversationBusy 会话正在生成回复
+var ErrConversationBusy = errors.New("会话正在生成回复，请稍后再试")
+
+// ErrLockLost 锁已过期并被其他请求取得，本次写入被拒绝
+var ErrLockLost = errors.New("会话已被其他请求占用，本次回复未保存")
+
+// ErrLockUnavailable 无法确认会话锁（数据库不可用），拒绝本次请求而不是放行
+var ErrLockUnavailable = errors.New("服务暂时不可用，请稍后再试")
+
+// 锁空闲时递增令牌并加锁，返回令牌；已被占用时返回0
+// ARGV[2] 为数据库中已发放的最大令牌，计数器丢失（如Redis被清空）或Redis不可用期间由数据库发放过令牌时从该值继续，保证令牌单调递增
+var acquireConversationLockScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+local token = redis.call("INCR", KEYS[2])
+if token <= tonumber(ARGV[2]) then
+	token = tonumber(ARGV[2]) + 1
+	redis.call("SET", KEYS[2], token)
+end
+redis.call("SET", KEYS[1], token, "PX", ARGV[1])
+return token
+`)
+
+// 仅当锁仍由自己持有时才释放
+var releaseConversationLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// ConversationLock 会话锁
+// 锁从保存用户消息前一直持有到AI回复保存完成（可能跨实例，由执行生成的worker释放），
+// 过期时间 CONVERSATION_LOCK_TTL_MS 默认略长于流式请求的整体超时，持有者异常退出时自动释放。
+// 会话行上的租约（lock_token、lock_expires_at）是锁的依据，在 SELECT ... FOR UPDATE 中判断和写入；
+// Redis锁在此之上用于快速判断和发放令牌，Redis不可用时只凭租约加锁，由数据库发放令牌。
+// 每次加锁得到递增的令牌，保存回复时以令牌更新 conversations.fence_token，
+// 锁过期后被其他请求取得时，旧生成的写入会被拒绝。
+type ConversationLock struct {
+	DB  *gorm.DB
+	RDB *redis.Client
+}
+
+// lockMode 拿不到锁时的处理方式：reject 立即返回会话忙（默认），queue 排队等待至 CONVERSATION_LOCK_WAIT_MS
+func lockMode() string {
+	if os.Getenv("CONVERSATION_LOCK_MODE") == "queue" {
+		return "queue"
+	}
+	return "reject"
+}
+
+func lockTTL() time.Duration {
+	if ms := envInt("CONVERSATION_LOCK_TTL_MS", 0); ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return streamTTL()
+}
+
+/**
+ * Acquire 获取会话锁，返回防护令牌
+ * reject 模式下会话忙时立即返回 ErrConversationBusy；queue 模式下轮询等待，超时后返回 ErrConversationBusy。
+ * 数据库不可用时返回 ErrLockUnavailable，不放行
+ */
+func (l *ConversationLock) Acquire(ctx context.Context, convID uint) (int64, error) {
+	wait := time.Duration(envInt("CONVERSATION_LOCK_WAIT_MS", 30000)) * time.Millisecond
+	deadline := time.Now().Add(wait)
+	for {
+		token, err := l.tryAcquire(ctx, convID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			log.Printf("获取会话锁失败：convID=%d, err=%v", convID, err)
+			return 0, ErrLockUnavailable
+		}
+		if token > 0 {
+			return token, nil
+		}
+		if lockMode() != "queue" || time.Now().After(deadline) {
+			return 0, ErrConversationBusy
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+/**
+ * tryAcquire 尝试加锁一次，会话忙时返回0
+ * 1. 锁定会话行，租约未过期时会话忙
+ * 2. 以数据库中已发放的最大令牌为下限取得Redis锁；Redis不可用时由数据库发放下一个令牌
+ * 3. 写入租约后提交，提交失败时释放已取得的Redis锁
+ */
+func (l *ConversationLock) tryAcquire(ctx context.Context, convID uint) (int64, error) {
+	key := fmt.Sprintf(conversationLockKeyPrefix, convID)
+	var token int64
+	redisLocked := false
+	err := l.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var conv model.Conversation
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id", "fence_token", "lock_token", "lock_expires_at").
+			Where("id = ?", convID).First(&conv).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		if conv.LockExpiresAt != nil && conv.LockExpiresAt.After(now) {
+			return nil
+		}
+		floor := max(conv.FenceToken, conv.LockToken)
+
+		keys := []string{key, fmt.Sprintf(conversationLockTokenKeyPrefix, convID)}
+		result, err := acquireConversationLockScript.Run(ctx, l.RDB, keys, lockTTL().Milliseconds(), floor).Int64()
+		switch {
+		case err != nil:
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("Redis会话锁不可用，使用数据库租约：convID=%d, err=%v", convID, err)
+			result = floor + 1
+		case result == 0:
+			return nil
+		default:
+			redisLocked = true
+		}
+
+		if err := tx.Model(&model.Conversation{}).Where("id = ?", convID).
+			Updates(map[string]interface{}{"lock_token": result, "lock_expires_at": now.Add(lockTTL())}).Error; err != nil {
+			return err
+		}
+		token = result
+		return nil
+	})
+	if err != nil {
+		if redisLocked {
+			l.releaseRedis(convID, token)
+		}
+		return 0, err
+	}
+	return token, nil
+}
+
+// Release 释放会话锁，锁已过期或已被其他请求取得时忽略
+func (l *ConversationLock) Release(convID uint, token int64) {
+	if token == 0 {
+		return
+	}
+	if err := l.DB.Model(&model.Conversation{}).Where("id = ? AND lock_token = ?", convID, token).
+		Update("lock_expires_at", nil).Error; err != nil {
+		log.Printf("释放会话锁租约失败：convID=%d, err=%v", convID, err)
+	}
+	l.releaseRedis(convID, token)
+}
+
+// releaseRedis 释放Redis锁，仅当仍由该令牌持有时
+func (l *ConversationLock) releaseRedis(convID uint, token int64) {
+	key := fmt.Sprintf(conversationLockKeyPrefix, convID)
+	if err := releaseConversationLockScript.Run(context.Background(), l.RDB, []string{key}, token).Err(); err != nil {
+		log.Printf("释放会话锁失败：convID=%d, err=%v", convID, err)
+	}
+}
+
+// Releaser 返回只执行一次的释放函数，便于在多个结束路径上提前释放
+func (l *ConversationLock) Releaser(convID uint, token int64) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.Release(convID, token) })
+	}
+}
+
+// CheckFence 在保存回复的事务中校验并推进会话的防护令牌
+// 租约已被其他请求取得或令牌已落后时返回 ErrLockLost；令牌为0（未加锁）同样拒绝
+func CheckFence(tx *gorm.DB, convID uint, token int64) error {
+	if token <= 0 {
+		return ErrLockLost
+	}
+	result := tx.Model(&model.Conversation{}).
+		Where("id = ? AND lock_token = ? AND fence_token < ?", convID, token, token).
+		Update("fence_token", token)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// CheckLease 在保存回复之前的写入事务中校验令牌仍持有会话锁（如切换分支、保存编辑后的消息），
+// 锁定会话行但不推进防护令牌，同一次加锁最终保存回复时仍由 CheckFence 校验
+func CheckLease(tx *gorm.DB, convID uint, token int64) error {
+	if token <= 0 {
+		return ErrLockLost
+	}
+	var conversation model.Conversation
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").
+		Where("id = ? AND lock_token = ? AND fence_token < ?", convID, token, token).
+		Take(&conversation).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrLockLost
+	}
+	return err
+}
@@ -0,0 +1,244 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"server/model"
+
+	"gorm.io/gorm"
+)
+
+// newTestLock 创建一个会话及其会话锁
+func newTestLock(t *testing.T) (*ConversationLock, uint) {
+	t.Helper()
+	_, rdb := newTestRedis(t)
+	db := newTestDB(t)
+	conv := model.Conversation{UserID: 1, Title: "t"}
+	if err := db.Create(&conv).Error; err != nil {
+		t.Fatalf("创建会话失败：%v", err)
+	}
+	return &ConversationLock{DB: db, RDB: rdb}, conv.ID
+}
+
+func TestConversationLockAcquire(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("会话忙时拒绝，释放后令牌递增", func(t *testing.T) {
+		lock, convID := newTestLock(t)
+		first, err := lock.Acquire(ctx, convID)
+		if err != nil || first <= 0 {
+			t.Fatalf("Acquire = %d, %v", first, err)
+		}
+		if _, err := lock.Acquire(ctx, convID); !errors.Is(err, ErrConversationBusy) {
+			t.Fatalf("err = %v, want ErrConversationBusy", err)
+		}
+		lock.Release(convID, first)
+		second, err := lock.Acquire(ctx, convID)
+		if err != nil || second <= first {
+			t.Fatalf("Acquire = %d, %v, want > %d", second, err, first)
+		}
+	})
+
+	t.Run("排队模式等待超时后返回会话忙", func(t *testing.T) {
+		t.Setenv("CONVERSATION_LOCK_MODE", "queue")
+		t.Setenv("CONVERSATION_LOCK_WAIT_MS", "300")
+		lock, convID := newTestLock(t)
+		if _, err := lock.Acquire(ctx, convID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := lock.Acquire(ctx, convID); !errors.Is(err, ErrConversationBusy) {
+			t.Fatalf("err = %v, want ErrConversationBusy", err)
+		}
+	})
+
+	t.Run("释放旧令牌不影响新的持有者", func(t *testing.T) {
+		lock, convID := newTestLock(t)
+		first, _ := lock.Acquire(ctx, convID)
+		lock.Release(convID, first)
+		second, _ := lock.Acquire(ctx, convID)
+		lock.Release(convID, first)
+		if _, err := lock.Acquire(ctx, convID); !errors.Is(err, ErrConversationBusy) {
+			t.Fatalf("err = %v, 新的持有者 %d 不应被旧令牌释放", err, second)
+		}
+	})
+
+	t.Run("Redis不可用时以数据库租约加锁", func(t *testing.T) {
+		mr, rdb := newTestRedis(t)
+		db := newTestDB(t)
+		conv := model.Conversation{UserID: 1}
+		db.Create(&conv)
+		lock := &ConversationLock{DB: db, RDB: rdb}
+
+		first, err := lock.Acquire(ctx, conv.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lock.Release(conv.ID, first)
+
+		mr.Close()
+		second, err := lock.Acquire(ctx, conv.ID)
+		if err != nil || second <= first {
+			t.Fatalf("Acquire = %d, %v, want > %d", second, err, first)
+		}
+		if _, err := lock.Acquire(ctx, conv.ID); !errors.Is(err, ErrConversationBusy) {
+			t.Fatalf("租约未过期时应拒绝：err = %v", err)
+		}
+
+		// Redis恢复后仍以租约为准，令牌从数据库中已发放的最大值继续
+		if err := mr.Restart(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := lock.Acquire(ctx, conv.ID); !errors.Is(err, ErrConversationBusy) {
+			t.Fatalf("Redis恢复后租约仍应生效：err = %v", err)
+		}
+		lock.Release(conv.ID, second)
+		third, err := lock.Acquire(ctx, conv.ID)
+		if err != nil || third <= second {
+			t.Fatalf("Acquire = %d, %v, want > %d", third, err, second)
+		}
+	})
+
+	t.Run("数据库不可用时返回错误而不是放行", func(t *testing.T) {
+		lock, _ := newTestLock(t)
+		if _, err := lock.Acquire(ctx, 999); !errors.Is(err, ErrLockUnavailable) {
+			t.Fatalf("err = %v, want ErrLockUnavailable", err)
+		}
+	})
+}
+
+func TestCheckFence(t *testing.T) {
+	ctx := context.Background()
+	check := func(lock *ConversationLock, convID uint, token int64) error {
+		return lock.DB.Transaction(func(tx *gorm.DB) error { return CheckFence(tx, convID, token) })
+	}
+
+	tests := []struct {
+		name    string
+		run     func(lock *ConversationLock, convID uint) error
+		wantErr error
+	}{
+		{
+			name: "持有者保存成功",
+			run: func(lock *ConversationLock, convID uint) error {
+				token, _ := lock.Acquire(ctx, convID)
+				return check(lock, convID, token)
+			},
+		},
+		{
+			name: "令牌0被拒绝",
+			run: func(lock *ConversationLock, convID uint) error {
+				return check(lock, convID, 0)
+			},
+			wantErr: ErrLockLost,
+		},
+		{
+			name: "同一令牌只能保存一次",
+			run: func(lock *ConversationLock, convID uint) error {
+				token, _ := lock.Acquire(ctx, convID)
+				if err := check(lock, convID, token); err != nil {
+					return err
+				}
+				return check(lock, convID, token)
+			},
+			wantErr: ErrLockLost,
+		},
+		{
+			name: "锁被其他请求取得后旧令牌被拒绝",
+			run: func(lock *ConversationLock, convID uint) error {
+				old, _ := lock.Acquire(ctx, convID)
+				// 模拟锁过期：释放后由新请求取得
+				lock.Release(convID, old)
+				if _, err := lock.Acquire(ctx, convID); err != nil {
+					return err
+				}
+				return check(lock, convID, old)
+			},
+			wantErr: ErrLockLost,
+		},
+		{
+			name: "释放后、无人取得前仍可保存",
+			run: func(lock *ConversationLock, convID uint) error {
+				token, _ := lock.Acquire(ctx, convID)
+				lock.Release(convID, token)
+				return check(lock, convID, token)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lock, convID := newTestLock(t)
+			if err := tt.run(lock, convID); !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckLease(t *testing.T) {
+	ctx := context.Background()
+	lease := func(lock *ConversationLock, convID uint, token int64) error {
+		return lock.DB.Transaction(func(tx *gorm.DB) error { return CheckLease(tx, convID, token) })
+	}
+	fence := func(lock *ConversationLock, convID uint, token int64) error {
+		return lock.DB.Transaction(func(tx *gorm.DB) error { return CheckFence(tx, convID, token) })
+	}
+
+	tests := []struct {
+		name    string
+		run     func(lock *ConversationLock, convID uint) error
+		wantErr error
+	}{
+		{
+			name: "多次写入后仍可保存回复",
+			run: func(lock *ConversationLock, convID uint) error {
+				token, _ := lock.Acquire(ctx, convID)
+				for i := 0; i < 2; i++ {
+					if err := lease(lock, convID, token); err != nil {
+						return err
+					}
+				}
+				return fence(lock, convID, token)
+			},
+		},
+		{
+			name: "令牌0被拒绝",
+			run: func(lock *ConversationLock, convID uint) error {
+				return lease(lock, convID, 0)
+			},
+			wantErr: ErrLockLost,
+		},
+		{
+			name: "锁被其他请求取得后被拒绝",
+			run: func(lock *ConversationLock, convID uint) error {
+				old, _ := lock.Acquire(ctx, convID)
+				lock.Release(convID, old)
+				if _, err := lock.Acquire(ctx, convID); err != nil {
+					return err
+				}
+				return lease(lock, convID, old)
+			},
+			wantErr: ErrLockLost,
+		},
+		{
+			name: "保存回复后被拒绝",
+			run: func(lock *ConversationLock, convID uint) error {
+				token, _ := lock.Acquire(ctx, convID)
+				if err := fence(lock, convID, token); err != nil {
+					return err
+				}
+				return lease(lock, convID, token)
+			},
+			wantErr: ErrLockLost,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lock, convID := newTestLock(t)
+			if err := tt.run(lock, convID); !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+// services 包
+// 邮件令牌：邮箱验证和重置密码链接中的令牌，使用HMAC签名，带过期时间，只能使用一次
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"server/model" // 模型包，包含数据模型定义
+
+	"github.com/redis/go-redis/v9" // Redis客户端
+)
+
+// 邮件令牌的用途
+const (
+	EmailTokenVerify = "verify" // 验证邮箱
+	EmailTokenReset  = "reset"  // 重置密码
+)
+
+const (
+	// 已使用的令牌：email_token_used:{nonce}，保留到令牌过期
+	emailTokenUsedKeyPrefix = "email_token_used:%s"
+	// 发送间隔：mail_cooldown:{用途}:{userID}，期间不再重复发送
+	mailCooldownKeyPrefix = "mail_cooldown:%s:%d"
+)
+
+// ErrEmailTokenInvalid 令牌格式或签名错误、已过期、已使用，或对应的邮箱/密码已变更
+var ErrEmailTokenInvalid = errors.New("链接无效或已过期")
+
+// EmailTokenClaims 令牌内容；Stamp 为签发时邮箱（验证）或密码摘要（重置）的摘要，变更后令牌随即失效
+type EmailTokenClaims struct {
+	Purpose   string `json:"p"`
+	UserID    uint   `json:"u"`
+	Stamp     string `json:"s"`
+	ExpiresAt int64  `json:"e"`
+	Nonce     string `json:"n"`
+}
+
+// EmailTokenService 邮件令牌的签发和使用
+type EmailTokenService struct {
+	RDB *redis.Client
+}
+
+// emailTokenSecret 签名密钥，由 EMAIL_TOKEN_SECRET 配置，未配置时使用 JWT_SECRET
+func emailTokenSecret() []byte {
+	if secret := os.Getenv("EMAIL_TOKEN_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	return []byte("my_chat_secret_key")
+}
+
+// EmailTokenTTL 令牌有效期：验证邮箱由 EMAIL_VERIFY_TTL_HOURS 配置，重置密码由 PASSWORD_RESET_TTL_MINUTES 配置
+func EmailTokenTTL(purpose string) time.Duration {
+	if purpose == EmailTokenReset {
+		return time.Duration(envInt("PASSWORD_RESET_TTL_MINUTES", 30)) * time.Minute
+	}
+	return time.Duration(envInt("EMAIL_VERIFY_TTL_HOURS", 24)) * time.Hour
+}
+
+// emailTokenStamp 令牌绑定的用户状态
+func emailTokenStamp(purpose string, user *model.User) string {
+	source := strings.ToLower(user.Email)
+	if purpose == EmailTokenReset {
+		source = user.Password
+	}
+	sum := sha256.Sum256([]byte(purpose + ":" + source))
+	return hex.EncodeToString(sum[:8])
+}
+
+func signEmailToken(payload []byte) []byte {
+	mac := hmac.New(sha256.New, emailTokenSecret())
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Issue 为用户签发令牌
+func (s *EmailTokenService) Issue(purpose string, user *model.User) (string, error) {
+	payload, err := json.Marshal(EmailTokenClaims{
+		Purpose:   purpose,
+		UserID:    user.ID,
+		Stamp:     emailTokenStamp(purpose, user),
+		ExpiresAt: time.Now().Add(EmailTokenTTL(purpose)).Unix(),
+		Nonce:     NewStreamID(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signEmailToken(payload)), nil
+}
+
+// Parse 校验令牌的签名、用途和有效期，返回令牌内容；不标记为已使用
+func (s *EmailTokenService) Parse(purpose string, token string) (*EmailTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrEmailTokenInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrEmailTokenInvalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, signEmailToken(payload)) {
+		return nil, ErrEmailTokenInvalid
+	}
+	var claims EmailTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrEmailTokenInvalid
+	}
+	if claims.Purpose != purpose || claims.Nonce == "" || time.Now().Unix() > claims.ExpiresAt {
+		return nil, ErrEmailTokenInvalid
+	}
+	return &claims, nil
+}
+
+/**
+ * Consume 使用令牌：校验令牌与用户当前状态一致，并标记为已使用
+ * 同一令牌只能成功使用一次；Redis不可用时拒绝，不能确认令牌是否已被使用
+ */
+func (s *EmailTokenService) Consume(ctx context.Context, claims *EmailTokenClaims, user *model.User) error {
+	if user.ID != claims.UserID || emailTokenStamp(claims.Purpose, user) != claims.Stamp {
+		return ErrEmailTokenInvalid
+	}
+	ttl := time.Until(time.Unix(claims.ExpiresAt, 0)) + time.Minute
+	ok, err := s.RDB.SetNX(ctx, fmt.Sprintf(emailTokenUsedKeyPrefix, claims.Nonce), 1, ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrEmailTokenInvalid
+	}
+	return nil
+}
+
+// AllowSend 同一用户同一用途的邮件在 MAIL_COOLDOWN_SECONDS 内只发送一次；Redis不可用时放行
+func (s *EmailTokenService) AllowSend(ctx context.Context, purpose string, userID uint) bool {
+	cooldown := time.Duration(envInt("MAIL_COOLDOWN_SECONDS", 60)) * time.Second
+	if cooldown <= 0 {
+		return true
+	}
+	ok, err := s.RDB.SetNX(ctx, fmt.Sprintf(mailCooldownKeyPrefix, purpose, userID), 1, cooldown).Result()
+	if err != nil {
+		log.Printf("检查邮件发送间隔失败，放行本次发送：purpose=%s, user_id=%d, err=%v", purpose, userID, err)
+		return true
+	}
+	return ok
+}
+
+// EmailLink 邮件中的链接，指向前端页面 MAIL_LINK_BASE（默认 FRONT_URL）下的 path
+func EmailLink(path string, token string) string {
+	base := os.Getenv("MAIL_LINK_BASE")
+	if base == "" {
+		base = os.Getenv("FRONT_URL")
+	}
+	return strings.TrimRight(base, "/") + path + "?token=" + token
+}
+
+// RequireEmailVerified 是否要求验证邮箱后才能登录，由 REQUIRE_EMAIL_VERIFIED 配置
+func RequireEmailVerified() bool {
+	return strings.EqualFold(os.Getenv("REQUIRE_EMAIL_VERIFIED"), "true")
+}
@@ -0,0 +1,136 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"server/model"
+)
+
+func TestEmailTokenParse(t *testing.T) {
+	t.Setenv("EMAIL_TOKEN_SECRET", "test-secret")
+	user := &model.User{ID: 7, Email: "a@example.com", Password: "hash-1"}
+	s := &EmailTokenService{}
+
+	valid, err := s.Issue(EmailTokenReset, user)
+	if err != nil {
+		t.Fatalf("签发令牌失败：%v", err)
+	}
+	payload, signature, _ := strings.Cut(valid, ".")
+
+	// 篡改内容后使用原签名
+	claims, _ := base64.RawURLEncoding.DecodeString(payload)
+	var decoded EmailTokenClaims
+	_ = json.Unmarshal(claims, &decoded)
+	decoded.UserID = 8
+	tampered, _ := json.Marshal(decoded)
+
+	// 使用正确的密钥签发已过期的令牌
+	decoded.UserID = 7
+	decoded.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	expiredPayload, _ := json.Marshal(decoded)
+	expired := base64.RawURLEncoding.EncodeToString(expiredPayload) + "." + base64.RawURLEncoding.EncodeToString(signEmailToken(expiredPayload))
+
+	tests := []struct {
+		name    string
+		purpose string
+		token   string
+		wantErr bool
+	}{
+		{"有效令牌", EmailTokenReset, valid, false},
+		{"用途不符", EmailTokenVerify, valid, true},
+		{"缺少签名", EmailTokenReset, payload, true},
+		{"签名不是base64", EmailTokenReset, payload + ".!!!", true},
+		{"内容被篡改", EmailTokenReset, base64.RawURLEncoding.EncodeToString(tampered) + "." + signature, true},
+		{"已过期", EmailTokenReset, expired, true},
+		{"空令牌", EmailTokenReset, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := s.Parse(tt.purpose, tt.token)
+			if tt.wantErr {
+				if !errors.Is(err, ErrEmailTokenInvalid) {
+					t.Errorf("err = %v, want ErrEmailTokenInvalid", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if claims.UserID != user.ID || claims.Purpose != tt.purpose {
+				t.Errorf("claims = %+v", claims)
+			}
+		})
+	}
+
+	t.Run("密钥不同", func(t *testing.T) {
+		t.Setenv("EMAIL_TOKEN_SECRET", "other-secret")
+		if _, err := s.Parse(EmailTokenReset, valid); !errors.Is(err, ErrEmailTokenInvalid) {
+			t.Errorf("err = %v, want ErrEmailTokenInvalid", err)
+		}
+	})
+}
+
+func TestEmailTokenConsume(t *testing.T) {
+	t.Setenv("EMAIL_TOKEN_SECRET", "test-secret")
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		purpose string
+		change  func(u *model.User)
+		twice   bool
+		wantErr error
+	}{
+		{"首次使用成功", EmailTokenReset, nil, false, nil},
+		{"同一令牌只能使用一次", EmailTokenReset, nil, true, ErrEmailTokenInvalid},
+		{"密码已修改后重置令牌失效", EmailTokenReset, func(u *model.User) { u.Password = "hash-2" }, false, ErrEmailTokenInvalid},
+		{"邮箱已修改后验证令牌失效", EmailTokenVerify, func(u *model.User) { u.Email = "b@example.com" }, false, ErrEmailTokenInvalid},
+		{"邮箱大小写不同不影响验证令牌", EmailTokenVerify, func(u *model.User) { u.Email = "A@Example.com" }, false, nil},
+		{"其他用户不能使用", EmailTokenReset, func(u *model.User) { u.ID = 8 }, false, ErrEmailTokenInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, rdb := newTestRedis(t)
+			s := &EmailTokenService{RDB: rdb}
+			user := &model.User{ID: 7, Email: "a@example.com", Password: "hash-1"}
+			token, err := s.Issue(tt.purpose, user)
+			if err != nil {
+				t.Fatalf("签发令牌失败：%v", err)
+			}
+			claims, err := s.Parse(tt.purpose, token)
+			if err != nil {
+				t.Fatalf("解析令牌失败：%v", err)
+			}
+
+			if tt.change != nil {
+				tt.change(user)
+			}
+			if tt.twice {
+				if err := s.Consume(ctx, claims, user); err != nil {
+					t.Fatalf("首次使用失败：%v", err)
+				}
+			}
+			if err := s.Consume(ctx, claims, user); !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("Redis不可用时拒绝", func(t *testing.T) {
+		mr, rdb := newTestRedis(t)
+		s := &EmailTokenService{RDB: rdb}
+		user := &model.User{ID: 7, Email: "a@example.com", Password: "hash-1"}
+		token, _ := s.Issue(EmailTokenReset, user)
+		claims, _ := s.Parse(EmailTokenReset, token)
+		mr.Close()
+		if err := s.Consume(ctx, claims, user); err == nil {
+			t.Error("无法确认令牌是否已使用时应拒绝")
+		}
+	})
+}
@@ -0,0 +1,90 @@
+// services 包
+// 降级链：主模型不可用时按顺序切换到备用模型/提供方
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// ModelTarget 降级链中的一个模型，Model 为空时使用提供方默认模型
+type ModelTarget struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+}
+
+// ParseModelTargets 解析 "provider:model,provider:model" 格式的降级链
+// 模型名中可以包含冒号（如 ollama:llama3:8b），只按第一个冒号切分
+func ParseModelTargets(s string) ([]ModelTarget, error) {
+	var targets []ModelTarget
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, ":", 2)
+		target := ModelTarget{Provider: strings.TrimSpace(parts[0])}
+		if len(parts) == 2 {
+			target.Model = strings.TrimSpace(parts[1])
+		}
+		if target.Provider == "" {
+			return nil, fmt.Errorf("降级链格式错误：%s", item)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// defaultFallbacks 全局降级链，由 AI_FALLBACKS 配置
+func defaultFallbacks() []ModelTarget {
+	targets, err := ParseModelTargets(os.Getenv("AI_FALLBACKS"))
+	if err != nil {
+		log.Printf("AI_FALLBACKS 配置错误：%v", err)
+		return nil
+	}
+	return targets
+}
+
+// candidates 按顺序返回本次请求依次尝试的请求：主模型在前，其后为会话或全局降级链，相同的模型只尝试一次
+func candidates(req *ChatRequest) []*ChatRequest {
+	fallbacks := req.Fallbacks
+	if fallbacks == nil {
+		fallbacks = defaultFallbacks()
+	}
+
+	result := []*ChatRequest{req}
+	seen := map[ModelTarget]bool{}
+	if p, resolved, err := resolve(req); err == nil {
+		seen[ModelTarget{Provider: p.Name(), Model: resolved.Model}] = true
+	}
+	for _, target := range fallbacks {
+		next := *req
+		next.Provider, next.Model = target.Provider, target.Model
+		if p, resolved, err := resolve(&next); err == nil {
+			key := ModelTarget{Provider: p.Name(), Model: resolved.Model}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		result = append(result, &next)
+	}
+	return result
+}
+
+/**
+ * shouldFallback 出错后是否尝试下一个模型
+ * 只在限流、5xx、超时、网络错误（见 IsRetryable）和熔断时切换；请求参数错误、认证失败、上下文超长等
+ * 换模型也无法解决，直接返回以暴露配置问题，避免沿降级链重复计费；调用方主动取消时不再继续
+ */
+func shouldFallback(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	var openErr *CircuitOpenError
+	return IsRetryable(err) || errors.As(err, &openErr)
+}
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseModelTargets(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []ModelTarget
+		wantErr bool
+	}{
+		{"空字符串", "", nil, false},
+		{"只有提供方", "deepseek", []ModelTarget{{Provider: "deepseek"}}, false},
+		{"多个目标", "qwen:qwen-plus, deepseek:deepseek-chat", []ModelTarget{{"qwen", "qwen-plus"}, {"deepseek", "deepseek-chat"}}, false},
+		{"模型名包含冒号", "ollama:llama3:8b", []ModelTarget{{"ollama", "llama3:8b"}}, false},
+		{"忽略空项和空白", " , qwen : qwen-max ,", []ModelTarget{{"qwen", "qwen-max"}}, false},
+		{"提供方为空", ":qwen-plus", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseModelTargets(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseModelTargets(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldFallback(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{"成功", context.Background(), nil, false},
+		{"限流", context.Background(), &UpstreamError{StatusCode: http.StatusTooManyRequests}, true},
+		{"服务端错误", context.Background(), &UpstreamError{StatusCode: http.StatusBadGateway}, true},
+		{"超时", context.Background(), fmt.Errorf("读取响应失败：%w", context.DeadlineExceeded), true},
+		{"熔断", context.Background(), &CircuitOpenError{Provider: "qwen", RetryAt: time.Now()}, true},
+		{"请求参数错误", context.Background(), &UpstreamError{StatusCode: http.StatusBadRequest}, false},
+		{"认证失败", context.Background(), &UpstreamError{StatusCode: http.StatusUnauthorized}, false},
+		{"未配置的提供方", context.Background(), errors.New("未注册的AI提供方：foo"), false},
+		{"调用方已取消", canceled, &UpstreamError{StatusCode: http.StatusBadGateway}, false},
+		{"取消错误", context.Background(), context.Canceled, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldFallback(tt.ctx, tt.err); got != tt.want {
+				t.Errorf("shouldFallback(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
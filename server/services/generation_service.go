@@ -0,0 +1,545 @@
+// services 包
+// 生成任务：接口投递任务到Redis队列，生成worker调用模型并将事件写入Redis Stream，
+// 任意数量的连接（多个标签页、设备）都可以回放和续读，所有连接断开后生成仍会完成并保存；
+// worker取出任务时移入自己的处理中列表，执行结束后确认移除，worker异常退出时由回收任务接管
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"server/cache" // 缓存包，用于对话上下文缓存
+	"server/dto"   // 数据传输对象，定义请求和响应结构
+	"server/model" // 模型包，包含数据模型定义
+	"server/utils" // 工具包，包含字符串截断等工具函数
+
+	"github.com/redis/go-redis/v9" // Redis客户端
+	"gorm.io/gorm"                 // GORM数据库框架
+)
+
+const (
+	// 生成事件缓冲：generation_stream:{generationID}，每条记录包含 data(JSON) 和 final(是否为最后一条)
+	generationStreamKeyPrefix = "generation_stream:%s"
+	generationStreamMaxLen    = 20000
+	generationTailBlock       = 5 * time.Second
+	// 生成任务队列，元素为 GenerationJob 的JSON
+	generationQueueKey = "generation_jobs"
+	// 处理中的任务：generation_processing:{workerID}，任务执行结束后移除
+	generationProcessingKeyPrefix = "generation_processing:%s"
+	// worker心跳：generation_worker:{workerID}，过期说明worker已退出，其处理中的任务由回收任务接管
+	generationWorkerKeyPrefix = "generation_worker:%s"
+	generationWorkerTTL       = time.Minute
+	generationHeartbeat       = 15 * time.Second
+	generationReapInterval    = 30 * time.Second
+)
+
+// GenerationJob 一次生成任务，可序列化以便投递给其他实例执行
+type GenerationJob struct {
+	ID             string        `json:"id"`
+	UserID         uint          `json:"user_id"`
+	ConversationID uint          `json:"conversation_id"`
+	UserMessage    model.Message `json:"user_message"`
+	Request        *ChatRequest  `json:"request"`
+	Context        []dto.Message `json:"context"`     // 含本次用户消息的上下文，生成完成后追加回复写回Redis
+	CtxVersion     int64         `json:"ctx_version"` // 构建上下文时的缓存版本，期间缓存失效则不写回
+	LockToken      int64         `json:"lock_token"`  // 会话锁令牌，生成结束后由worker释放
+
+	// 提交任务时新建的数据，预占额度失败时撤销，避免留下没有回复的用户消息
+	CreatedMessage      bool `json:"created_message"`      // UserMessage 为本次新建
+	CreatedConversation bool `json:"created_conversation"` // 会话为本次新建
+	ReplacedMessageID   uint `json:"replaced_message_id"`  // 编辑时被替换的原消息，撤销时恢复为当前版本
+}
+
+// GenerationEvent 缓冲中的一条事件，ID 为Redis Stream的记录ID，用作SSE的事件ID
+type GenerationEvent struct {
+	ID    string
+	Type  string // 事件类型，用作SSE的 event 字段
+	Data  []byte // 序列化后的 dto.StreamEvent
+	Final bool
+}
+
+// eventHeader 本次生成的事件头
+func (job *GenerationJob) eventHeader(eventType string) dto.EventHeader {
+	header := dto.NewEventHeader(eventType)
+	header.StreamID = job.ID
+	header.ConversationID = job.ConversationID
+	header.UserMessageID = job.UserMessage.ID
+	return header
+}
+
+// GenerationService 生成服务
+type GenerationService struct {
+	DB  *gorm.DB
+	RDB *redis.Client
+}
+
+// generationBufferTTL 生成结束后事件缓冲的保留时间，由 GENERATION_BUFFER_TTL_SECONDS 配置
+func generationBufferTTL() time.Duration {
+	return time.Duration(envInt("GENERATION_BUFFER_TTL_SECONDS", 3600)) * time.Second
+}
+
+// publish 追加一条事件到缓冲
+func (gs *GenerationService) publish(id string, event dto.StreamEvent, final bool) {
+	jsonData, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("序列化生成事件失败：%v", err)
+		return
+	}
+	finalFlag := "0"
+	if final {
+		finalFlag = "1"
+	}
+
+	ctx := context.Background()
+	key := fmt.Sprintf(generationStreamKeyPrefix, id)
+	pipe := gs.RDB.Pipeline()
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: key,
+		MaxLen: generationStreamMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{"type": event.EventType(), "data": jsonData, "final": finalFlag},
+	})
+	if final {
+		pipe.Expire(ctx, key, generationBufferTTL())
+	} else {
+		pipe.Expire(ctx, key, streamTTL())
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("写入生成事件失败：generation_id=%s, err=%v", id, err)
+	}
+}
+
+// publishError 写入错误事件以及结束事件
+func (gs *GenerationService) publishError(job *GenerationJob, code int, msg string) {
+	gs.publish(job.ID, dto.ErrorEvent{EventHeader: job.eventHeader(dto.EventError), Code: code, Msg: msg}, false)
+	gs.publish(job.ID, dto.DoneEvent{EventHeader: job.eventHeader(dto.EventDone), Msg: "错误终止"}, true)
+}
+
+/**
+ * Enqueue 投递生成任务，由任意实例上的生成worker执行
+ * 投递前先登记生成信息，使客户端可以立即订阅事件或停止生成
+ */
+func (gs *GenerationService) Enqueue(ctx context.Context, job *GenerationJob) error {
+	payload, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	err = Streams.Register(ctx, job.ID, job.UserID, job.ConversationID)
+	if err == nil {
+		err = gs.RDB.LPush(ctx, generationQueueKey, payload).Err()
+	}
+	if err != nil {
+		// 任务未能投递，不会有worker释放会话锁
+		(&ConversationLock{DB: gs.DB, RDB: gs.RDB}).Release(job.ConversationID, job.LockToken)
+	}
+	return err
+}
+
+// StartGenerationWorkers 启动 GENERATION_WORKERS 个生成worker，为0时本实例只投递不执行；
+// 各实例都运行回收任务，接管已退出worker处理中的任务
+func StartGenerationWorkers(db *gorm.DB, rdb *redis.Client) {
+	gs := &GenerationService{DB: db, RDB: rdb}
+	workers := envInt("GENERATION_WORKERS", 4)
+	instanceID := NewStreamID()[:12]
+	workerIDs := make([]string, workers)
+	for i := range workerIDs {
+		workerIDs[i] = fmt.Sprintf("%s-%d", instanceID, i)
+	}
+	gs.heartbeat(workerIDs)
+	go func() {
+		for range time.Tick(generationHeartbeat) {
+			gs.heartbeat(workerIDs)
+		}
+	}()
+	for _, workerID := range workerIDs {
+		go gs.work(workerID)
+	}
+	go func() {
+		for range time.Tick(generationReapInterval) {
+			gs.reap()
+		}
+	}()
+	log.Printf("生成worker启动完成：%d 个", workers)
+}
+
+// heartbeat 刷新本实例各worker的心跳
+func (gs *GenerationService) heartbeat(workerIDs []string) {
+	if len(workerIDs) == 0 {
+		return
+	}
+	ctx := context.Background()
+	pipe := gs.RDB.Pipeline()
+	for _, workerID := range workerIDs {
+		pipe.Set(ctx, fmt.Sprintf(generationWorkerKeyPrefix, workerID), 1, generationWorkerTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("刷新生成worker心跳失败：%v", err)
+	}
+}
+
+// work 循环从队列中取出任务并执行，取出的任务原子地移入本worker的处理中列表，执行结束后移除
+func (gs *GenerationService) work(workerID string) {
+	processingKey := fmt.Sprintf(generationProcessingKeyPrefix, workerID)
+	for {
+		payload, err := gs.RDB.BLMove(context.Background(), generationQueueKey, processingKey, "RIGHT", "LEFT", generationTailBlock).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			log.Printf("读取生成任务失败：%v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		var job GenerationJob
+		if err := json.Unmarshal([]byte(payload), &job); err != nil {
+			log.Printf("解析生成任务失败：%v", err)
+		} else {
+			gs.runSafely(&job)
+		}
+		if err := gs.RDB.LRem(context.Background(), processingKey, 1, payload).Err(); err != nil {
+			log.Printf("确认生成任务失败：worker=%s, err=%v", workerID, err)
+		}
+	}
+}
+
+/**
+ * reap 接管心跳已过期的worker处理中的任务
+ * 尚未开始（事件缓冲为空）的任务放回队列，由其他worker执行；
+ * 已开始的任务不重新执行，避免事件缓冲中出现重复的内容，改为写入错误事件结束生成并释放会话锁
+ */
+func (gs *GenerationService) reap() {
+	ctx := context.Background()
+	iter := gs.RDB.Scan(ctx, 0, fmt.Sprintf(generationProcessingKeyPrefix, "*"), 100).Iterator()
+	for iter.Next(ctx) {
+		processingKey := iter.Val()
+		var workerID string
+		if _, err := fmt.Sscanf(processingKey, generationProcessingKeyPrefix, &workerID); err != nil {
+			continue
+		}
+		alive, err := gs.RDB.Exists(ctx, fmt.Sprintf(generationWorkerKeyPrefix, workerID)).Result()
+		if err != nil || alive == 1 {
+			continue
+		}
+		for {
+			payload, err := gs.RDB.RPop(ctx, processingKey).Result()
+			if err != nil {
+				if !errors.Is(err, redis.Nil) {
+					log.Printf("回收生成任务失败：worker=%s, err=%v", workerID, err)
+				}
+				break
+			}
+			gs.reclaim(ctx, workerID, payload)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("扫描处理中的生成任务失败：%v", err)
+	}
+}
+
+// reclaim 处理一个从已退出worker回收的任务
+func (gs *GenerationService) reclaim(ctx context.Context, workerID string, payload string) {
+	var job GenerationJob
+	if err := json.Unmarshal([]byte(payload), &job); err != nil {
+		log.Printf("解析回收的生成任务失败：worker=%s, err=%v", workerID, err)
+		return
+	}
+	started, err := gs.RDB.XLen(ctx, fmt.Sprintf(generationStreamKeyPrefix, job.ID)).Result()
+	if err != nil {
+		log.Printf("读取生成事件失败，放回队列：generation_id=%s, err=%v", job.ID, err)
+		started = 0
+	}
+	if started == 0 {
+		// 放到出队的一端，优先执行
+		if err := gs.RDB.RPush(ctx, generationQueueKey, payload).Err(); err != nil {
+			log.Printf("放回生成任务失败：generation_id=%s, err=%v", job.ID, err)
+			return
+		}
+		log.Printf("生成worker已退出，任务放回队列：worker=%s, generation_id=%s", workerID, job.ID)
+		return
+	}
+
+	log.Printf("生成worker已退出，结束执行中的任务：worker=%s, generation_id=%s", workerID, job.ID)
+	(&ConversationLock{DB: gs.DB, RDB: gs.RDB}).Release(job.ConversationID, job.LockToken)
+	gs.publishError(&job, http.StatusInternalServerError, "生成中断，请重新生成")
+	(&ActiveStream{ID: job.ID, UserID: job.UserID, ConversationID: job.ConversationID, registry: Streams}).Finish()
+}
+
+// runSafely 执行任务，捕获 panic 避免worker退出
+func (gs *GenerationService) runSafely(job *GenerationJob) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("生成任务异常：generation_id=%s, panic=%v", job.ID, r)
+			gs.publishError(job, http.StatusInternalServerError, "生成任务异常")
+		}
+	}()
+	gs.Run(job)
+}
+
+/**
+ * Run 执行一次生成任务
+ * 1. 登记生成，使其可被 /api/message/stop 停止；生成不受发起请求的连接影响
+ * 2. 预占额度，超限时撤销提交时新建的用户消息并以错误结束；流式调用模型，分片依次写入事件缓冲
+ * 3. 保存AI消息（被停止时保存已生成的部分并标记 interrupted），以实际用量结算额度，更新上下文缓存和会话信息；
+ *    未保存回复时退还预占的额度
+ * 4. 释放会话锁，写入 complete 或 stopped 作为最后一条事件
+ */
+func (gs *GenerationService) Run(job *GenerationJob) {
+	stream, ctx := Streams.Start(context.Background(), job.ID, job.UserID, job.ConversationID)
+	defer stream.Finish()
+	// 在最后一条事件之前释放会话锁，客户端收到结束事件后即可发送下一条消息
+	release := (&ConversationLock{DB: gs.DB, RDB: gs.RDB}).Releaser(job.ConversationID, job.LockToken)
+	defer release()
+
+	// 受理时的额度检查不能阻止并发请求共同超额，调用模型前原子地预占
+	reservation, err := (&QuotaService{DB: gs.DB, RDB: gs.RDB}).Reserve(ctx, job.UserID, EstimateRequestTokens(job.Request))
+	if err != nil {
+		gs.discard(job)
+		release()
+		gs.publishError(job, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	defer reservation.Cancel(context.Background())
+
+	gs.publish(job.ID, dto.StartEvent{EventHeader: job.eventHeader(dto.EventStart)}, false)
+
+	aiResp, err := StreamAIResponse(ctx, job.Request, func(delta StreamDelta) error {
+		if delta.Trim != nil {
+			gs.publish(job.ID, dto.ContextTrimmedEvent{EventHeader: job.eventHeader(dto.EventContextTrimmed), Trim: delta.Trim}, false)
+		}
+		if delta.ReasoningContent != "" {
+			gs.publish(job.ID, dto.ReasoningEvent{EventHeader: job.eventHeader(dto.EventReasoning), ReasoningContent: delta.ReasoningContent}, false)
+		}
+		if delta.Content != "" {
+			gs.publish(job.ID, dto.ChunkEvent{EventHeader: job.eventHeader(dto.EventChunk), Content: delta.Content}, false)
+		}
+		return nil
+	})
+
+	stopped := IsStreamStopped(ctx)
+	if err != nil && !stopped {
+		log.Printf("调用AI接口失败：generation_id=%s, err=%v", job.ID, err)
+		release()
+		var openErr *CircuitOpenError
+		if errors.As(err, &openErr) {
+			gs.publishError(job, http.StatusServiceUnavailable, openErr.Error())
+			return
+		}
+		gs.publishError(job, http.StatusBadGateway, "调用AI接口失败")
+		return
+	}
+
+	if stopped {
+		log.Printf("用户停止生成：generation_id=%s", job.ID)
+		// 没有任何内容时不保存AI消息
+		if aiResp == nil || (aiResp.Content == "" && aiResp.ReasoningContent == "") {
+			release()
+			gs.publish(job.ID, dto.ResultEvent{
+				EventHeader: job.eventHeader(dto.EventStopped),
+				Msg:         "已停止生成",
+				UserMessage: job.UserMessage,
+			}, true)
+			return
+		}
+	} else {
+		gs.publish(job.ID, dto.DoneEvent{EventHeader: job.eventHeader(dto.EventDone), Msg: "流式响应结束"}, false)
+	}
+
+	aiMessage, err := gs.persist(job, aiResp, stopped, reservation)
+	release()
+	if err != nil {
+		gs.publishError(job, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	eventType, msg := dto.EventComplete, "操作成功"
+	if stopped {
+		eventType, msg = dto.EventStopped, "已停止生成"
+	}
+	gs.publish(job.ID, dto.ResultEvent{
+		EventHeader: job.eventHeader(eventType),
+		Msg:         msg,
+		UserMessage: job.UserMessage,
+		AIMessage:   aiMessage,
+		Usage: &dto.MessageUsage{
+			Provider:         aiMessage.Provider,
+			Model:            aiMessage.Model,
+			PromptTokens:     aiMessage.PromptTokens,
+			CompletionTokens: aiMessage.CompletionTokens,
+			TotalTokens:      aiMessage.TotalTokens,
+			LatencyMs:        aiMessage.LatencyMs,
+			Cost:             aiMessage.Cost,
+		},
+	}, true)
+}
+
+/**
+ * discard 撤销提交任务时新建的用户消息，使会话回到提交前的状态
+ * 用户消息没有回复，直接删除而不是软删除，否则仍会作为当前分支的末尾；
+ * 编辑产生的消息被删除后恢复原消息为当前版本，本次新建的会话一并删除
+ */
+func (gs *GenerationService) discard(job *GenerationJob) {
+	if !job.CreatedMessage {
+		return
+	}
+	err := gs.DB.Transaction(func(tx *gorm.DB) error {
+		if err := CheckFence(tx, job.ConversationID, job.LockToken); err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Delete(&model.Message{}, job.UserMessage.ID).Error; err != nil {
+			return err
+		}
+		if job.ReplacedMessageID != 0 {
+			if err := tx.Model(&model.Message{}).Where("id = ?", job.ReplacedMessageID).
+				Update("inactive", false).Error; err != nil {
+				return err
+			}
+		}
+		if job.CreatedConversation {
+			return tx.Delete(&model.Conversation{}, job.ConversationID).Error
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("撤销用户消息失败：generation_id=%s, message_id=%d, err=%v", job.ID, job.UserMessage.ID, err)
+		return
+	}
+	cc := cache.ConversationCache{DB: gs.DB, RDB: gs.RDB}
+	if _, err := cc.InvalidateConversationCtx(job.ConversationID); err != nil {
+		log.Printf("清除Redis上下文失败：convID=%d, err=%v", job.ConversationID, err)
+	}
+}
+
+// persist 保存AI消息，以实际用量结算额度预占，并更新上下文缓存和会话信息
+func (gs *GenerationService) persist(job *GenerationJob, aiResp *ChatResponse, interrupted bool, reservation *QuotaReservation) (*model.Message, error) {
+	aiResponseContent := aiResp.Content
+	if aiResponseContent == "" {
+		aiResponseContent = "AI未返回有效内容"
+	}
+
+	aiMessage := model.Message{
+		Content:          aiResponseContent,
+		ReasoningContent: aiResp.ReasoningContent,
+		Type:             model.MessageTypeText,
+		MessageRole:      model.MessageRoleAI,
+		UserID:           job.UserID,
+		ConversationID:   job.ConversationID,
+		Provider:         aiResp.Provider,
+		Model:            aiResp.Model,
+		PromptTokens:     aiResp.Usage.PromptTokens,
+		CompletionTokens: aiResp.Usage.CompletionTokens,
+		TotalTokens:      aiResp.Usage.TotalTokens,
+		LatencyMs:        aiResp.LatencyMs,
+		Cost:             aiResp.Cost,
+		Interrupted:      interrupted,
+		ParentID:         job.UserMessage.ID,
+	}
+	// 同一条用户消息下已有的回复成为历史版本，新回复为当前版本
+	err := gs.DB.Transaction(func(tx *gorm.DB) error {
+		if err := CheckFence(tx, job.ConversationID, job.LockToken); err != nil {
+			return err
+		}
+		if err := tx.Model(&model.Message{}).
+			Where("conversation_id = ? AND parent_id = ? AND message_role = ?", job.ConversationID, job.UserMessage.ID, model.MessageRoleAI).
+			Update("inactive", true).Error; err != nil {
+			return err
+		}
+		return tx.Create(&aiMessage).Error
+	})
+	if errors.Is(err, ErrLockLost) {
+		log.Printf("会话锁已过期，放弃保存AI消息：generation_id=%s, token=%d", job.ID, job.LockToken)
+		return nil, err
+	}
+	if err != nil {
+		log.Printf("保存AI消息失败：%v", err)
+		return nil, fmt.Errorf("保存AI回复失败")
+	}
+	reservation.Settle(context.Background(), aiMessage.TotalTokens)
+
+	cc := cache.ConversationCache{DB: gs.DB, RDB: gs.RDB}
+	conversationCtx := append(job.Context, dto.Message{
+		Role:    "assistant",
+		Content: aiResponseContent,
+	})
+	if err := cc.SetConversationCtxToRedis(job.ConversationID, job.CtxVersion, conversationCtx); err != nil {
+		log.Printf("更新Redis上下文失败：convID=%d, err=%v", job.ConversationID, err)
+	}
+	(&Summarizer{DB: gs.DB, Cache: &cc}).SummarizeAsync(job.ConversationID, job.UserID)
+
+	var title string
+	if aiResp.ReasoningContent != "" {
+		title = utils.SafeTruncateStr(aiResp.ReasoningContent, 10)
+	} else {
+		title = utils.SafeTruncateStr(job.UserMessage.Content, 10)
+	}
+	if title == "" {
+		title = "无标题会话"
+	}
+	lastMsg := utils.SafeTruncateStr(aiResponseContent, 10)
+	if lastMsg == "" {
+		lastMsg = "无消息内容"
+	}
+	if err := gs.DB.Model(&model.Conversation{}).Where("id = ?", job.ConversationID).Updates(map[string]interface{}{
+		"title":       title,
+		"last_msg":    lastMsg,
+		"last_msg_at": time.Now(),
+	}).Error; err != nil {
+		log.Printf("更新会话失败：%v", err)
+		return nil, fmt.Errorf("更新会话失败")
+	}
+	return &aiMessage, nil
+}
+
+/**
+ * Tail 从 lastID 之后读取生成事件，先回放已缓冲的事件再持续等待新事件，读到最后一条事件后返回
+ * lastID 为空时从头读取；ctx 取消（客户端断开）只结束读取，不影响生成本身
+ */
+func (gs *GenerationService) Tail(ctx context.Context, id string, lastID string, onEvent func(GenerationEvent) error) error {
+	if lastID == "" {
+		lastID = "0"
+	}
+	key := fmt.Sprintf(generationStreamKeyPrefix, id)
+	for {
+		streams, err := gs.RDB.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{key, lastID},
+			Count:   100,
+			Block:   generationTailBlock,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			// 等待超时：生成信息已过期说明生成不会再产生事件
+			if _, _, err := Streams.Owner(ctx, id); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				lastID = msg.ID
+				data, _ := msg.Values["data"].(string)
+				eventType, _ := msg.Values["type"].(string)
+				if eventType == "" {
+					// 没有 type 字段的旧事件从内容中读取
+					var header dto.EventHeader
+					json.Unmarshal([]byte(data), &header)
+					eventType = header.Type
+				}
+				event := GenerationEvent{ID: msg.ID, Type: eventType, Data: []byte(data), Final: msg.Values["final"] == "1"}
+				if err := onEvent(event); err != nil {
+					return err
+				}
+				if event.Final {
+					return nil
+				}
+			}
+		}
+	}
+}
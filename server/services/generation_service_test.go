@@ -0,0 +1,109 @@
+package services
+
+import (
+	"context"
+	"maps"
+	"testing"
+
+	"server/model"
+
+	"gorm.io/gorm"
+)
+
+func TestGenerationDiscard(t *testing.T) {
+	// 会话中已有一轮对话 1 → 2，任务提交时新建了用户消息 3
+	setup := func(t *testing.T, parentID uint, replaced bool) (*GenerationService, *GenerationJob) {
+		_, rdb := newTestRedis(t)
+		db := newTestDB(t)
+		gs := &GenerationService{DB: db, RDB: rdb}
+		conv := model.Conversation{UserID: 1}
+		db.Create(&conv)
+		for _, msg := range []model.Message{
+			{ConversationID: conv.ID, UserID: 1, MessageRole: model.MessageRoleUser},
+			{ConversationID: conv.ID, UserID: 1, MessageRole: model.MessageRoleAI, ParentID: 1, Inactive: replaced},
+		} {
+			db.Create(&msg)
+		}
+		userMessage := model.Message{ConversationID: conv.ID, UserID: 1, MessageRole: model.MessageRoleUser, ParentID: parentID}
+		db.Create(&userMessage)
+
+		token, err := (&ConversationLock{DB: db, RDB: rdb}).Acquire(context.Background(), conv.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gs, &GenerationJob{ID: "g", UserID: 1, ConversationID: conv.ID, UserMessage: userMessage, LockToken: token}
+	}
+	messages := func(db *gorm.DB) map[uint]bool {
+		var list []model.Message
+		db.Unscoped().Find(&list)
+		active := map[uint]bool{}
+		for _, msg := range list {
+			active[msg.ID] = !msg.Inactive
+		}
+		return active
+	}
+
+	tests := []struct {
+		name         string
+		parentID     uint
+		replaced     bool // 用户消息替换了消息2（编辑）
+		configure    func(job *GenerationJob)
+		want         map[uint]bool // 消息ID → 是否为当前版本
+		wantConvGone bool
+	}{
+		{
+			name:      "撤销发送的消息",
+			parentID:  2,
+			configure: func(job *GenerationJob) { job.CreatedMessage = true },
+			want:      map[uint]bool{1: true, 2: true},
+		},
+		{
+			name:     "撤销编辑并恢复原消息",
+			parentID: 1,
+			replaced: true,
+			configure: func(job *GenerationJob) {
+				job.CreatedMessage, job.ReplacedMessageID = true, 2
+			},
+			want: map[uint]bool{1: true, 2: true},
+		},
+		{
+			name:     "撤销新建的会话",
+			parentID: 2,
+			configure: func(job *GenerationJob) {
+				job.CreatedMessage, job.CreatedConversation = true, true
+			},
+			want:         map[uint]bool{1: true, 2: true},
+			wantConvGone: true,
+		},
+		{
+			name:      "重新生成不删除已有消息",
+			parentID:  2,
+			configure: func(job *GenerationJob) {},
+			want:      map[uint]bool{1: true, 2: true, 3: true},
+		},
+		{
+			name:     "会话锁已过期时不做修改",
+			parentID: 2,
+			configure: func(job *GenerationJob) {
+				job.CreatedMessage, job.LockToken = true, job.LockToken+1
+			},
+			want: map[uint]bool{1: true, 2: true, 3: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs, job := setup(t, tt.parentID, tt.replaced)
+			tt.configure(job)
+			gs.discard(job)
+
+			if got := messages(gs.DB); !maps.Equal(got, tt.want) {
+				t.Errorf("messages = %v, want %v", got, tt.want)
+			}
+			var count int64
+			gs.DB.Model(&model.Conversation{}).Where("id = ?", job.ConversationID).Count(&count)
+			if gone := count == 0; gone != tt.wantConvGone {
+				t.Errorf("conversation deleted = %v, want %v", gone, tt.wantConvGone)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+// services 包
+// 幂等键：客户端通过 Idempotency-Key 请求头标识一次发送，网络重试时返回首次请求的结果而不是重新生成
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9" // Redis客户端
+)
+
+const (
+	// 幂等记录：idempotency:{userID}:{scope}:{key} -> Hash{status, fingerprint, generation_id, status_code, response}
+	idempotencyKeyPrefix = "idempotency:%d:%s:%s"
+	// 幂等键的最大长度
+	IdempotencyKeyMaxLen = 255
+)
+
+// 幂等记录的状态
+const (
+	IdempotencyPending   = "pending"   // 首次请求处理中
+	IdempotencyStreaming = "streaming" // 生成已投递，可凭 generation_id 订阅
+	IdempotencyCompleted = "completed" // 已完成，保存了响应
+)
+
+// ErrIdempotencyMismatch 同一个幂等键用于了内容不同的请求
+var ErrIdempotencyMismatch = errors.New("幂等键已用于其他请求")
+
+// 记录不存在时创建处理中的记录并返回空，已存在时返回记录内容
+var beginIdempotencyScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	redis.call("HSET", KEYS[1], "status", "pending", "fingerprint", ARGV[1])
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return {}
+end
+return redis.call("HGETALL", KEYS[1])
+`)
+
+// IdempotencyRecord 已存在的幂等记录
+type IdempotencyRecord struct {
+	Status       string
+	GenerationID string
+	StatusCode   int
+	Response     []byte
+}
+
+// Idempotency 首次请求持有的幂等记录，请求未成功时调用 Release 删除，允许客户端重试
+// 未携带幂等键时为 nil，各方法均可安全调用
+type Idempotency struct {
+	RDB *redis.Client
+
+	key  string
+	kept bool
+}
+
+// idempotencyTTL 完成后的记录保留时间
+func idempotencyTTL() time.Duration {
+	return time.Duration(envInt("IDEMPOTENCY_TTL_SECONDS", 86400)) * time.Second
+}
+
+// RequestFingerprint 请求内容的摘要，用于识别同一幂等键下内容不同的请求
+func RequestFingerprint(req interface{}) string {
+	data, _ := json.Marshal(req)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+/**
+ * BeginIdempotency 登记一次带幂等键的请求，scope 区分不同接口
+ * 首次请求返回 *Idempotency；重复请求返回已有记录，由调用方回放结果或订阅进行中的生成；
+ * 请求内容与首次不同时返回 ErrIdempotencyMismatch。Redis不可用时放行，按普通请求处理
+ */
+func BeginIdempotency(ctx context.Context, rdb *redis.Client, uid uint, scope string, key string, fingerprint string) (*Idempotency, *IdempotencyRecord, error) {
+	redisKey := fmt.Sprintf(idempotencyKeyPrefix, uid, scope, key)
+	// 处理中的记录只保留到请求超时，避免请求异常中断后长期无法重试
+	values, err := beginIdempotencyScript.Run(ctx, rdb, []string{redisKey}, fingerprint, streamTTL().Milliseconds()).StringSlice()
+	if err != nil {
+		log.Printf("登记幂等键失败，按普通请求处理：key=%s, err=%v", redisKey, err)
+		return nil, nil, nil
+	}
+	if len(values) == 0 {
+		return &Idempotency{RDB: rdb, key: redisKey}, nil, nil
+	}
+
+	fields := make(map[string]string, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		fields[values[i]] = values[i+1]
+	}
+	if fields["fingerprint"] != fingerprint {
+		return nil, nil, ErrIdempotencyMismatch
+	}
+	statusCode, _ := strconv.Atoi(fields["status_code"])
+	return nil, &IdempotencyRecord{
+		Status:       fields["status"],
+		GenerationID: fields["generation_id"],
+		StatusCode:   statusCode,
+		Response:     []byte(fields["response"]),
+	}, nil
+}
+
+// Attach 记录投递的生成，重复请求订阅该生成；记录保留到生成事件缓冲过期
+func (i *Idempotency) Attach(ctx context.Context, generationID string) {
+	if i == nil {
+		return
+	}
+	i.kept = true
+	pipe := i.RDB.TxPipeline()
+	pipe.HSet(ctx, i.key, "status", IdempotencyStreaming, "generation_id", generationID)
+	pipe.Expire(ctx, i.key, streamTTL()+generationBufferTTL())
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("保存幂等记录失败：key=%s, err=%v", i.key, err)
+	}
+}
+
+// Complete 保存首次请求的响应，重复请求直接返回该响应
+func (i *Idempotency) Complete(ctx context.Context, statusCode int, response interface{}) {
+	if i == nil {
+		return
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		return
+	}
+	i.kept = true
+	pipe := i.RDB.TxPipeline()
+	pipe.HSet(ctx, i.key, "status", IdempotencyCompleted, "status_code", statusCode, "response", data)
+	pipe.Expire(ctx, i.key, idempotencyTTL())
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("保存幂等记录失败：key=%s, err=%v", i.key, err)
+	}
+}
+
+// Release 请求未成功时删除记录，客户端可以用同一个幂等键重试；已保存结果时不做处理
+func (i *Idempotency) Release() {
+	if i == nil || i.kept {
+		return
+	}
+	if err := i.RDB.Del(context.Background(), i.key).Err(); err != nil {
+		log.Printf("删除幂等记录失败：key=%s, err=%v", i.key, err)
+	}
+}
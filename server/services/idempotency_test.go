@@ -0,0 +1,142 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBeginIdempotency(t *testing.T) {
+	ctx := context.Background()
+	first := RequestFingerprint(map[string]string{"content": "你好"})
+	other := RequestFingerprint(map[string]string{"content": "再见"})
+
+	tests := []struct {
+		name        string
+		prepare     func(t *testing.T, idem *Idempotency)
+		fingerprint string
+		wantNew     bool
+		wantStatus  string
+		wantErr     error
+	}{
+		{
+			name:        "处理中的重复请求返回记录",
+			prepare:     func(t *testing.T, idem *Idempotency) {},
+			fingerprint: first,
+			wantStatus:  IdempotencyPending,
+		},
+		{
+			name:        "内容不同的请求被拒绝",
+			prepare:     func(t *testing.T, idem *Idempotency) {},
+			fingerprint: other,
+			wantErr:     ErrIdempotencyMismatch,
+		},
+		{
+			name: "失败释放后可以重试",
+			prepare: func(t *testing.T, idem *Idempotency) {
+				idem.Release()
+			},
+			fingerprint: first,
+			wantNew:     true,
+		},
+		{
+			name: "已投递生成时返回生成ID",
+			prepare: func(t *testing.T, idem *Idempotency) {
+				idem.Attach(ctx, "gen-1")
+				idem.Release()
+			},
+			fingerprint: first,
+			wantStatus:  IdempotencyStreaming,
+		},
+		{
+			name: "已完成时返回保存的响应",
+			prepare: func(t *testing.T, idem *Idempotency) {
+				idem.Complete(ctx, http.StatusOK, map[string]int{"code": 200})
+				idem.Release()
+			},
+			fingerprint: first,
+			wantStatus:  IdempotencyCompleted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, rdb := newTestRedis(t)
+			idem, record, err := BeginIdempotency(ctx, rdb, 1, "send", "key-1", first)
+			if err != nil || idem == nil || record != nil {
+				t.Fatalf("首次请求应登记成功：idem=%v, record=%v, err=%v", idem, record, err)
+			}
+			tt.prepare(t, idem)
+
+			idem, record, err = BeginIdempotency(ctx, rdb, 1, "send", "key-1", tt.fingerprint)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if (idem != nil) != tt.wantNew {
+				t.Fatalf("idem = %v, wantNew %v", idem, tt.wantNew)
+			}
+			if tt.wantNew {
+				return
+			}
+			if record == nil || record.Status != tt.wantStatus {
+				t.Fatalf("record = %+v, want status %s", record, tt.wantStatus)
+			}
+			switch tt.wantStatus {
+			case IdempotencyStreaming:
+				if record.GenerationID != "gen-1" {
+					t.Errorf("GenerationID = %q", record.GenerationID)
+				}
+			case IdempotencyCompleted:
+				if record.StatusCode != http.StatusOK || string(record.Response) != `{"code":200}` {
+					t.Errorf("StatusCode = %d, Response = %s", record.StatusCode, record.Response)
+				}
+			}
+		})
+	}
+}
+
+func TestBeginIdempotencyScopes(t *testing.T) {
+	ctx := context.Background()
+	_, rdb := newTestRedis(t)
+	fingerprint := RequestFingerprint("x")
+
+	if idem, _, _ := BeginIdempotency(ctx, rdb, 1, "send", "k", fingerprint); idem == nil {
+		t.Fatal("首次请求应登记成功")
+	}
+	// 不同用户、不同接口的同名幂等键互不影响
+	if idem, _, _ := BeginIdempotency(ctx, rdb, 2, "send", "k", fingerprint); idem == nil {
+		t.Error("其他用户的同名幂等键应独立")
+	}
+	if idem, _, _ := BeginIdempotency(ctx, rdb, 1, "stream", "k", fingerprint); idem == nil {
+		t.Error("其他接口的同名幂等键应独立")
+	}
+}
+
+func TestBeginIdempotencyExpires(t *testing.T) {
+	t.Setenv("AI_STREAM_TIMEOUT_MS", "1000")
+	ctx := context.Background()
+	mr, rdb := newTestRedis(t)
+	fingerprint := RequestFingerprint("x")
+
+	if idem, _, _ := BeginIdempotency(ctx, rdb, 1, "send", "k", fingerprint); idem == nil {
+		t.Fatal("首次请求应登记成功")
+	}
+	// 处理中的记录在请求超时后过期，异常中断的请求可以重试
+	mr.FastForward(streamTTL() + time.Second)
+	if idem, _, _ := BeginIdempotency(ctx, rdb, 1, "send", "k", fingerprint); idem == nil {
+		t.Error("处理中的记录过期后应允许重试")
+	}
+}
+
+func TestBeginIdempotencyRedisDown(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	mr.Close()
+	idem, record, err := BeginIdempotency(context.Background(), rdb, 1, "send", "k", "f")
+	if idem != nil || record != nil || err != nil {
+		t.Errorf("Redis不可用时应按普通请求处理：idem=%v, record=%v, err=%v", idem, record, err)
+	}
+}
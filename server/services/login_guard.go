@@ -0,0 +1,204 @@
+// services 包
+// 登录防护：按用户名和IP统计连续失败次数，失败越多需要等待越久，达到阈值后暂时锁定
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"server/model" // 模型包，包含数据模型定义
+
+	"github.com/redis/go-redis/v9" // Redis客户端
+	"gorm.io/gorm"
+)
+
+const (
+	// 失败计数：login_fail:{user:用户名 或 ip:地址}，窗口内无失败时过期
+	loginFailKeyPrefix = "login_fail:%s"
+	// 下次允许尝试的等待：login_delay:{主体}，过期前的尝试直接拒绝
+	loginDelayKeyPrefix = "login_delay:%s"
+	// 锁定：login_lock:{主体}，过期后自动解除
+	loginLockKeyPrefix = "login_lock:%s"
+)
+
+// 记录一次失败：递增计数，超过 ARGV[2] 次后按指数增长设置等待，达到 ARGV[5] 次时锁定
+// 返回 {失败次数, 是否本次锁定, 等待毫秒数}
+var recordLoginFailureScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[1])
+local threshold = tonumber(ARGV[5])
+if threshold > 0 and count >= threshold then
+	local locked = redis.call("SET", KEYS[3], count, "PX", ARGV[6], "NX")
+	redis.call("DEL", KEYS[1], KEYS[2])
+	if locked then
+		return {count, 1, tonumber(ARGV[6])}
+	end
+	return {count, 0, redis.call("PTTL", KEYS[3])}
+end
+local after = tonumber(ARGV[2])
+if count <= after then
+	return {count, 0, 0}
+end
+local delay = tonumber(ARGV[3]) * 2 ^ (count - after - 1)
+if delay > tonumber(ARGV[4]) then
+	delay = tonumber(ARGV[4])
+end
+delay = math.floor(delay)
+redis.call("SET", KEYS[2], 1, "PX", delay)
+return {count, 0, delay}
+`)
+
+// LoginBlock 登录被拒绝的原因
+type LoginBlock struct {
+	Locked     bool          // 已锁定，否则为需要等待
+	RetryAfter time.Duration // 可以再次尝试的剩余时间
+}
+
+// loginGuardRule 单个主体（用户名或IP）的防护参数
+type loginGuardRule struct {
+	delayAfter int // 连续失败超过该次数后开始等待
+	threshold  int // 连续失败达到该次数后锁定，0为不锁定
+}
+
+// LoginGuard 登录防护，Redis不可用时放行
+type LoginGuard struct {
+	DB  *gorm.DB
+	RDB *redis.Client
+}
+
+func loginUserSubject(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+func loginIPSubject(ip string) string {
+	return "ip:" + ip
+}
+
+func loginUserRule() loginGuardRule {
+	return loginGuardRule{delayAfter: envInt("LOGIN_DELAY_AFTER", 3), threshold: envInt("LOGIN_LOCK_THRESHOLD", 10)}
+}
+
+// IP 可能被多个用户共享（如NAT），阈值高于单个用户名
+func loginIPRule() loginGuardRule {
+	return loginGuardRule{delayAfter: envInt("LOGIN_IP_DELAY_AFTER", 10), threshold: envInt("LOGIN_IP_LOCK_THRESHOLD", 50)}
+}
+
+/**
+ * Check 校验密码前检查是否允许本次登录尝试
+ * 用户名或IP处于锁定或等待中时返回 *LoginBlock，不再校验密码，避免对每次猜测都执行bcrypt
+ */
+func (g *LoginGuard) Check(ctx context.Context, username string, ip string) *LoginBlock {
+	subjects := []string{loginUserSubject(username), loginIPSubject(ip)}
+	pipe := g.RDB.Pipeline()
+	lockCmds := make([]*redis.DurationCmd, len(subjects))
+	delayCmds := make([]*redis.DurationCmd, len(subjects))
+	for i, subject := range subjects {
+		lockCmds[i] = pipe.PTTL(ctx, fmt.Sprintf(loginLockKeyPrefix, subject))
+		delayCmds[i] = pipe.PTTL(ctx, fmt.Sprintf(loginDelayKeyPrefix, subject))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("登录防护检查失败，放行本次请求：username=%s, ip=%s, err=%v", username, ip, err)
+		return nil
+	}
+
+	var block *LoginBlock
+	for i := range subjects {
+		if ttl := lockCmds[i].Val(); ttl > 0 && (block == nil || !block.Locked || ttl > block.RetryAfter) {
+			block = &LoginBlock{Locked: true, RetryAfter: ttl}
+		}
+	}
+	if block != nil {
+		return block
+	}
+	for i := range subjects {
+		if ttl := delayCmds[i].Val(); ttl > 0 && (block == nil || ttl > block.RetryAfter) {
+			block = &LoginBlock{RetryAfter: ttl}
+		}
+	}
+	return block
+}
+
+/**
+ * RecordFailure 记录一次登录失败，返回下一次尝试前需要等待的时间
+ * 用户名和IP分别计数；达到锁定阈值时写入审计记录，userID 为0表示用户名不存在
+ */
+func (g *LoginGuard) RecordFailure(ctx context.Context, userID uint, username string, ip string) *LoginBlock {
+	window := time.Duration(envInt("LOGIN_FAIL_WINDOW_MINUTES", 15)) * time.Minute
+	lockout := time.Duration(envInt("LOGIN_LOCKOUT_MINUTES", 15)) * time.Minute
+	baseDelay := envInt("LOGIN_DELAY_BASE_MS", 1000)
+	maxDelay := envInt("LOGIN_DELAY_MAX_MS", 30000)
+
+	var block *LoginBlock
+	for _, item := range []struct {
+		subject string
+		rule    loginGuardRule
+		event   string
+	}{
+		{loginUserSubject(username), loginUserRule(), model.AuditLoginLocked},
+		{loginIPSubject(ip), loginIPRule(), model.AuditIPLocked},
+	} {
+		keys := []string{
+			fmt.Sprintf(loginFailKeyPrefix, item.subject),
+			fmt.Sprintf(loginDelayKeyPrefix, item.subject),
+			fmt.Sprintf(loginLockKeyPrefix, item.subject),
+		}
+		result, err := recordLoginFailureScript.Run(ctx, g.RDB, keys,
+			window.Milliseconds(), item.rule.delayAfter, baseDelay, maxDelay, item.rule.threshold, lockout.Milliseconds()).Int64Slice()
+		if err != nil {
+			log.Printf("记录登录失败次数失败：subject=%s, err=%v", item.subject, err)
+			continue
+		}
+
+		count, locked, wait := result[0], result[1] == 1, time.Duration(result[2])*time.Millisecond
+		if locked {
+			log.Printf("连续登录失败，暂时锁定：subject=%s, count=%d", item.subject, count)
+			g.audit(userID, username, ip, item.event, fmt.Sprintf("连续失败%d次，锁定%s", count, lockout))
+		}
+		if wait > 0 && (block == nil || wait > block.RetryAfter) {
+			block = &LoginBlock{Locked: locked, RetryAfter: wait}
+		}
+	}
+	return block
+}
+
+// RecordSuccess 登录成功后清除该用户名的失败计数；IP的计数保留，避免攻击者用自己的账号重置
+func (g *LoginGuard) RecordSuccess(ctx context.Context, username string) {
+	subject := loginUserSubject(username)
+	if err := g.RDB.Del(ctx, fmt.Sprintf(loginFailKeyPrefix, subject), fmt.Sprintf(loginDelayKeyPrefix, subject)).Err(); err != nil {
+		log.Printf("清除登录失败次数失败：subject=%s, err=%v", subject, err)
+	}
+}
+
+// Unlock 解除用户名的锁定和等待，并写入审计记录；reason 说明解除方式
+func (g *LoginGuard) Unlock(ctx context.Context, userID uint, username string, ip string, reason string) error {
+	subject := loginUserSubject(username)
+	n, err := g.RDB.Del(ctx,
+		fmt.Sprintf(loginFailKeyPrefix, subject),
+		fmt.Sprintf(loginDelayKeyPrefix, subject),
+		fmt.Sprintf(loginLockKeyPrefix, subject),
+	).Result()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		g.audit(userID, username, ip, model.AuditLoginUnlocked, reason)
+	}
+	return nil
+}
+
+// audit 写入审计记录，失败时只记录日志
+func (g *LoginGuard) audit(userID uint, username string, ip string, event string, detail string) {
+	record := model.AuthAuditLog{
+		UserID:   userID,
+		Username: username,
+		IP:       ip,
+		Event:    event,
+		Detail:   detail,
+	}
+	if err := g.DB.Create(&record).Error; err != nil {
+		log.Printf("写入审计记录失败：event=%s, username=%s, err=%v", event, username, err)
+	}
+}
@@ -0,0 +1,159 @@
+// services 包
+// 邮件发送：MAIL_DRIVER 必须显式配置
+// smtp 通过SMTP发送；log 只写入日志并隐去链接中的令牌，file 写入 MAIL_LOG_DIR 下的文件，二者仅用于开发和测试
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mail 一封纯文本邮件
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+	Secrets []string // 正文中的令牌等敏感内容，写入日志时隐去
+}
+
+// redactedBody 隐去敏感内容后的正文
+func (m Mail) redactedBody() string {
+	body := m.Body
+	for _, secret := range m.Secrets {
+		if secret != "" {
+			body = strings.ReplaceAll(body, secret, "[已隐藏]")
+		}
+	}
+	return body
+}
+
+// Mailer 邮件发送方
+type Mailer interface {
+	Send(ctx context.Context, mail Mail) error
+}
+
+/**
+ * NewMailer 按 MAIL_DRIVER 创建邮件发送方，启动时调用，配置缺失或无效时返回错误
+ * 未配置时不回退到日志，避免生产环境遗漏配置后把重置密码链接写入日志；
+ * file 会保存完整的链接，GIN_MODE=release 时不允许使用
+ */
+func NewMailer() (Mailer, error) {
+	switch driver := strings.ToLower(os.Getenv("MAIL_DRIVER")); driver {
+	case "smtp":
+		mailer := &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     envInt("SMTP_PORT", 587),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		}
+		if mailer.Host == "" || mailer.From == "" {
+			return nil, fmt.Errorf("MAIL_DRIVER=smtp 时须配置 SMTP_HOST 和 MAIL_FROM")
+		}
+		return mailer, nil
+	case "log":
+		return &LogMailer{}, nil
+	case "file":
+		dir := os.Getenv("MAIL_LOG_DIR")
+		if dir == "" {
+			return nil, fmt.Errorf("MAIL_DRIVER=file 时须配置 MAIL_LOG_DIR")
+		}
+		if os.Getenv("GIN_MODE") == "release" {
+			return nil, fmt.Errorf("MAIL_DRIVER=file 仅用于开发和测试，GIN_MODE=release 时不可使用")
+		}
+		return &FileMailer{Dir: dir}, nil
+	case "":
+		return nil, fmt.Errorf("未配置 MAIL_DRIVER（smtp / log / file）")
+	default:
+		return nil, fmt.Errorf("不支持的 MAIL_DRIVER：%s", driver)
+	}
+}
+
+// SendMailAsync 在后台发送邮件，失败时只记录日志；接口不等待发送结果，也不因收件人是否存在而耗时不同
+func SendMailAsync(mailer Mailer, mail Mail) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := mailer.Send(ctx, mail); err != nil {
+			log.Printf("发送邮件失败：to=%s, subject=%s, err=%v", mail.To, mail.Subject, err)
+		}
+	}()
+}
+
+// formatMail 组装邮件原文
+func formatMail(from string, mail Mail) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", mail.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(mail.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// SMTPMailer 通过SMTP服务器发送，端口587使用STARTTLS（由 net/smtp 在服务器支持时自动启用）
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Mail) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	addr := net.JoinHostPort(m.Host, fmt.Sprint(m.Port))
+	// MAIL_FROM 可以带显示名（如 "MyChat <noreply@example.com>"），SMTP信封只使用地址部分
+	sender, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("MAIL_FROM 格式错误：%w", err)
+	}
+
+	// smtp.SendMail 不支持 context，在后台执行并在超时后返回
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(addr, auth, sender.Address, []string{msg.To}, formatMail(m.From, msg))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// LogMailer 不发送邮件，只写入日志；正文中的令牌被隐去，链接不可用
+type LogMailer struct{}
+
+func (m *LogMailer) Send(ctx context.Context, mail Mail) error {
+	log.Printf("邮件（未发送）：to=%s, subject=%s\n%s", mail.To, mail.Subject, mail.redactedBody())
+	return nil
+}
+
+// FileMailer 不发送邮件，每封邮件完整写入 Dir 下的一个 .eml 文件，用于本地开发和测试
+type FileMailer struct {
+	Dir string
+}
+
+func (m *FileMailer) Send(ctx context.Context, mail Mail) error {
+	if err := os.MkdirAll(m.Dir, 0o700); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405.000000"), NewStreamID()[:8])
+	return os.WriteFile(filepath.Join(m.Dir, name), formatMail("mychat@localhost", mail), 0o600)
+}
@@ -0,0 +1,253 @@
+// services 包
+// 确定性的模拟提供方，用于离线开发和测试
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"server/dto" // 数据传输对象，定义请求和响应结构
+)
+
+// MockReply 脚本模式下的一条预设回复
+type MockReply struct {
+	Content          string `json:"content"`
+	ReasoningContent string `json:"reasoning_content"`
+	FinishReason     string `json:"finish_reason"`
+}
+
+// MockProvider 模拟提供方，不访问网络
+// 回复内容、分片大小、延迟和故障注入均由 MOCK_* 环境变量控制，相同输入得到相同输出
+type MockProvider struct {
+	model          string
+	mode           string        // echo：回显用户消息；script：按顺序循环使用预设回复
+	script         []MockReply   // 脚本模式的预设回复
+	latency        time.Duration // 每个分片之间的延迟
+	chunkSize      int           // 每个分片包含的字符数
+	failEvery      int64         // 每第N次请求在开始输出前失败，0表示不注入
+	failAfterChunk int           // 输出N个分片后中断，0表示不注入
+
+	mu       sync.Mutex
+	requests map[uint]int64 // 按会话的请求计数，用于脚本轮转和故障注入
+}
+
+// NewMockProvider 从 MOCK_* 环境变量创建模拟提供方
+func NewMockProvider() *MockProvider {
+	p := &MockProvider{
+		model:          envOrDefault("MOCK_MODEL", "mock-echo"),
+		mode:           envOrDefault("MOCK_MODE", "echo"),
+		latency:        time.Duration(envInt("MOCK_LATENCY_MS", 20)) * time.Millisecond,
+		chunkSize:      envInt("MOCK_CHUNK_SIZE", 4),
+		failEvery:      int64(envInt("MOCK_FAIL_EVERY", 0)),
+		failAfterChunk: envInt("MOCK_FAIL_AFTER_CHUNKS", 0),
+		requests:       make(map[uint]int64),
+	}
+	if p.chunkSize <= 0 {
+		p.chunkSize = 4
+	}
+
+	if p.mode == "script" {
+		script, err := loadMockScript(os.Getenv("MOCK_SCRIPT_FILE"))
+		if err != nil {
+			log.Printf("加载模拟回复脚本失败，回退为回显模式：%v", err)
+			p.mode = "echo"
+		} else {
+			p.script = script
+		}
+	}
+	return p
+}
+
+// loadMockScript 读取JSON数组格式的预设回复
+func loadMockScript(path string) ([]MockReply, error) {
+	if path == "" {
+		return nil, fmt.Errorf("MOCK_SCRIPT_FILE 环境变量未设置")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var script []MockReply
+	if err := json.Unmarshal(data, &script); err != nil {
+		return nil, err
+	}
+	if len(script) == 0 {
+		return nil, fmt.Errorf("脚本中没有回复")
+	}
+	return script, nil
+}
+
+func (p *MockProvider) Name() string {
+	return "mock"
+}
+
+func (p *MockProvider) DefaultModel() string {
+	return p.model
+}
+
+// reply 根据请求序号和模式生成本次回复，序号从1开始；摘要调用的序号为0，始终回显
+func (p *MockProvider) reply(seq int64, req *ChatRequest) MockReply {
+	var reply MockReply
+	if p.mode == "script" && seq > 0 {
+		reply = p.script[(seq-1)%int64(len(p.script))]
+	} else {
+		lastUserContent := ""
+		for i := len(req.Messages) - 1; i >= 0; i-- {
+			if req.Messages[i].Role == "user" {
+				lastUserContent = req.Messages[i].Content
+				break
+			}
+		}
+		reply = MockReply{
+			Content:          "Echo: " + lastUserContent,
+			ReasoningContent: fmt.Sprintf("用户发送了 %d 个字符，直接回显。", len([]rune(lastUserContent))),
+		}
+	}
+
+	if !req.EnableThinking {
+		reply.ReasoningContent = ""
+	}
+	if reply.FinishReason == "" {
+		reply.FinishReason = "stop"
+	}
+	return reply
+}
+
+/**
+ * begin 记录一次请求并判断是否注入开始前故障
+ * 请求序号按会话分别计数，摘要调用不计数也不注入故障，
+ * 因此脚本轮转和 MOCK_FAIL_EVERY 只取决于被测会话自身发出的对话请求
+ */
+func (p *MockProvider) begin(req *ChatRequest) (int64, error) {
+	if req.Summary {
+		return 0, nil
+	}
+	p.mu.Lock()
+	p.requests[req.ConversationID]++
+	seq := p.requests[req.ConversationID]
+	p.mu.Unlock()
+
+	if p.failEvery > 0 && seq%p.failEvery == 0 {
+		return seq, &UpstreamError{
+			Provider:   p.Name(),
+			StatusCode: http.StatusServiceUnavailable,
+			Body:       fmt.Sprintf("模拟AI接口故障：会话 %d 的第 %d 次请求", req.ConversationID, seq),
+		}
+	}
+	return seq, nil
+}
+
+// usage 以字符数近似计算用量，保证结果确定
+func (p *MockProvider) usage(req *ChatRequest, reply MockReply) dto.UsageItem {
+	promptTokens := 0
+	for _, msg := range req.Messages {
+		promptTokens += len([]rune(msg.Content))
+	}
+	completionTokens := len([]rune(reply.Content)) + len([]rune(reply.ReasoningContent))
+	return dto.UsageItem{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+}
+
+func (p *MockProvider) Complete(ctx context.Context, req *ChatRequest) (*ChatResponse, error) {
+	seq, err := p.begin(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := sleepContext(ctx, p.latency); err != nil {
+		return nil, err
+	}
+
+	reply := p.reply(seq, req)
+	return &ChatResponse{
+		Provider:         p.Name(),
+		Model:            req.Model,
+		Content:          reply.Content,
+		ReasoningContent: reply.ReasoningContent,
+		FinishReason:     reply.FinishReason,
+		Usage:            p.usage(req, reply),
+	}, nil
+}
+
+func (p *MockProvider) Stream(ctx context.Context, req *ChatRequest, onDelta DeltaHandler) (*ChatResponse, error) {
+	seq, err := p.begin(req)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := p.reply(seq, req)
+	result := &ChatResponse{Provider: p.Name(), Model: req.Model}
+	contentBuffer := new(strings.Builder)
+	reasoningContentBuffer := new(strings.Builder)
+	chunks := 0
+
+	// 先输出推理内容，再输出正文，与真实模型的顺序一致
+	emit := func(text string, reasoning bool) error {
+		runes := []rune(text)
+		for start := 0; start < len(runes); start += p.chunkSize {
+			if p.failAfterChunk > 0 && chunks >= p.failAfterChunk {
+				return fmt.Errorf("模拟AI流式响应中断：已输出 %d 个分片", chunks)
+			}
+			if err := sleepContext(ctx, p.latency); err != nil {
+				return err
+			}
+
+			end := min(start+p.chunkSize, len(runes))
+			piece := string(runes[start:end])
+			delta := StreamDelta{}
+			if reasoning {
+				delta.ReasoningContent = piece
+				reasoningContentBuffer.WriteString(piece)
+			} else {
+				delta.Content = piece
+				contentBuffer.WriteString(piece)
+			}
+			chunks++
+			if err := onDelta(delta); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err = emit(reply.ReasoningContent, true)
+	if err == nil {
+		err = emit(reply.Content, false)
+	}
+	if err == nil {
+		result.FinishReason = reply.FinishReason
+		result.Usage = p.usage(req, reply)
+		err = onDelta(StreamDelta{FinishReason: reply.FinishReason})
+	}
+
+	result.Content = contentBuffer.String()
+	result.ReasoningContent = reasoningContentBuffer.String()
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// sleepContext 可被取消的等待
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,220 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"server/dto"
+)
+
+// newTestMockProvider 以给定的 MOCK_* 配置创建无延迟的模拟提供方
+func newTestMockProvider(t *testing.T, env map[string]string) *MockProvider {
+	t.Helper()
+	t.Setenv("MOCK_LATENCY_MS", "0")
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	return NewMockProvider()
+}
+
+func mockRequest(convID uint, content string) *ChatRequest {
+	return &ChatRequest{
+		Model:          "mock-echo",
+		ConversationID: convID,
+		Messages: []dto.Message{
+			{Role: "system", Content: "sys"},
+			{Role: "user", Content: content},
+		},
+	}
+}
+
+// streamAll 收集流式输出的全部分片
+func streamAll(p *MockProvider, req *ChatRequest) ([]StreamDelta, *ChatResponse, error) {
+	var deltas []StreamDelta
+	resp, err := p.Stream(context.Background(), req, func(delta StreamDelta) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	return deltas, resp, err
+}
+
+func TestMockProviderReply(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "script.json")
+	if err := os.WriteFile(script, []byte(`[{"content":"第一条"},{"content":"第二条","finish_reason":"length"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		env        map[string]string
+		want       []string
+		wantFinish []string
+	}{
+		{"回显最后一条用户消息", nil, []string{"Echo: 你好", "Echo: 你好"}, []string{"stop", "stop"}},
+		{
+			"脚本按顺序循环",
+			map[string]string{"MOCK_MODE": "script", "MOCK_SCRIPT_FILE": script},
+			[]string{"第一条", "第二条", "第一条"},
+			[]string{"stop", "length", "stop"},
+		},
+		{
+			"脚本无法加载时回退为回显",
+			map[string]string{"MOCK_MODE": "script", "MOCK_SCRIPT_FILE": ""},
+			[]string{"Echo: 你好"},
+			[]string{"stop"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestMockProvider(t, tt.env)
+			var got, finish []string
+			for range tt.want {
+				resp, err := p.Complete(context.Background(), mockRequest(1, "你好"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, resp.Content)
+				finish = append(finish, resp.FinishReason)
+			}
+			if !reflect.DeepEqual(got, tt.want) || !reflect.DeepEqual(finish, tt.wantFinish) {
+				t.Errorf("replies = %v %v, want %v %v", got, finish, tt.want, tt.wantFinish)
+			}
+		})
+	}
+
+	t.Run("关闭深度思考时不返回推理内容", func(t *testing.T) {
+		p := newTestMockProvider(t, nil)
+		req := mockRequest(1, "你好")
+		resp, _ := p.Complete(context.Background(), req)
+		if resp.ReasoningContent != "" {
+			t.Errorf("ReasoningContent = %q, want empty", resp.ReasoningContent)
+		}
+		req.EnableThinking = true
+		resp, _ = p.Complete(context.Background(), req)
+		if resp.ReasoningContent == "" {
+			t.Error("开启深度思考时应返回推理内容")
+		}
+	})
+
+	t.Run("用量按字符数计算", func(t *testing.T) {
+		p := newTestMockProvider(t, nil)
+		resp, _ := p.Complete(context.Background(), mockRequest(1, "你好"))
+		want := dto.UsageItem{PromptTokens: 5, CompletionTokens: 8, TotalTokens: 13}
+		if resp.Usage != want {
+			t.Errorf("Usage = %+v, want %+v", resp.Usage, want)
+		}
+	})
+}
+
+func TestMockProviderStreamChunks(t *testing.T) {
+	tests := []struct {
+		name      string
+		chunkSize string
+		thinking  bool
+		want      []StreamDelta
+	}{
+		{
+			"按字符分片并以结束原因收尾",
+			"4",
+			false,
+			[]StreamDelta{{Content: "Echo"}, {Content: ": 你好"}, {FinishReason: "stop"}},
+		},
+		{
+			"非法分片大小使用默认值",
+			"0",
+			false,
+			[]StreamDelta{{Content: "Echo"}, {Content: ": 你好"}, {FinishReason: "stop"}},
+		},
+		{
+			"先输出推理内容再输出正文",
+			"20",
+			true,
+			[]StreamDelta{{ReasoningContent: "用户发送了 2 个字符，直接回显。"}, {Content: "Echo: 你好"}, {FinishReason: "stop"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestMockProvider(t, map[string]string{"MOCK_CHUNK_SIZE": tt.chunkSize})
+			req := mockRequest(1, "你好")
+			req.EnableThinking = tt.thinking
+			deltas, resp, err := streamAll(p, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(deltas, tt.want) {
+				t.Errorf("deltas = %+v, want %+v", deltas, tt.want)
+			}
+			if resp.Content != "Echo: 你好" || resp.FinishReason != "stop" {
+				t.Errorf("resp = %+v", resp)
+			}
+		})
+	}
+}
+
+func TestMockProviderFailEvery(t *testing.T) {
+	p := newTestMockProvider(t, map[string]string{"MOCK_FAIL_EVERY": "3"})
+	call := func(req *ChatRequest) bool {
+		_, err := p.Complete(context.Background(), req)
+		var upstream *UpstreamError
+		if err != nil && (!errors.As(err, &upstream) || !IsRetryable(err)) {
+			t.Fatalf("err = %v, want retryable *UpstreamError", err)
+		}
+		return err != nil
+	}
+
+	summary := mockRequest(1, "摘要")
+	summary.Summary = true
+
+	// 两个会话的请求与摘要调用交替进行，各会话仍按自身的请求次数失败
+	var failed1, failed2 []bool
+	for i := 0; i < 6; i++ {
+		failed1 = append(failed1, call(mockRequest(1, "你好")))
+		if call(summary) {
+			t.Error("摘要调用不应注入故障")
+		}
+		failed2 = append(failed2, call(mockRequest(2, "你好")))
+	}
+	want := []bool{false, false, true, false, false, true}
+	if !reflect.DeepEqual(failed1, want) || !reflect.DeepEqual(failed2, want) {
+		t.Errorf("failed = %v / %v, want %v", failed1, failed2, want)
+	}
+
+	t.Run("流式请求在开始输出前失败", func(t *testing.T) {
+		p := newTestMockProvider(t, map[string]string{"MOCK_FAIL_EVERY": "1"})
+		deltas, resp, err := streamAll(p, mockRequest(1, "你好"))
+		if err == nil || resp != nil || len(deltas) != 0 {
+			t.Errorf("deltas = %v, resp = %v, err = %v", deltas, resp, err)
+		}
+	})
+}
+
+func TestMockProviderFailAfterChunks(t *testing.T) {
+	p := newTestMockProvider(t, map[string]string{"MOCK_CHUNK_SIZE": "2", "MOCK_FAIL_AFTER_CHUNKS": "2"})
+	deltas, resp, err := streamAll(p, mockRequest(1, "你好"))
+	if err == nil {
+		t.Fatal("want error")
+	}
+	if IsRetryable(err) {
+		t.Errorf("开始输出后的中断不应重试：%v", err)
+	}
+	if want := []StreamDelta{{Content: "Ec"}, {Content: "ho"}}; !reflect.DeepEqual(deltas, want) {
+		t.Errorf("deltas = %+v, want %+v", deltas, want)
+	}
+	// 中断时返回已输出的部分，供调用方保存
+	if resp == nil || resp.Content != "Echo" || resp.FinishReason != "" {
+		t.Errorf("resp = %+v, want partial content", resp)
+	}
+}
+
+func TestMockProviderCancel(t *testing.T) {
+	p := newTestMockProvider(t, map[string]string{"MOCK_LATENCY_MS": "1000"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.Complete(ctx, mockRequest(1, "你好")); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,152 @@
+// services 包
+// 本地 Ollama 提供方
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"server/dto" // 数据传输对象，定义请求和响应结构
+)
+
+// OllamaProvider 本地 Ollama /api/chat 提供方
+type OllamaProvider struct {
+	apiURL string
+	model  string
+	client *http.Client
+}
+
+// NewOllamaProvider 从 OLLAMA_* 环境变量创建提供方
+func NewOllamaProvider() *OllamaProvider {
+	return &OllamaProvider{
+		apiURL: envOrDefault("OLLAMA_API_URL", "http://localhost:11434/api/chat"),
+		model:  os.Getenv("OLLAMA_MODEL"),
+		client: defaultHTTPClient(),
+	}
+}
+
+func (p *OllamaProvider) Name() string {
+	return "ollama"
+}
+
+func (p *OllamaProvider) DefaultModel() string {
+	return p.model
+}
+
+func (p *OllamaProvider) buildBody(req *ChatRequest, stream bool) dto.OllamaRequest {
+	body := dto.OllamaRequest{
+		Model:    req.Model,
+		Messages: req.Messages,
+		Stream:   stream,
+		Think:    req.EnableThinking,
+	}
+	if req.Temperature != nil || req.TopP != nil || req.MaxTokens != nil {
+		body.Options = &dto.OllamaOptions{
+			Temperature: req.Temperature,
+			TopP:        req.TopP,
+			NumPredict:  req.MaxTokens,
+		}
+	}
+	return body
+}
+
+// usageOf 将 Ollama 的计数字段转换为统一用量结构
+func (p *OllamaProvider) usageOf(resp *dto.OllamaResponse) dto.UsageItem {
+	return dto.UsageItem{
+		PromptTokens:     resp.PromptEvalCount,
+		CompletionTokens: resp.EvalCount,
+		TotalTokens:      resp.PromptEvalCount + resp.EvalCount,
+	}
+}
+
+func (p *OllamaProvider) Complete(ctx context.Context, req *ChatRequest) (*ChatResponse, error) {
+	resp, err := postJSON(ctx, p.Name(), p.client, p.apiURL, nil, p.buildBody(req, false))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ollamaResp dto.OllamaResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ollamaResp); err != nil {
+		log.Printf("解析响应体失败：%v", err)
+		return nil, err
+	}
+	if ollamaResp.Error != "" {
+		return nil, fmt.Errorf("AI接口返回错误：%s", ollamaResp.Error)
+	}
+
+	return &ChatResponse{
+		Provider:         p.Name(),
+		Model:            req.Model,
+		Content:          ollamaResp.Message.Content,
+		ReasoningContent: ollamaResp.Message.Thinking,
+		FinishReason:     ollamaResp.DoneReason,
+		Usage:            p.usageOf(&ollamaResp),
+	}, nil
+}
+
+func (p *OllamaProvider) Stream(ctx context.Context, req *ChatRequest, onDelta DeltaHandler) (*ChatResponse, error) {
+	resp, err := postJSON(ctx, p.Name(), p.client, p.apiURL, nil, p.buildBody(req, true))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &ChatResponse{Provider: p.Name(), Model: req.Model}
+	contentBuffer := new(strings.Builder)
+	reasoningContentBuffer := new(strings.Builder)
+
+	// Ollama 流式响应为每行一个 JSON 对象
+	scanner := newLineScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var chunk dto.OllamaResponse
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			log.Printf("解析AI分片失败：%v, 数据：%s", err, string(line))
+			continue
+		}
+		if chunk.Error != "" {
+			err = fmt.Errorf("AI接口返回错误：%s", chunk.Error)
+			break
+		}
+
+		delta := StreamDelta{
+			Content:          chunk.Message.Content,
+			ReasoningContent: chunk.Message.Thinking,
+		}
+		if chunk.Done {
+			delta.FinishReason = chunk.DoneReason
+			result.FinishReason = chunk.DoneReason
+			result.Usage = p.usageOf(&chunk)
+		}
+		if delta.Content == "" && delta.ReasoningContent == "" && delta.FinishReason == "" {
+			continue
+		}
+
+		contentBuffer.WriteString(delta.Content)
+		reasoningContentBuffer.WriteString(delta.ReasoningContent)
+		if err = onDelta(delta); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = scanner.Err()
+	}
+
+	result.Content = contentBuffer.String()
+	result.ReasoningContent = reasoningContentBuffer.String()
+	if err != nil {
+		log.Printf("读取AI流式响应失败：%v", err)
+		return result, err
+	}
+	return result, nil
+}
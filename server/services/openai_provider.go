@@ -0,0 +1,182 @@
+// services 包
+// OpenAI 兼容接口提供方（DashScope/通义千问兼容模式等）
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"server/dto" // 数据传输对象，定义请求和响应结构
+)
+
+// OpenAIProvider OpenAI 兼容接口提供方，沿用 AI_MODEL/AI_API_URL/AI_API_KEY 配置
+type OpenAIProvider struct {
+	apiURL string
+	apiKey string
+	model  string
+	client *http.Client
+}
+
+// NewOpenAIProvider 从环境变量创建 OpenAI 兼容提供方
+func NewOpenAIProvider() *OpenAIProvider {
+	return &OpenAIProvider{
+		apiURL: os.Getenv("AI_API_URL"),
+		apiKey: os.Getenv("AI_API_KEY"),
+		model:  os.Getenv("AI_MODEL"),
+		client: defaultHTTPClient(),
+	}
+}
+
+func (p *OpenAIProvider) Name() string {
+	return "openai"
+}
+
+func (p *OpenAIProvider) DefaultModel() string {
+	return p.model
+}
+
+// checkConfig 检查环境变量配置
+func (p *OpenAIProvider) checkConfig() error {
+	if p.apiKey == "" {
+		return fmt.Errorf("AI_API_KEY 环境变量未设置")
+	}
+	if p.apiURL == "" {
+		return fmt.Errorf("AI_API_URL 环境变量未设置")
+	}
+	return nil
+}
+
+func (p *OpenAIProvider) buildBody(req *ChatRequest, stream bool) dto.RequestBody {
+	body := dto.RequestBody{
+		Model:          req.Model,
+		Messages:       req.Messages,
+		Stream:         stream,
+		EnableThinking: req.EnableThinking,
+		EnableSearch:   req.EnableSearch,
+		Temperature:    req.Temperature,
+		TopP:           req.TopP,
+		MaxTokens:      req.MaxTokens,
+	}
+	if stream {
+		body.ResultFormat = "message"
+		body.IncrementalOutput = true
+		body.StreamOptions = &dto.StreamOptions{IncludeUsage: true}
+	}
+	return body
+}
+
+func (p *OpenAIProvider) headers(stream bool) map[string]string {
+	// 新加坡和北京地域的API Key不同。获取API Key：https://help.aliyun.com/model-studio/get-api-key
+	headers := map[string]string{"Authorization": "Bearer " + p.apiKey}
+	if stream {
+		headers["Accept"] = "text/event-stream"
+	}
+	return headers
+}
+
+func (p *OpenAIProvider) Complete(ctx context.Context, req *ChatRequest) (*ChatResponse, error) {
+	if err := p.checkConfig(); err != nil {
+		return nil, err
+	}
+
+	resp, err := postJSON(ctx, p.Name(), p.client, p.apiURL, p.headers(false), p.buildBody(req, false))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	bodyText, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("读取响应体失败：%v", err)
+		return nil, err
+	}
+
+	var qwenResp dto.QwenResponse
+	if err := json.Unmarshal(bodyText, &qwenResp); err != nil {
+		log.Printf("解析响应体失败：%v", err)
+		return nil, err
+	}
+	if len(qwenResp.Choices) == 0 {
+		return nil, fmt.Errorf("AI未返回有效内容")
+	}
+
+	result := &ChatResponse{
+		Provider:     p.Name(),
+		Model:        req.Model,
+		Content:      qwenResp.Choices[0].Message.Content,
+		FinishReason: qwenResp.Choices[0].FinishReason,
+		Usage:        qwenResp.Usage,
+	}
+	if qwenResp.Model != "" {
+		result.Model = qwenResp.Model
+	}
+	return result, nil
+}
+
+func (p *OpenAIProvider) Stream(ctx context.Context, req *ChatRequest, onDelta DeltaHandler) (*ChatResponse, error) {
+	if err := p.checkConfig(); err != nil {
+		return nil, err
+	}
+
+	resp, err := postJSON(ctx, p.Name(), p.client, p.apiURL, p.headers(true), p.buildBody(req, true))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &ChatResponse{Provider: p.Name(), Model: req.Model}
+	contentBuffer := new(strings.Builder)
+	reasoningContentBuffer := new(strings.Builder)
+
+	err = scanSSE(resp.Body, func(_ string, dataStr string) error {
+		if dataStr == "[DONE]" {
+			return nil
+		}
+
+		var chunk dto.QwenStreamChunk
+		if err := json.Unmarshal([]byte(dataStr), &chunk); err != nil {
+			log.Printf("解析AI分片失败：%v, 数据：%s", err, dataStr)
+			return nil
+		}
+		if chunk.Usage != nil {
+			result.Usage = *chunk.Usage
+		}
+		if chunk.Model != "" {
+			result.Model = chunk.Model
+		}
+		if len(chunk.Choices) == 0 {
+			return nil
+		}
+
+		choice := chunk.Choices[0]
+		delta := StreamDelta{
+			Content:          choice.Delta.Content,
+			ReasoningContent: choice.Delta.ReasoningContent,
+		}
+		if choice.FinishReason != nil {
+			delta.FinishReason = *choice.FinishReason
+			result.FinishReason = delta.FinishReason
+		}
+		if delta.Content == "" && delta.ReasoningContent == "" && delta.FinishReason == "" {
+			return nil
+		}
+
+		contentBuffer.WriteString(delta.Content)
+		reasoningContentBuffer.WriteString(delta.ReasoningContent)
+		return onDelta(delta)
+	})
+
+	result.Content = contentBuffer.String()
+	result.ReasoningContent = reasoningContentBuffer.String()
+	if err != nil {
+		log.Printf("读取AI流式响应失败：%v", err)
+		return result, err
+	}
+	return result, nil
+}
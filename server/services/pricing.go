@@ -0,0 +1,63 @@
+// services 包
+// 模型计价：根据用量计算单次请求费用
+package services
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"server/dto"   // 数据传输对象，定义请求和响应结构
+	"server/utils" // 工具包，包含token估算
+)
+
+// ModelPrice 模型单价，单位为每千token
+type ModelPrice struct {
+	Input  float64
+	Output float64
+}
+
+// LookupModelPrice 读取模型单价
+// 通过 MODEL_PRICING="qwen-plus:0.0008:0.002,qwen-turbo:0.0003:0.0006" 配置输入/输出单价，未配置的模型不计费
+func LookupModelPrice(model string) (ModelPrice, bool) {
+	for _, item := range strings.Split(os.Getenv("MODEL_PRICING"), ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) != 3 || parts[0] != model {
+			continue
+		}
+		input, err1 := strconv.ParseFloat(parts[1], 64)
+		output, err2 := strconv.ParseFloat(parts[2], 64)
+		if err1 != nil || err2 != nil {
+			log.Printf("MODEL_PRICING 配置格式错误：%s", item)
+			return ModelPrice{}, false
+		}
+		return ModelPrice{Input: input, Output: output}, true
+	}
+	return ModelPrice{}, false
+}
+
+// CalculateCost 按模型单价计算费用
+func CalculateCost(model string, usage dto.UsageItem) float64 {
+	price, ok := LookupModelPrice(model)
+	if !ok {
+		return 0
+	}
+	return (float64(usage.PromptTokens)*price.Input + float64(usage.CompletionTokens)*price.Output) / 1000
+}
+
+// fillUsage 补全回复的用量与费用，提供方未返回用量时按估算值记录
+func fillUsage(req *ChatRequest, resp *ChatResponse) {
+	if resp.Usage.TotalTokens == 0 {
+		if resp.Usage.PromptTokens == 0 {
+			for _, msg := range req.Messages {
+				resp.Usage.PromptTokens += utils.EstimateMessageTokens(msg.Role, msg.Content)
+			}
+		}
+		if resp.Usage.CompletionTokens == 0 {
+			resp.Usage.CompletionTokens = utils.EstimateTokens(resp.Content) + utils.EstimateTokens(resp.ReasoningContent)
+		}
+		resp.Usage.TotalTokens = resp.Usage.PromptTokens + resp.Usage.CompletionTokens
+	}
+	resp.Cost = CalculateCost(resp.Model, resp.Usage)
+}
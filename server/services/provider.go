@@ -0,0 +1,269 @@
+// services 包
+// ChatProvider 大模型提供方抽象及注册表
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"server/dto" // 数据传输对象，定义请求和响应结构
+)
+
+// ChatRequest 与具体提供方无关的对话请求
+type ChatRequest struct {
+	Provider       string        // 提供方名称，为空时使用默认提供方
+	Model          string        // 模型名称，为空时使用提供方默认模型
+	Messages       []dto.Message // 完整上下文（含system消息）
+	EnableThinking bool          // 是否开启深度思考
+	EnableSearch   bool          // 是否开启联网搜索
+	Temperature    *float64      // 采样温度，为空时使用提供方默认值
+	TopP           *float64      // 核采样概率，为空时使用提供方默认值
+	MaxTokens      *int          // 最大输出token数，为空时使用提供方默认值
+	Fallbacks      []ModelTarget // 降级链，为 nil 时使用全局 AI_FALLBACKS
+	ConversationID uint          // 所属会话，0表示不关联会话
+	Summary        bool          // 是否为滚动摘要调用
+}
+
+// ChatResponse 一次完整的模型回复
+type ChatResponse struct {
+	Provider         string        `json:"provider"`
+	Model            string        `json:"model"`
+	Content          string        `json:"content"`
+	ReasoningContent string        `json:"reasoning_content"`
+	FinishReason     string        `json:"finish_reason"`
+	Usage            dto.UsageItem `json:"usage"`
+	Cost             float64       `json:"cost"`           // 按 MODEL_PRICING 计算的费用
+	LatencyMs        int64         `json:"latency_ms"`     // 从发起请求到回复结束的耗时
+	Trim             *TrimReport   `json:"trim,omitempty"` // 上下文裁剪结果，未裁剪时为空
+}
+
+// StreamDelta 流式输出中的一个增量分片
+type StreamDelta struct {
+	Content          string
+	ReasoningContent string
+	FinishReason     string
+	Trim             *TrimReport // 发送前的上下文裁剪结果，仅在开始输出前出现一次
+}
+
+// DeltaHandler 处理流式分片的回调，返回错误时终止读取
+type DeltaHandler func(delta StreamDelta) error
+
+// ChatProvider 大模型提供方接口
+type ChatProvider interface {
+	// Name 提供方名称，用于注册和选择
+	Name() string
+	// DefaultModel 未指定模型时使用的模型
+	DefaultModel() string
+	// Complete 阻塞式获取完整回复
+	Complete(ctx context.Context, req *ChatRequest) (*ChatResponse, error)
+	// Stream 流式获取回复，每个分片回调一次，结束后返回聚合结果；出错时同时返回已收到的部分内容
+	Stream(ctx context.Context, req *ChatRequest, onDelta DeltaHandler) (*ChatResponse, error)
+}
+
+var (
+	providersMu sync.RWMutex
+	providers   = map[string]ChatProvider{}
+)
+
+// RegisterProvider 注册提供方，同名提供方会被覆盖
+func RegisterProvider(p ChatProvider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[p.Name()] = p
+}
+
+// GetProvider 按名称获取提供方，名称为空时返回默认提供方
+func GetProvider(name string) (ChatProvider, error) {
+	if name == "" {
+		name = DefaultProviderName()
+	}
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	p, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("未注册的AI提供方：%s", name)
+	}
+	return p, nil
+}
+
+// ProviderNames 返回已注册的提供方名称
+func ProviderNames() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DefaultProviderName 默认提供方，由 AI_PROVIDER 指定，默认为 openai
+func DefaultProviderName() string {
+	if name := os.Getenv("AI_PROVIDER"); name != "" {
+		return name
+	}
+	return "openai"
+}
+
+// InitProviders 根据环境变量注册内置提供方
+func InitProviders() {
+	RegisterProvider(NewOpenAIProvider())
+	RegisterProvider(NewAnthropicProvider())
+	RegisterProvider(NewOllamaProvider())
+	RegisterProvider(NewMockProvider())
+	log.Printf("AI提供方注册完成：%v，默认：%s", ProviderNames(), DefaultProviderName())
+}
+
+// resolve 选择提供方并补全模型名称
+func resolve(req *ChatRequest) (ChatProvider, *ChatRequest, error) {
+	p, err := GetProvider(req.Provider)
+	if err != nil {
+		return nil, nil, err
+	}
+	resolved := *req
+	resolved.Provider = p.Name()
+	if resolved.Model == "" {
+		resolved.Model = p.DefaultModel()
+	}
+	if resolved.Model == "" {
+		return nil, nil, fmt.Errorf("AI提供方 %s 未配置模型", p.Name())
+	}
+	return p, &resolved, nil
+}
+
+/**
+ * postJSON 发送JSON请求，状态码非200时返回 *UpstreamError
+ * 网络错误、429 和 5xx 在收到响应体之前按指数退避重试，最多 AI_RETRY_MAX 次，优先遵循 Retry-After；
+ * 流式调用在此返回后才开始读取分片，因此重试不会导致重复输出
+ */
+func postJSON(ctx context.Context, provider string, client *http.Client, url string, headers map[string]string, body interface{}) (*http.Response, error) {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("JSON序列化失败：%v", err)
+		return nil, err
+	}
+
+	// 请求体含完整的对话内容，只记录大小
+	log.Printf("发送AI请求：provider=%s, bytes=%d", provider, len(jsonData))
+
+	maxRetries := max(envInt("AI_RETRY_MAX", 2), 0)
+	for attempt := 0; ; attempt++ {
+		resp, err := doPostJSON(ctx, provider, client, url, headers, jsonData)
+		if err == nil {
+			return resp, nil
+		}
+		if attempt >= maxRetries || !IsRetryable(err) || ctx.Err() != nil {
+			return nil, err
+		}
+
+		wait := retryBackoff(attempt, err)
+		log.Printf("AI请求失败，%v 后第 %d 次重试：provider=%s, err=%v", wait, attempt+1, provider, err)
+		if err := sleepContext(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// doPostJSON 发送一次JSON请求
+func doPostJSON(ctx context.Context, provider string, client *http.Client, url string, headers map[string]string, jsonData []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(jsonData))
+	if err != nil {
+		log.Printf("创建HTTP请求失败：%v", err)
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("发送HTTP请求失败：%v", err)
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		errBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		log.Printf("请求失败：%s, 响应：%s", resp.Status, string(errBody))
+		return nil, &UpstreamError{
+			Provider:   provider,
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			Body:       string(errBody),
+		}
+	}
+	return resp, nil
+}
+
+// newLineScanner 创建按行读取响应体的扫描器，放大缓冲区以容纳较长的分片
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	return scanner
+}
+
+// scanSSE 逐条解析SSE事件，回调参数为 event 名称和 data 内容
+func scanSSE(r io.Reader, onEvent func(event, data string) error) error {
+	scanner := newLineScanner(r)
+	event := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			event = ""
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(line[6:])
+		case strings.HasPrefix(line, "data:"):
+			if err := onEvent(event, strings.TrimSpace(line[5:])); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// envOrDefault 读取环境变量，为空时返回默认值
+func envOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt 读取整数环境变量，为空或格式错误时返回默认值
+func envInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+// defaultHTTPClient 提供方使用的HTTP客户端
+// 只限制建立连接（AI_CONNECT_TIMEOUT_MS）和等待响应头（AI_RESPONSE_HEADER_TIMEOUT_MS）的时间，
+// 整体耗时由调用方的 context 控制，避免截断较长的流式输出
+func defaultHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   time.Duration(envInt("AI_CONNECT_TIMEOUT_MS", 10000)) * time.Millisecond,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.ResponseHeaderTimeout = time.Duration(envInt("AI_RESPONSE_HEADER_TIMEOUT_MS", 60000)) * time.Millisecond
+	return &http.Client{Transport: transport}
+}
@@ -0,0 +1,372 @@
+// services 包
+// 用户额度：按日/按月限制token用量和请求次数
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/model" // 模型包，包含数据模型定义
+
+	"github.com/redis/go-redis/v9" // Redis客户端
+	"gorm.io/gorm"                 // GORM数据库框架
+)
+
+const (
+	// 额度计数Key：quota:{userID}:day:{20060102} / quota:{userID}:month:{200601}，Hash字段为 tokens、requests
+	quotaDayKeyPrefix   = "quota:%d:day:%s"
+	quotaMonthKeyPrefix = "quota:%d:month:%s"
+)
+
+// 仅在计数已加载时累加 ARGV[1] 个token、ARGV[2] 次请求，未加载时由下次检查从MySQL重新统计
+var quotaIncrScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	redis.call("HINCRBY", KEYS[1], "tokens", ARGV[1])
+	redis.call("HINCRBY", KEYS[1], "requests", ARGV[2])
+end
+return 1
+`)
+
+// 计数未加载时写入从MySQL统计的值，已存在则保持不变
+var quotaLoadScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	redis.call("HSET", KEYS[1], "tokens", ARGV[1], "requests", ARGV[2])
+	redis.call("EXPIRE", KEYS[1], ARGV[3])
+end
+return redis.call("HMGET", KEYS[1], "tokens", "requests")
+`)
+
+// 预占额度：任一周期的请求次数或token（含进行中请求的预占）加上本次预占后超过上限时拒绝，
+// 否则两个周期同时累加 ARGV[1] 个token和1次请求；计数须已加载
+// ARGV[2..5] 依次为每日token、每日请求、每月token、每月请求上限，0 表示不限
+// 返回 {0} 表示成功，{周期序号, 类型(1为token，2为请求), 已用量} 表示超限
+var quotaReserveScript = redis.NewScript(`
+for i, key in ipairs(KEYS) do
+	local tokenLimit = tonumber(ARGV[i * 2])
+	local requestLimit = tonumber(ARGV[i * 2 + 1])
+	local tokens = tonumber(redis.call("HGET", key, "tokens")) or 0
+	local requests = tonumber(redis.call("HGET", key, "requests")) or 0
+	if requestLimit > 0 and requests + 1 > requestLimit then
+		return {i, 2, requests}
+	end
+	if tokenLimit > 0 and tokens + tonumber(ARGV[1]) > tokenLimit then
+		return {i, 1, tokens}
+	end
+end
+for _, key in ipairs(KEYS) do
+	redis.call("HINCRBY", key, "tokens", ARGV[1])
+	redis.call("HINCRBY", key, "requests", 1)
+end
+return {0}
+`)
+
+// QuotaLimits 生效的限额，0 表示不限
+type QuotaLimits struct {
+	Plan            string `json:"plan"`
+	DailyTokens     int64  `json:"daily_tokens"`
+	MonthlyTokens   int64  `json:"monthly_tokens"`
+	DailyRequests   int64  `json:"daily_requests"`
+	MonthlyRequests int64  `json:"monthly_requests"`
+}
+
+// QuotaUsage 当前周期内的已用量
+type QuotaUsage struct {
+	DailyTokens     int64 `json:"daily_tokens"`
+	MonthlyTokens   int64 `json:"monthly_tokens"`
+	DailyRequests   int64 `json:"daily_requests"`
+	MonthlyRequests int64 `json:"monthly_requests"`
+}
+
+// QuotaStatus 额度查询结果，Remaining 中 -1 表示不限
+type QuotaStatus struct {
+	Limits         QuotaLimits `json:"limits"`
+	Used           QuotaUsage  `json:"used"`
+	Remaining      QuotaUsage  `json:"remaining"`
+	DailyResetAt   time.Time   `json:"daily_reset_at"`
+	MonthlyResetAt time.Time   `json:"monthly_reset_at"`
+}
+
+// QuotaExceededError 额度超限错误
+type QuotaExceededError struct {
+	Period  string    `json:"period"` // daily / monthly
+	Kind    string    `json:"kind"`   // tokens / requests
+	Limit   int64     `json:"limit"`
+	Used    int64     `json:"used"`
+	ResetAt time.Time `json:"reset_at"`
+}
+
+func (e *QuotaExceededError) Error() string {
+	period := "今日"
+	if e.Period == "monthly" {
+		period = "本月"
+	}
+	kind := "token额度"
+	if e.Kind == "requests" {
+		kind = "请求次数"
+	}
+	if e.Used < e.Limit {
+		// 预占时剩余额度不足以容纳本次请求的预估用量
+		return fmt.Sprintf("%s%s剩余不足（%d/%d）", period, kind, e.Used, e.Limit)
+	}
+	return fmt.Sprintf("%s%s已用尽（%d/%d）", period, kind, e.Used, e.Limit)
+}
+
+// QuotaService 额度服务，计数存于Redis，MySQL中的AI消息用量和其他调用的用量记录（model.UsageRecord）为持久记录
+type QuotaService struct {
+	DB  *gorm.DB
+	RDB *redis.Client
+}
+
+// planLimits 读取套餐默认限额
+// 通过 QUOTA_PLANS="free:200000:3000000:200:3000,pro:0:0:0:0" 配置，
+// 依次为每日token、每月token、每日请求、每月请求，未配置的套餐不限
+func planLimits(plan string) QuotaLimits {
+	limits := QuotaLimits{Plan: plan}
+	for _, item := range strings.Split(os.Getenv("QUOTA_PLANS"), ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) != 5 || parts[0] != plan {
+			continue
+		}
+		values := make([]int64, 4)
+		for i, part := range parts[1:] {
+			v, err := strconv.ParseInt(part, 10, 64)
+			if err != nil {
+				log.Printf("QUOTA_PLANS 配置格式错误：%s", item)
+				return limits
+			}
+			values[i] = v
+		}
+		limits.DailyTokens, limits.MonthlyTokens = values[0], values[1]
+		limits.DailyRequests, limits.MonthlyRequests = values[2], values[3]
+		return limits
+	}
+	return limits
+}
+
+// Limits 获取用户生效的限额：用户配置覆盖套餐默认值
+func (qs *QuotaService) Limits(uid uint) (QuotaLimits, error) {
+	var quota model.UserQuota
+	err := qs.DB.Where("user_id = ?", uid).First(&quota).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return QuotaLimits{}, err
+	}
+
+	plan := quota.Plan
+	if plan == "" {
+		plan = envOrDefault("QUOTA_DEFAULT_PLAN", "free")
+	}
+	limits := planLimits(plan)
+	if quota.DailyTokenLimit != nil {
+		limits.DailyTokens = *quota.DailyTokenLimit
+	}
+	if quota.MonthlyTokenLimit != nil {
+		limits.MonthlyTokens = *quota.MonthlyTokenLimit
+	}
+	if quota.DailyRequestLimit != nil {
+		limits.DailyRequests = *quota.DailyRequestLimit
+	}
+	if quota.MonthlyRequestLimit != nil {
+		limits.MonthlyRequests = *quota.MonthlyRequestLimit
+	}
+	return limits, nil
+}
+
+// periodBounds 返回当日和当月的起止时间
+func periodBounds(now time.Time) (dayStart, dayEnd, monthStart, monthEnd time.Time) {
+	dayStart = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	monthStart = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	return dayStart, dayStart.AddDate(0, 0, 1), monthStart, monthStart.AddDate(0, 1, 0)
+}
+
+// loadPeriod 读取周期计数，Redis未加载时从MySQL统计该周期内的AI消息用量，摘要等调用的token一并计入
+func (qs *QuotaService) loadPeriod(ctx context.Context, key string, uid uint, start, end time.Time) (int64, int64, error) {
+	exists, err := qs.RDB.Exists(ctx, key).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var tokens, requests int64
+	if exists == 0 {
+		var stat struct {
+			Tokens   int64
+			Requests int64
+		}
+		if err := qs.DB.Unscoped().Model(&model.Message{}).
+			Select("COALESCE(SUM(total_tokens), 0) AS tokens, COUNT(*) AS requests").
+			Where("user_id = ? AND message_role = ? AND source_id = 0 AND created_at >= ? AND created_at < ?",
+				uid, model.MessageRoleAI, start, end).
+			Scan(&stat).Error; err != nil {
+			return 0, 0, err
+		}
+		var recordTokens int64
+		if err := qs.DB.Model(&model.UsageRecord{}).
+			Select("COALESCE(SUM(total_tokens), 0)").
+			Where("user_id = ? AND created_at >= ? AND created_at < ?", uid, start, end).
+			Scan(&recordTokens).Error; err != nil {
+			return 0, 0, err
+		}
+		tokens, requests = stat.Tokens+recordTokens, stat.Requests
+	}
+
+	// 过期时间延后一天，避免周期边界处计数提前失效
+	ttl := int64(time.Until(end).Seconds()) + 86400
+	values, err := quotaLoadScript.Run(ctx, qs.RDB, []string{key}, tokens, requests, ttl).Slice()
+	if err != nil {
+		return 0, 0, err
+	}
+	tokens, _ = strconv.ParseInt(fmt.Sprint(values[0]), 10, 64)
+	requests, _ = strconv.ParseInt(fmt.Sprint(values[1]), 10, 64)
+	return tokens, requests, nil
+}
+
+func (qs *QuotaService) keys(uid uint, now time.Time) (string, string) {
+	return fmt.Sprintf(quotaDayKeyPrefix, uid, now.Format("20060102")),
+		fmt.Sprintf(quotaMonthKeyPrefix, uid, now.Format("200601"))
+}
+
+// Status 查询用户额度及剩余量
+func (qs *QuotaService) Status(ctx context.Context, uid uint) (*QuotaStatus, error) {
+	limits, err := qs.Limits(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	dayStart, dayEnd, monthStart, monthEnd := periodBounds(now)
+	dayKey, monthKey := qs.keys(uid, now)
+
+	status := &QuotaStatus{Limits: limits, DailyResetAt: dayEnd, MonthlyResetAt: monthEnd}
+	if status.Used.DailyTokens, status.Used.DailyRequests, err = qs.loadPeriod(ctx, dayKey, uid, dayStart, dayEnd); err != nil {
+		return nil, err
+	}
+	if status.Used.MonthlyTokens, status.Used.MonthlyRequests, err = qs.loadPeriod(ctx, monthKey, uid, monthStart, monthEnd); err != nil {
+		return nil, err
+	}
+
+	remaining := func(limit, used int64) int64 {
+		if limit <= 0 {
+			return -1
+		}
+		return max(limit-used, 0)
+	}
+	status.Remaining = QuotaUsage{
+		DailyTokens:     remaining(limits.DailyTokens, status.Used.DailyTokens),
+		MonthlyTokens:   remaining(limits.MonthlyTokens, status.Used.MonthlyTokens),
+		DailyRequests:   remaining(limits.DailyRequests, status.Used.DailyRequests),
+		MonthlyRequests: remaining(limits.MonthlyRequests, status.Used.MonthlyRequests),
+	}
+	return status, nil
+}
+
+/**
+ * Check 受理请求前检查额度，作为快速拒绝；发起上游请求前仍须以 Reserve 预占
+ * 任一周期的token或请求次数达到上限时返回 *QuotaExceededError；
+ * Redis等基础设施故障时放行并记录日志，避免因计数不可用导致服务不可用
+ */
+func (qs *QuotaService) Check(ctx context.Context, uid uint) error {
+	status, err := qs.Status(ctx, uid)
+	if err != nil {
+		log.Printf("检查额度失败，放行本次请求：user_id=%d, err=%v", uid, err)
+		return nil
+	}
+
+	checks := []QuotaExceededError{
+		{Period: "daily", Kind: "requests", Limit: status.Limits.DailyRequests, Used: status.Used.DailyRequests, ResetAt: status.DailyResetAt},
+		{Period: "daily", Kind: "tokens", Limit: status.Limits.DailyTokens, Used: status.Used.DailyTokens, ResetAt: status.DailyResetAt},
+		{Period: "monthly", Kind: "requests", Limit: status.Limits.MonthlyRequests, Used: status.Used.MonthlyRequests, ResetAt: status.MonthlyResetAt},
+		{Period: "monthly", Kind: "tokens", Limit: status.Limits.MonthlyTokens, Used: status.Used.MonthlyTokens, ResetAt: status.MonthlyResetAt},
+	}
+	for _, check := range checks {
+		if check.Limit > 0 && check.Used >= check.Limit {
+			return &check
+		}
+	}
+	return nil
+}
+
+/**
+ * Reserve 发起上游请求前原子地预占一次请求和预估的token，并发请求不会共同超出限额
+ * 超限时返回 *QuotaExceededError；Redis等基础设施故障时放行并返回 nil 预占，与 Check 一致。
+ * 回复保存后以实际用量调用 Settle，未保存回复时调用 Cancel 退还
+ */
+func (qs *QuotaService) Reserve(ctx context.Context, uid uint, tokens int) (*QuotaReservation, error) {
+	status, err := qs.Status(ctx, uid)
+	if err != nil {
+		log.Printf("预占额度失败，放行本次请求：user_id=%d, err=%v", uid, err)
+		return nil, nil
+	}
+
+	dayKey, monthKey := qs.keys(uid, time.Now())
+	limits := status.Limits
+	result, err := quotaReserveScript.Run(ctx, qs.RDB, []string{dayKey, monthKey}, tokens,
+		limits.DailyTokens, limits.DailyRequests, limits.MonthlyTokens, limits.MonthlyRequests).Int64Slice()
+	if err != nil {
+		log.Printf("预占额度失败，放行本次请求：user_id=%d, err=%v", uid, err)
+		return nil, nil
+	}
+	if result[0] != 0 {
+		exceeded := &QuotaExceededError{Period: "daily", Kind: "tokens", Limit: limits.DailyTokens, Used: result[2], ResetAt: status.DailyResetAt}
+		if result[0] == 2 {
+			exceeded.Period, exceeded.Limit, exceeded.ResetAt = "monthly", limits.MonthlyTokens, status.MonthlyResetAt
+		}
+		if result[1] == 2 {
+			exceeded.Kind, exceeded.Limit = "requests", limits.DailyRequests
+			if result[0] == 2 {
+				exceeded.Limit = limits.MonthlyRequests
+			}
+		}
+		return nil, exceeded
+	}
+	return &QuotaReservation{rdb: qs.RDB, uid: uid, keys: []string{dayKey, monthKey}, tokens: tokens}, nil
+}
+
+// QuotaReservation 一次额度预占，nil 表示未预占（Redis不可用时放行），其方法均可在 nil 上调用
+type QuotaReservation struct {
+	rdb    *redis.Client
+	uid    uint
+	keys   []string // 预占时的日、月计数Key，跨周期结算时仍调整预占的周期
+	tokens int      // 预占的token数
+	done   bool
+}
+
+// Settle 以实际用量结算，只调整预占与实际的token差额；只生效一次
+func (r *QuotaReservation) Settle(ctx context.Context, tokens int) {
+	if r != nil {
+		r.adjust(ctx, tokens-r.tokens, 0)
+	}
+}
+
+// Cancel 退还预占的请求次数和token，已结算时不做处理
+func (r *QuotaReservation) Cancel(ctx context.Context) {
+	if r != nil {
+		r.adjust(ctx, -r.tokens, -1)
+	}
+}
+
+func (r *QuotaReservation) adjust(ctx context.Context, tokens int, requests int) {
+	if r.done {
+		return
+	}
+	r.done = true
+	for _, key := range r.keys {
+		if err := quotaIncrScript.Run(ctx, r.rdb, []string{key}, tokens, requests).Err(); err != nil {
+			log.Printf("结算额度预占失败：user_id=%d, key=%s, err=%v", r.uid, key, err)
+		}
+	}
+}
+
+// RecordTokens 只累加token，不计请求次数；用于摘要等由系统发起的调用，用量记录保存到MySQL之后调用
+func (qs *QuotaService) RecordTokens(ctx context.Context, uid uint, tokens int) {
+	dayKey, monthKey := qs.keys(uid, time.Now())
+	for _, key := range []string{dayKey, monthKey} {
+		if err := quotaIncrScript.Run(ctx, qs.RDB, []string{key}, tokens, 0).Err(); err != nil {
+			log.Printf("累加额度计数失败：user_id=%d, key=%s, err=%v", uid, key, err)
+		}
+	}
+}
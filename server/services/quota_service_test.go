@@ -0,0 +1,132 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestQuotaReserve(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		plans    string
+		reserved []int // 依次预占的token数，均应成功
+		tokens   int
+		wantKind string // 为空表示应成功
+	}{
+		{"不限额", "", []int{1000, 1000}, 1000, ""},
+		{"请求次数用尽", "free:0:0:2:0", []int{1, 1}, 1, "requests"},
+		{"token剩余不足", "free:100:0:0:0", []int{60}, 50, "tokens"},
+		{"token恰好用完", "free:100:0:0:0", []int{60}, 40, ""},
+		{"按月限额", "free:0:100:0:0", []int{90}, 20, "tokens"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("QUOTA_PLANS", tt.plans)
+			_, rdb := newTestRedis(t)
+			qs := &QuotaService{DB: newTestDB(t), RDB: rdb}
+			for _, tokens := range tt.reserved {
+				if _, err := qs.Reserve(ctx, 1, tokens); err != nil {
+					t.Fatalf("预占 %d 失败：%v", tokens, err)
+				}
+			}
+
+			_, err := qs.Reserve(ctx, 1, tt.tokens)
+			if tt.wantKind == "" {
+				if err != nil {
+					t.Fatalf("err = %v", err)
+				}
+				return
+			}
+			var exceeded *QuotaExceededError
+			if !errors.As(err, &exceeded) || exceeded.Kind != tt.wantKind {
+				t.Fatalf("err = %v, want %s 超限", err, tt.wantKind)
+			}
+		})
+	}
+}
+
+func TestQuotaReserveConcurrent(t *testing.T) {
+	t.Setenv("QUOTA_PLANS", "free:0:0:3:0")
+	_, rdb := newTestRedis(t)
+	qs := &QuotaService{DB: newTestDB(t), RDB: rdb}
+	// 先加载计数，避免并发的首次加载互相覆盖
+	if _, err := qs.Status(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	granted := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r, err := qs.Reserve(context.Background(), 1, 10); err == nil && r != nil {
+				mu.Lock()
+				granted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if granted != 3 {
+		t.Errorf("并发预占成功 %d 次，want 3", granted)
+	}
+}
+
+func TestQuotaReservationSettle(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name         string
+		finish       func(r *QuotaReservation)
+		wantTokens   int64
+		wantRequests int64
+	}{
+		{"按实际用量结算", func(r *QuotaReservation) { r.Settle(ctx, 30) }, 30, 1},
+		{"未保存回复时退还", func(r *QuotaReservation) { r.Cancel(ctx) }, 0, 0},
+		{"结算后退还不生效", func(r *QuotaReservation) { r.Settle(ctx, 30); r.Cancel(ctx) }, 30, 1},
+		{"只结算一次", func(r *QuotaReservation) { r.Settle(ctx, 30); r.Settle(ctx, 50) }, 30, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, rdb := newTestRedis(t)
+			qs := &QuotaService{DB: newTestDB(t), RDB: rdb}
+			r, err := qs.Reserve(ctx, 1, 100)
+			if err != nil || r == nil {
+				t.Fatalf("Reserve = %v, %v", r, err)
+			}
+			tt.finish(r)
+
+			status, err := qs.Status(ctx, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.Used.DailyTokens != tt.wantTokens || status.Used.DailyRequests != tt.wantRequests {
+				t.Errorf("used = %+v, want tokens %d, requests %d", status.Used, tt.wantTokens, tt.wantRequests)
+			}
+			if status.Used.MonthlyTokens != status.Used.DailyTokens {
+				t.Errorf("月计数 %d 与日计数 %d 不一致", status.Used.MonthlyTokens, status.Used.DailyTokens)
+			}
+		})
+	}
+}
+
+func TestQuotaReserveRedisDown(t *testing.T) {
+	t.Setenv("QUOTA_PLANS", "free:1:1:1:1")
+	mr, rdb := newTestRedis(t)
+	qs := &QuotaService{DB: newTestDB(t), RDB: rdb}
+	mr.Close()
+
+	r, err := qs.Reserve(context.Background(), 1, 100)
+	if r != nil || err != nil {
+		t.Fatalf("Redis不可用时应放行：r = %v, err = %v", r, err)
+	}
+	// nil 预占上的结算和退还不做处理
+	r.Settle(context.Background(), 10)
+	r.Cancel(context.Background())
+}
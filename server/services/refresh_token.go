@@ -0,0 +1,219 @@
+// services 包
+// 刷新令牌：访问令牌有效期较短，客户端凭刷新令牌换取新的访问令牌；刷新令牌每次使用后轮换，只保存摘要
+// 每次登录对应一个登录会话（model.UserSession）和一个刷新令牌家族
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"server/model" // 模型包，包含数据模型定义
+	"server/utils" // 工具包，包含字符串截断等工具函数
+
+	"gorm.io/gorm"
+)
+
+// ErrRefreshTokenInvalid 刷新令牌不存在、已过期或已作废
+var ErrRefreshTokenInvalid = errors.New("刷新令牌无效或已过期，请重新登录")
+
+// ErrRefreshTokenReused 已轮换的刷新令牌被再次使用，整个家族已作废
+var ErrRefreshTokenReused = errors.New("刷新令牌已被使用，请重新登录")
+
+// ErrSessionNotFound 登录会话不存在或不属于当前用户
+var ErrSessionNotFound = errors.New("登录会话不存在")
+
+// RefreshTokenService 登录会话及其刷新令牌的签发、轮换和作废
+type RefreshTokenService struct {
+	DB *gorm.DB
+}
+
+// RefreshTokenTTL 刷新令牌的有效期，由 JWT_REFRESH_TTL_HOURS 配置
+func RefreshTokenTTL() time.Duration {
+	return time.Duration(envInt("JWT_REFRESH_TTL_HOURS", 720)) * time.Hour
+}
+
+// hashRefreshToken 刷新令牌的摘要，数据库只保存摘要
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// StartSession 登录时创建登录会话并签发第一个刷新令牌，返回会话和令牌原文
+func (s *RefreshTokenService) StartSession(userID uint, userAgent string, ip string) (*model.UserSession, string, error) {
+	now := time.Now()
+	session := model.UserSession{
+		UserID:     userID,
+		FamilyID:   NewStreamID(),
+		UserAgent:  utils.SafeTruncateStr(userAgent, 500),
+		IP:         ip,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(RefreshTokenTTL()),
+	}
+	var token string
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&session).Error; err != nil {
+			return err
+		}
+		var err error
+		token, err = s.issue(tx, userID, session.FamilyID)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &session, token, nil
+}
+
+func (s *RefreshTokenService) issue(tx *gorm.DB, userID uint, familyID string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	record := model.RefreshToken{
+		UserID:    userID,
+		FamilyID:  familyID,
+		TokenHash: hashRefreshToken(token),
+		ExpiresAt: time.Now().Add(RefreshTokenTTL()),
+	}
+	if err := tx.Create(&record).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+/**
+ * Rotate 使用刷新令牌换发新的刷新令牌
+ * 1. 令牌不存在、已过期或已作废时返回 ErrRefreshTokenInvalid
+ * 2. 令牌已被使用过（包括并发的两次刷新中较晚的一次）时作废整个家族，返回 ErrRefreshTokenReused
+ * 3. 否则标记旧令牌已使用，在同一家族下签发新令牌，并更新登录会话的最近活跃时间和IP
+ * 返回旧令牌的记录（用于签发访问令牌及作废家族）和新令牌原文
+ */
+func (s *RefreshTokenService) Rotate(token string, ip string) (*model.RefreshToken, string, error) {
+	var record model.RefreshToken
+	if err := s.DB.Where("token_hash = ?", hashRefreshToken(token)).First(&record).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, "", ErrRefreshTokenInvalid
+		}
+		return nil, "", err
+	}
+	if record.RevokedAt != nil || time.Now().After(record.ExpiresAt) {
+		return &record, "", ErrRefreshTokenInvalid
+	}
+	if record.UsedAt != nil {
+		if err := s.RevokeFamily(record.FamilyID); err != nil {
+			return &record, "", err
+		}
+		return &record, "", ErrRefreshTokenReused
+	}
+
+	var next string
+	reused := false
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		// 以条件更新标记已使用，并发刷新时只有一个请求能成功
+		result := tx.Model(&model.RefreshToken{}).
+			Where("id = ? AND used_at IS NULL AND revoked_at IS NULL", record.ID).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			reused = true
+			return nil
+		}
+		var err error
+		next, err = s.issue(tx, record.UserID, record.FamilyID)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		return tx.Model(&model.UserSession{}).
+			Where("family_id = ?", record.FamilyID).
+			Updates(map[string]interface{}{"last_seen_at": now, "ip": ip, "expires_at": now.Add(RefreshTokenTTL())}).Error
+	})
+	if err != nil {
+		return &record, "", err
+	}
+	if reused {
+		if err := s.RevokeFamily(record.FamilyID); err != nil {
+			return &record, "", err
+		}
+		return &record, "", ErrRefreshTokenReused
+	}
+	return &record, next, nil
+}
+
+// Revoke 作废刷新令牌所在的家族（退出登录），返回该令牌的记录；令牌不存在时返回 ErrRefreshTokenInvalid
+func (s *RefreshTokenService) Revoke(token string) (*model.RefreshToken, error) {
+	var record model.RefreshToken
+	if err := s.DB.Where("token_hash = ?", hashRefreshToken(token)).First(&record).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrRefreshTokenInvalid
+		}
+		return nil, err
+	}
+	return &record, s.RevokeFamily(record.FamilyID)
+}
+
+// RevokeFamily 作废登录会话及家族中所有尚未作废的刷新令牌
+func (s *RefreshTokenService) RevokeFamily(familyID string) error {
+	now := time.Now()
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&model.RefreshToken{}).
+			Where("family_id = ? AND revoked_at IS NULL", familyID).
+			Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(&model.UserSession{}).
+			Where("family_id = ? AND revoked_at IS NULL", familyID).
+			Update("revoked_at", now).Error
+	})
+}
+
+// ListSessions 用户当前有效的登录会话，按最近活跃时间倒序
+func (s *RefreshTokenService) ListSessions(userID uint) ([]model.UserSession, error) {
+	var sessions []model.UserSession
+	err := s.DB.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// RevokeSession 移除用户的一个登录会话，返回该会话（用于作废其访问令牌）；不属于该用户时返回 ErrSessionNotFound
+func (s *RefreshTokenService) RevokeSession(userID uint, sessionID uint) (*model.UserSession, error) {
+	var session model.UserSession
+	if err := s.DB.Where("id = ? AND user_id = ? AND revoked_at IS NULL", sessionID, userID).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, err
+	}
+	return &session, s.RevokeFamily(session.FamilyID)
+}
+
+// RevokeUser 作废用户的所有登录会话（如重置密码后），返回被作废的家族ID，用于作废其访问令牌
+func (s *RefreshTokenService) RevokeUser(userID uint) ([]string, error) {
+	var familyIDs []string
+	if err := s.DB.Model(&model.UserSession{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Pluck("family_id", &familyIDs).Error; err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&model.RefreshToken{}).
+			Where("user_id = ? AND revoked_at IS NULL", userID).
+			Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(&model.UserSession{}).
+			Where("user_id = ? AND revoked_at IS NULL", userID).
+			Update("revoked_at", now).Error
+	})
+	return familyIDs, err
+}
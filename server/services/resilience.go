@@ -0,0 +1,224 @@
+// services 包
+// 上游调用的容错：错误分类、重试退避、按提供方熔断和超时配置
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UpstreamError 上游接口返回的非200响应
+type UpstreamError struct {
+	Provider   string
+	StatusCode int
+	RetryAfter time.Duration // 上游通过 Retry-After 建议的等待时间，未提供时为0
+	Body       string        // 截断后的响应体，便于排查
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("AI接口返回错误：%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// CircuitOpenError 提供方处于熔断状态，请求未发出
+type CircuitOpenError struct {
+	Provider string
+	RetryAt  time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("AI提供方 %s 暂不可用（熔断中），请于 %s 后重试", e.Provider, e.RetryAt.Format(time.TimeOnly))
+}
+
+// IsRetryable 判断错误是否为可重试的上游故障：网络错误、429 或 5xx
+// 调用方主动取消、参数错误等不重试，也不计入熔断
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		return upstreamErr.StatusCode == http.StatusTooManyRequests || upstreamErr.StatusCode >= 500
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// parseRetryAfter 解析 Retry-After 响应头，支持秒数和HTTP日期两种格式
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// retryBackoff 第 attempt 次重试前的等待时间：指数退避加随机抖动，上游给出 Retry-After 时以其为准
+func retryBackoff(attempt int, err error) time.Duration {
+	maxWait := time.Duration(envInt("AI_RETRY_MAX_WAIT_MS", 10000)) * time.Millisecond
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) && upstreamErr.RetryAfter > 0 {
+		return min(upstreamErr.RetryAfter, maxWait)
+	}
+
+	base := time.Duration(envInt("AI_RETRY_BASE_MS", 500)) * time.Millisecond
+	backoff := min(base<<attempt, maxWait)
+	// 保留一半固定等待，另一半随机，避免多个实例同时重试
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// BreakerState 熔断器状态
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"    // 正常放行
+	BreakerOpen     BreakerState = "open"      // 熔断中，直接拒绝
+	BreakerHalfOpen BreakerState = "half_open" // 冷却结束，放行一个探测请求
+)
+
+// BreakerSnapshot 熔断器状态快照，用于诊断接口
+type BreakerSnapshot struct {
+	Provider  string       `json:"provider"`
+	State     BreakerState `json:"state"`
+	Failures  int          `json:"failures"` // 连续失败次数
+	LastError string       `json:"last_error,omitempty"`
+	OpenedAt  *time.Time   `json:"opened_at,omitempty"`
+	RetryAt   *time.Time   `json:"retry_at,omitempty"`
+}
+
+// CircuitBreaker 按提供方统计连续失败的熔断器
+// 连续失败达到 AI_BREAKER_THRESHOLD 次后熔断 AI_BREAKER_COOLDOWN_MS，冷却结束后放行一个探测请求，
+// 探测成功则恢复，失败则重新熔断
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	provider  string
+	state     BreakerState
+	failures  int
+	lastError string
+	openedAt  time.Time
+	probing   bool
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = map[string]*CircuitBreaker{}
+)
+
+// breakerFor 获取提供方的熔断器，不存在时创建
+func breakerFor(provider string) *CircuitBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[provider]
+	if !ok {
+		b = &CircuitBreaker{provider: provider, state: BreakerClosed}
+		breakers[provider] = b
+	}
+	return b
+}
+
+// BreakerSnapshots 返回所有已注册提供方的熔断器状态
+func BreakerSnapshots() []BreakerSnapshot {
+	names := ProviderNames()
+	snapshots := make([]BreakerSnapshot, 0, len(names))
+	for _, name := range names {
+		snapshots = append(snapshots, breakerFor(name).Snapshot())
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Provider < snapshots[j].Provider })
+	return snapshots
+}
+
+func breakerThreshold() int {
+	return max(envInt("AI_BREAKER_THRESHOLD", 5), 1)
+}
+
+func breakerCooldown() time.Duration {
+	return time.Duration(envInt("AI_BREAKER_COOLDOWN_MS", 30000)) * time.Millisecond
+}
+
+// Allow 判断是否放行请求，熔断中返回 *CircuitOpenError
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen {
+		retryAt := b.openedAt.Add(breakerCooldown())
+		if time.Now().Before(retryAt) {
+			return &CircuitOpenError{Provider: b.provider, RetryAt: retryAt}
+		}
+		b.state = BreakerHalfOpen
+		b.probing = false
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probing {
+			return &CircuitOpenError{Provider: b.provider, RetryAt: time.Now().Add(time.Second)}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// Record 记录请求结果：成功则复位，可重试的上游故障计入失败，其他错误不影响熔断状态
+func (b *CircuitBreaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasProbing := b.probing
+	b.probing = false
+	switch {
+	case err == nil:
+		b.state = BreakerClosed
+		b.failures = 0
+		b.lastError = ""
+	case IsRetryable(err):
+		b.failures++
+		b.lastError = err.Error()
+		if wasProbing || b.failures >= breakerThreshold() {
+			b.state = BreakerOpen
+			b.openedAt = time.Now()
+		}
+	}
+}
+
+// Snapshot 当前状态快照
+func (b *CircuitBreaker) Snapshot() BreakerSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	snapshot := BreakerSnapshot{
+		Provider:  b.provider,
+		State:     b.state,
+		Failures:  b.failures,
+		LastError: b.lastError,
+	}
+	if !b.openedAt.IsZero() && b.state != BreakerClosed {
+		openedAt := b.openedAt
+		retryAt := openedAt.Add(breakerCooldown())
+		snapshot.OpenedAt, snapshot.RetryAt = &openedAt, &retryAt
+	}
+	return snapshot
+}
+
+// withRequestTimeout 为阻塞式调用设置整体超时 AI_REQUEST_TIMEOUT_MS
+func withRequestTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, time.Duration(envInt("AI_REQUEST_TIMEOUT_MS", 120000))*time.Millisecond)
+}
+
+// withStreamTimeout 为流式调用设置整体超时 AI_STREAM_TIMEOUT_MS
+func withStreamTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, time.Duration(envInt("AI_STREAM_TIMEOUT_MS", 600000))*time.Millisecond)
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"未提供", "", 0, 0},
+		{"秒数", "3", 3 * time.Second, 3 * time.Second},
+		{"HTTP日期", time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat), 8 * time.Second, 10 * time.Second},
+		{"已过去的日期", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+		{"无法解析", "soon", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseRetryAfter(tt.value)
+			if got < tt.min || got > tt.max {
+				t.Errorf("parseRetryAfter(%q) = %v, want [%v, %v]", tt.value, got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	t.Setenv("AI_RETRY_BASE_MS", "100")
+	t.Setenv("AI_RETRY_MAX_WAIT_MS", "1000")
+
+	tests := []struct {
+		name    string
+		attempt int
+		err     error
+		min     time.Duration
+		max     time.Duration
+	}{
+		{"第一次重试", 0, errors.New("timeout"), 50 * time.Millisecond, 100 * time.Millisecond},
+		{"指数增长", 2, errors.New("timeout"), 200 * time.Millisecond, 400 * time.Millisecond},
+		{"不超过最大等待", 10, errors.New("timeout"), 500 * time.Millisecond, time.Second},
+		{"以 Retry-After 为准", 0, &UpstreamError{StatusCode: 429, RetryAfter: 700 * time.Millisecond}, 700 * time.Millisecond, 700 * time.Millisecond},
+		{"Retry-After 不超过最大等待", 0, &UpstreamError{StatusCode: 429, RetryAfter: time.Minute}, time.Second, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				got := retryBackoff(tt.attempt, tt.err)
+				if got < tt.min || got > tt.max {
+					t.Fatalf("retryBackoff(%d) = %v, want [%v, %v]", tt.attempt, got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	t.Setenv("AI_BREAKER_THRESHOLD", "2")
+	t.Setenv("AI_BREAKER_COOLDOWN_MS", "50")
+	upstreamErr := &UpstreamError{StatusCode: http.StatusBadGateway}
+	cooldown := func(b *CircuitBreaker) {
+		// 直接回拨熔断时间，模拟冷却结束
+		b.mu.Lock()
+		b.openedAt = time.Now().Add(-time.Second)
+		b.mu.Unlock()
+	}
+
+	tests := []struct {
+		name  string
+		steps func(b *CircuitBreaker)
+		state BreakerState
+		allow bool
+	}{
+		{
+			name:  "初始为关闭",
+			steps: func(b *CircuitBreaker) {},
+			state: BreakerClosed,
+			allow: true,
+		},
+		{
+			name: "连续失败未达阈值时保持关闭",
+			steps: func(b *CircuitBreaker) {
+				b.Record(upstreamErr)
+			},
+			state: BreakerClosed,
+			allow: true,
+		},
+		{
+			name: "连续失败达到阈值后熔断",
+			steps: func(b *CircuitBreaker) {
+				b.Record(upstreamErr)
+				b.Record(upstreamErr)
+			},
+			state: BreakerOpen,
+			allow: false,
+		},
+		{
+			name: "成功后失败计数复位",
+			steps: func(b *CircuitBreaker) {
+				b.Record(upstreamErr)
+				b.Record(nil)
+				b.Record(upstreamErr)
+			},
+			state: BreakerClosed,
+			allow: true,
+		},
+		{
+			name: "不可重试的错误不计入失败",
+			steps: func(b *CircuitBreaker) {
+				b.Record(&UpstreamError{StatusCode: http.StatusBadRequest})
+				b.Record(context.Canceled)
+				b.Record(upstreamErr)
+			},
+			state: BreakerClosed,
+			allow: true,
+		},
+		{
+			name: "冷却结束后进入半开，只放行一个探测请求",
+			steps: func(b *CircuitBreaker) {
+				b.Record(upstreamErr)
+				b.Record(upstreamErr)
+				cooldown(b)
+				if err := b.Allow(); err != nil {
+					t.Fatalf("探测请求应放行：%v", err)
+				}
+			},
+			state: BreakerHalfOpen,
+			allow: false,
+		},
+		{
+			name: "探测成功后恢复",
+			steps: func(b *CircuitBreaker) {
+				b.Record(upstreamErr)
+				b.Record(upstreamErr)
+				cooldown(b)
+				_ = b.Allow()
+				b.Record(nil)
+			},
+			state: BreakerClosed,
+			allow: true,
+		},
+		{
+			name: "探测失败后重新熔断",
+			steps: func(b *CircuitBreaker) {
+				b.Record(upstreamErr)
+				b.Record(upstreamErr)
+				cooldown(b)
+				_ = b.Allow()
+				b.Record(upstreamErr)
+			},
+			state: BreakerOpen,
+			allow: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &CircuitBreaker{provider: "test", state: BreakerClosed}
+			tt.steps(b)
+			if state := b.Snapshot().State; state != tt.state {
+				t.Errorf("state = %s, want %s", state, tt.state)
+			}
+			err := b.Allow()
+			if (err == nil) != tt.allow {
+				t.Errorf("Allow() = %v, want allow %v", err, tt.allow)
+			}
+			var openErr *CircuitOpenError
+			if err != nil && !errors.As(err, &openErr) {
+				t.Errorf("拒绝时应返回 *CircuitOpenError，got %T", err)
+			}
+		})
+	}
+}
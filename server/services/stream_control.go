@@ -0,0 +1,217 @@
+// services 包
+// 流式生成的停止控制：登记进行中的生成，通过Redis发布/订阅跨实例取消
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9" // Redis客户端
+)
+
+const (
+	// 生成信息：stream:{streamID} -> Hash{user_id, conversation_id, status, stop_requested}
+	streamKeyPrefix = "stream:%s"
+	// 会话当前的生成：conversation_stream:{conversationID} -> streamID
+	conversationStreamKeyPrefix = "conversation_stream:%d"
+	// 停止指令频道，消息内容为 streamID
+	streamStopChannel = "stream_stop"
+)
+
+// ErrStreamStopped 用户主动停止生成，作为 context 的取消原因
+var ErrStreamStopped = errors.New("用户停止生成")
+
+// ErrStreamNotFound 没有找到进行中的生成
+var ErrStreamNotFound = errors.New("没有进行中的生成")
+
+// 仅当会话当前的生成仍是自己时才删除，避免误删新开始的生成
+var releaseConversationStreamScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// StreamRegistry 本实例进行中的生成登记表
+type StreamRegistry struct {
+	RDB *redis.Client
+
+	mu      sync.Mutex
+	cancels map[string]context.CancelCauseFunc
+}
+
+// Streams 全局生成登记表，由 InitStreamRegistry 初始化
+var Streams = &StreamRegistry{cancels: map[string]context.CancelCauseFunc{}}
+
+// ActiveStream 一次进行中的生成
+type ActiveStream struct {
+	ID             string
+	UserID         uint
+	ConversationID uint
+
+	registry *StreamRegistry
+}
+
+// InitStreamRegistry 设置Redis连接并订阅停止指令，收到后取消本实例上对应的生成
+func InitStreamRegistry(rdb *redis.Client) {
+	Streams.RDB = rdb
+	go func() {
+		pubsub := rdb.Subscribe(context.Background(), streamStopChannel)
+		defer pubsub.Close()
+		for msg := range pubsub.Channel() {
+			Streams.cancelLocal(msg.Payload)
+		}
+	}()
+}
+
+// NewStreamID 生成随机的生成ID，同时用作生成事件缓冲的Key
+func NewStreamID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// streamTTL 登记信息的过期时间，略长于流式请求的整体超时
+func streamTTL() time.Duration {
+	return time.Duration(envInt("AI_STREAM_TIMEOUT_MS", 600000))*time.Millisecond + time.Minute
+}
+
+// Register 登记排队中的生成，使其在开始执行前即可被订阅和停止
+func (r *StreamRegistry) Register(ctx context.Context, id string, uid uint, convID uint) error {
+	key := fmt.Sprintf(streamKeyPrefix, id)
+	pipe := r.RDB.TxPipeline()
+	pipe.HSet(ctx, key, "user_id", uid, "conversation_id", convID, "status", "queued")
+	pipe.Expire(ctx, key, streamTTL())
+	pipe.Set(ctx, fmt.Sprintf(conversationStreamKeyPrefix, convID), id, streamTTL())
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+/**
+ * Start 登记一次生成，返回可被停止指令取消的 context
+ * 排队期间已收到停止指令时返回已取消的 context；Redis写入失败时仍返回可用的 context，只是无法跨实例停止
+ */
+func (r *StreamRegistry) Start(parent context.Context, id string, uid uint, convID uint) (*ActiveStream, context.Context) {
+	ctx, cancel := context.WithCancelCause(parent)
+	stream := &ActiveStream{ID: id, UserID: uid, ConversationID: convID, registry: r}
+
+	r.mu.Lock()
+	r.cancels[stream.ID] = cancel
+	r.mu.Unlock()
+
+	if r.RDB != nil {
+		key := fmt.Sprintf(streamKeyPrefix, stream.ID)
+		pipe := r.RDB.TxPipeline()
+		pipe.HSet(ctx, key, "user_id", uid, "conversation_id", convID, "status", "running")
+		pipe.Expire(ctx, key, streamTTL())
+		pipe.Set(ctx, fmt.Sprintf(conversationStreamKeyPrefix, convID), stream.ID, streamTTL())
+		stopRequested := pipe.HGet(ctx, key, "stop_requested")
+		if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+			log.Printf("登记生成失败：stream_id=%s, err=%v", stream.ID, err)
+		}
+		if stopRequested.Val() == "1" {
+			cancel(ErrStreamStopped)
+		}
+	}
+	return stream, ctx
+}
+
+// Finish 生成结束后移除登记，生成信息保留到事件缓冲过期，供断线重连校验
+func (s *ActiveStream) Finish() {
+	r := s.registry
+	r.mu.Lock()
+	cancel, ok := r.cancels[s.ID]
+	delete(r.cancels, s.ID)
+	r.mu.Unlock()
+	if ok {
+		cancel(context.Canceled)
+	}
+
+	if r.RDB != nil {
+		ctx := context.Background()
+		key := fmt.Sprintf(streamKeyPrefix, s.ID)
+		r.RDB.HSet(ctx, key, "status", "finished")
+		r.RDB.Expire(ctx, key, generationBufferTTL())
+		releaseConversationStreamScript.Run(ctx, r.RDB, []string{fmt.Sprintf(conversationStreamKeyPrefix, s.ConversationID)}, s.ID)
+	}
+}
+
+// cancelLocal 取消本实例上的生成，不存在时忽略
+func (r *StreamRegistry) cancelLocal(streamID string) bool {
+	r.mu.Lock()
+	cancel, ok := r.cancels[streamID]
+	r.mu.Unlock()
+	if ok {
+		cancel(ErrStreamStopped)
+	}
+	return ok
+}
+
+/**
+ * Stop 停止用户的一次生成，可指定 streamID 或会话ID
+ * 校验生成属于当前用户后发布停止指令，由正在执行该生成的实例取消上游请求
+ */
+func (r *StreamRegistry) Stop(ctx context.Context, uid uint, convID uint, streamID string) (string, error) {
+	if streamID == "" {
+		id, err := r.RDB.Get(ctx, fmt.Sprintf(conversationStreamKeyPrefix, convID)).Result()
+		if errors.Is(err, redis.Nil) {
+			return "", ErrStreamNotFound
+		}
+		if err != nil {
+			return "", err
+		}
+		streamID = id
+	}
+
+	owner, err := r.RDB.HGet(ctx, fmt.Sprintf(streamKeyPrefix, streamID), "user_id").Result()
+	if errors.Is(err, redis.Nil) || (err == nil && owner != strconv.FormatUint(uint64(uid), 10)) {
+		return "", ErrStreamNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// 记录停止标记，覆盖生成尚在队列中、还没有实例执行的情况
+	if err := r.RDB.HSet(ctx, fmt.Sprintf(streamKeyPrefix, streamID), "stop_requested", "1").Err(); err != nil {
+		return "", err
+	}
+	if err := r.RDB.Publish(ctx, streamStopChannel, streamID).Err(); err != nil {
+		return "", err
+	}
+	return streamID, nil
+}
+
+// Owner 读取生成所属的用户和会话，生成不存在或已过期时返回 ErrStreamNotFound
+func (r *StreamRegistry) Owner(ctx context.Context, streamID string) (uint, uint, error) {
+	values, err := r.RDB.HMGet(ctx, fmt.Sprintf(streamKeyPrefix, streamID), "user_id", "conversation_id").Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	if values[0] == nil {
+		return 0, 0, ErrStreamNotFound
+	}
+	uid, _ := strconv.ParseUint(fmt.Sprint(values[0]), 10, 64)
+	convID, _ := strconv.ParseUint(fmt.Sprint(values[1]), 10, 64)
+	return uint(uid), uint(convID), nil
+}
+
+// StopOnDisconnect 发起生成的SSE连接断开时是否停止生成，由 GENERATION_STOP_ON_DISCONNECT 配置
+// 默认继续生成并保存，客户端可断线续读；开启后断开即停止，已生成的部分标记为 interrupted 保存
+func StopOnDisconnect() bool {
+	return os.Getenv("GENERATION_STOP_ON_DISCONNECT") == "true"
+}
+
+// IsStreamStopped 判断 context 是否因用户停止生成而取消
+func IsStreamStopped(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrStreamStopped)
+}
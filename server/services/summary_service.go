@@ -0,0 +1,218 @@
+// services 包
+// 滚动摘要：将较早的对话压缩为摘要，减少每次请求携带的历史
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"server/cache" // 缓存包，用于对话上下文缓存
+	"server/dto"   // 数据传输对象，定义请求和响应结构
+	"server/model" // 模型包，包含数据模型定义
+
+	"github.com/redis/go-redis/v9" // Redis客户端
+	"gorm.io/gorm"                 // GORM数据库框架
+)
+
+const (
+	// 摘要任务互斥锁Key：conversation_summary_lock:{conversationID}
+	summaryLockKeyPrefix = "conversation_summary_lock:%d"
+	summaryLockExpire    = 5 * time.Minute
+	summaryTimeout       = 2 * time.Minute
+)
+
+// 仅当摘要锁仍由自己持有时才释放，避免锁过期后误删其他任务的锁
+var releaseSummaryLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+const summarySystemPrompt = "你是对话摘要助手。请将已有摘要与新增对话合并为一份简洁的摘要，" +
+	"保留用户的目标、偏好、关键事实、已得出的结论和未解决的问题，使用第三人称陈述，不要添加对话中没有的信息。"
+
+// Summarizer 会话滚动摘要生成器
+type Summarizer struct {
+	DB    *gorm.DB
+	Cache *cache.ConversationCache
+}
+
+// summaryEnabled 是否开启滚动摘要，默认开启
+func summaryEnabled() bool {
+	return os.Getenv("SUMMARY_ENABLED") != "false"
+}
+
+// SummarizeAsync 在后台检查并生成摘要，不阻塞当前请求
+func (s *Summarizer) SummarizeAsync(convID uint, uid uint) {
+	if !summaryEnabled() {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), summaryTimeout)
+		defer cancel()
+		if err := s.MaybeSummarize(ctx, convID, uid); err != nil {
+			log.Printf("生成会话摘要失败：convID=%d, err=%v", convID, err)
+		}
+	}()
+}
+
+/**
+ * MaybeSummarize 未摘要的消息超过阈值时生成增量摘要
+ * 1. 读取当前分支上摘要之后的消息，数量未达到 SUMMARY_TRIGGER_MESSAGES 时跳过
+ * 2. 保留最近 SUMMARY_KEEP_RECENT 条消息原文，其余与旧摘要合并为新摘要
+ * 3. 用户额度已用尽时跳过；摘要调用的用量计入用量记录和token额度
+ * 4. 将摘要持久化到MySQL，并用新摘要重建Redis上下文
+ */
+func (s *Summarizer) MaybeSummarize(ctx context.Context, convID uint, uid uint) error {
+	lockKey := fmt.Sprintf(summaryLockKeyPrefix, convID)
+	owner := NewStreamID()
+	locked, err := s.Cache.RDB.SetNX(ctx, lockKey, owner, summaryLockExpire).Result()
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return nil
+	}
+	defer func() {
+		if err := releaseSummaryLockScript.Run(context.Background(), s.Cache.RDB, []string{lockKey}, owner).Err(); err != nil {
+			log.Printf("释放摘要锁失败：convID=%d, err=%v", convID, err)
+		}
+	}()
+
+	var conversation model.Conversation
+	if err := s.DB.Where("id = ? AND user_id = ?", convID, uid).First(&conversation).Error; err != nil {
+		return err
+	}
+
+	// 只摘要当前分支；摘要覆盖到的消息不在当前分支上时（切换过分支），旧摘要作废，从头摘要
+	tree, err := s.Cache.LoadMessageTree(convID, uid)
+	if err != nil {
+		return err
+	}
+	messages, summarized := cache.AfterSummary(cache.ActivePath(tree), conversation.SummaryUntilID)
+	if !summarized {
+		conversation.Summary = ""
+	}
+
+	trigger := envInt("SUMMARY_TRIGGER_MESSAGES", 20)
+	if len(messages) < trigger {
+		return nil
+	}
+
+	// 保留的最近消息从user消息开始，单次最多压缩 SUMMARY_BATCH_MESSAGES 条
+	cut := max(len(messages)-max(envInt("SUMMARY_KEEP_RECENT", 8), 1), 0)
+	cut = min(cut, envInt("SUMMARY_BATCH_MESSAGES", 40))
+	for cut > 0 && messages[cut].MessageRole != model.MessageRoleUser {
+		cut--
+	}
+	if cut == 0 {
+		return nil
+	}
+
+	quota := QuotaService{DB: s.DB, RDB: s.Cache.RDB}
+	if err := quota.Check(ctx, uid); err != nil {
+		log.Printf("额度已用尽，跳过会话摘要：convID=%d, err=%v", convID, err)
+		return nil
+	}
+
+	summary, err := s.summarize(ctx, &conversation, messages[:cut])
+	if err != nil {
+		return err
+	}
+
+	// 以旧的 summary_until_id 作为条件，避免覆盖并发生成的更新摘要
+	result := s.DB.Model(&model.Conversation{}).
+		Where("id = ? AND summary_until_id = ?", convID, conversation.SummaryUntilID).
+		Updates(map[string]interface{}{
+			"summary":          summary,
+			"summary_until_id": messages[cut-1].ID,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+	log.Printf("会话摘要已更新：convID=%d, summarized=%d, until=%d", convID, cut, messages[cut-1].ID)
+
+	return s.Cache.RefreshConversationCtx(convID, uid)
+}
+
+// summarize 调用会话配置的模型，将旧摘要与新增对话合并
+func (s *Summarizer) summarize(ctx context.Context, conversation *model.Conversation, messages []model.Message) (string, error) {
+	transcript := new(strings.Builder)
+	if conversation.Summary != "" {
+		transcript.WriteString("已有摘要：\n")
+		transcript.WriteString(conversation.Summary)
+		transcript.WriteString("\n\n")
+	}
+	transcript.WriteString("新增对话：\n")
+	for _, msg := range messages {
+		ctxMsg, ok := cache.ToContextMessage(msg)
+		if !ok {
+			continue
+		}
+		speaker := "用户"
+		if ctxMsg.Role == "assistant" {
+			speaker = "助手"
+		}
+		fmt.Fprintf(transcript, "%s：%s\n", speaker, ctxMsg.Content)
+	}
+	transcript.WriteString("\n请输出更新后的完整摘要。")
+
+	// 默认使用会话自身的模型，可通过 SUMMARY_PROVIDER/SUMMARY_MODEL 指定更便宜的模型
+	provider, modelName := conversation.Settings.Provider, conversation.Settings.Model
+	if summaryProvider := os.Getenv("SUMMARY_PROVIDER"); summaryProvider != "" {
+		provider, modelName = summaryProvider, os.Getenv("SUMMARY_MODEL")
+	}
+
+	temperature := 0.2
+	req := &ChatRequest{
+		Provider: provider,
+		Model:    modelName,
+		Messages: []dto.Message{
+			{Role: "system", Content: summarySystemPrompt},
+			{Role: "user", Content: transcript.String()},
+		},
+		Temperature:    &temperature,
+		ConversationID: conversation.ID,
+		Summary:        true,
+	}
+	resp, err := GetAIResponse(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	s.recordUsage(conversation, resp)
+
+	summary := strings.TrimSpace(resp.Content)
+	if summary == "" {
+		return "", fmt.Errorf("AI未返回有效摘要")
+	}
+	return summary, nil
+}
+
+// recordUsage 保存摘要调用的用量并计入token额度，失败时只记录日志
+func (s *Summarizer) recordUsage(conversation *model.Conversation, resp *ChatResponse) {
+	record := model.UsageRecord{
+		UserID:           conversation.UserID,
+		ConversationID:   conversation.ID,
+		Kind:             model.UsageKindSummary,
+		Provider:         resp.Provider,
+		Model:            resp.Model,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+		TotalTokens:      resp.Usage.TotalTokens,
+		LatencyMs:        resp.LatencyMs,
+		Cost:             resp.Cost,
+	}
+	if err := s.DB.Create(&record).Error; err != nil {
+		log.Printf("保存摘要用量失败：convID=%d, err=%v", conversation.ID, err)
+		return
+	}
+	(&QuotaService{DB: s.DB, RDB: s.Cache.RDB}).RecordTokens(context.Background(), conversation.UserID, record.TotalTokens)
+}
@@ -0,0 +1,36 @@
+package services
+
+import (
+	"testing"
+
+	"server/model"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/glebarez/sqlite"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestRedis 启动内存中的Redis，测试结束时关闭
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	// 关闭Redis的用例无需等待重试
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1, DialerRetries: 1})
+	t.Cleanup(func() { rdb.Close() })
+	return mr, rdb
+}
+
+// newTestDB 创建内存中的SQLite数据库并建表，每个测试独立
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("打开测试数据库失败：%v", err)
+	}
+	if err := db.AutoMigrate(&model.User{}, &model.Conversation{}, &model.Message{}, &model.UserQuota{}, &model.UsageRecord{}); err != nil {
+		t.Fatalf("建表失败：%v", err)
+	}
+	return db
+}
@@ -5,39 +5,156 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"server/dto"
 
 	"github.com/gin-gonic/gin"
 )
 
-func PushSSEError(c *gin.Context, msg string) {
+// SSEWriter 串行写入SSE事件和心跳
+// 事件带 event 字段（事件类型）和 id 字段（可断线续读的事件ID），内容为 dto.StreamEvent 的JSON；
+// 写入失败（客户端已断开）后不再写入，并通过 OnFail 通知调用方取消后续处理
+type SSEWriter struct {
+	c       *gin.Context
+	flusher http.Flusher
+
+	mu     sync.Mutex
+	err    error
+	onFail func(error)
+}
+
+// NewSSEWriter 设置SSE响应头并创建写入器
+func NewSSEWriter(c *gin.Context) *SSEWriter {
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
 	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
 	flusher, _ := c.Writer.(http.Flusher)
+	return &SSEWriter{c: c, flusher: flusher}
+}
+
+// Streamable 当前环境是否支持流式输出
+func (w *SSEWriter) Streamable() bool {
+	return w.flusher != nil
+}
 
-	SendSSEData(c, flusher, map[string]interface{}{
-		"type": "error",
-		"msg":  msg,
-	})
+// OnFail 设置写入失败时的回调，只会调用一次
+func (w *SSEWriter) OnFail(fn func(error)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.onFail = fn
+}
 
-	SendSSEData(c, flusher, map[string]interface{}{
-		"type": "done",
-		"msg":  "错误终止",
-	})
+// Err 首次写入失败的错误
+func (w *SSEWriter) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
 }
 
-func SendSSEData(c *gin.Context, flusher http.Flusher, data interface{}) {
-	jsonData, err := json.Marshal(data)
+// write 写入一段原始内容并刷新，写入失败后的调用直接返回首次的错误
+func (w *SSEWriter) write(format string, args ...interface{}) error {
+	w.mu.Lock()
+	if w.err != nil {
+		err := w.err
+		w.mu.Unlock()
+		return err
+	}
+	_, err := fmt.Fprintf(w.c.Writer, format, args...)
+	if err == nil && w.flusher != nil {
+		w.flusher.Flush()
+	}
+	var onFail func(error)
 	if err != nil {
-		log.Printf("序列化SSE数据失败：%v", err)
-		return
+		w.err = err
+		onFail = w.onFail
 	}
+	w.mu.Unlock()
 
-	_, err = fmt.Fprintf(c.Writer, "data: %s\n\n", jsonData)
 	if err != nil {
 		log.Printf("写入SSE数据失败：%v", err)
-		return
+		if onFail != nil {
+			onFail(err)
+		}
+	}
+	return err
+}
+
+// WriteRaw 推送已序列化的事件，id 为空时不带事件ID
+func (w *SSEWriter) WriteRaw(id string, eventType string, jsonData []byte) error {
+	if id == "" {
+		return w.write("event: %s\ndata: %s\n\n", eventType, jsonData)
 	}
+	return w.write("id: %s\nevent: %s\ndata: %s\n\n", id, eventType, jsonData)
+}
+
+// Send 推送一条不可续读的事件（如准备生成阶段的错误）
+func (w *SSEWriter) Send(event dto.StreamEvent) error {
+	jsonData, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("序列化SSE数据失败：%v", err)
+		return err
+	}
+	return w.WriteRaw("", event.EventType(), jsonData)
+}
+
+// Heartbeat 写入注释行，保持连接活跃，客户端解析时会忽略
+func (w *SSEWriter) Heartbeat() error {
+	return w.write(": ping\n\n")
+}
+
+// SSEHeartbeatInterval 心跳间隔，由 SSE_HEARTBEAT_SECONDS 配置，为0时关闭心跳
+func SSEHeartbeatInterval() time.Duration {
+	seconds := 15
+	if v, err := strconv.Atoi(os.Getenv("SSE_HEARTBEAT_SECONDS")); err == nil {
+		seconds = v
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// KeepAlive 在后台按间隔发送心跳，避免等待模型输出（如长时间思考）期间被代理判定空闲而断开；
+// 同时用于及时发现客户端断开。返回的函数停止心跳并等待其退出，须在请求处理结束前调用
+func (w *SSEWriter) KeepAlive() (stop func()) {
+	interval := SSEHeartbeatInterval()
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if w.Heartbeat() != nil {
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// PushSSEError 推送错误事件和结束事件
+func PushSSEError(c *gin.Context, msg string) {
+	PushSSEErrorCode(c, 0, msg, nil)
+}
 
-	flusher.Flush()
+// PushSSEErrorCode 推送带业务错误码和详情的错误事件，用于前端区分额度超限等可处理的错误
+func PushSSEErrorCode(c *gin.Context, code int, msg string, data interface{}) {
+	w := NewSSEWriter(c)
+	w.Send(dto.ErrorEvent{EventHeader: dto.NewEventHeader(dto.EventError), Code: code, Msg: msg, Data: data})
+	w.Send(dto.DoneEvent{EventHeader: dto.NewEventHeader(dto.EventDone), Msg: "错误终止"})
 }
@@ -0,0 +1,39 @@
+package utils
+
+import "unicode"
+
+// 每条消息除内容外的固定开销（角色、分隔符等）
+const messageTokenOverhead = 4
+
+// EstimateTokens 估算文本的token数
+// 中日韩等非ASCII字符按每字1个token计算，连续的ASCII字母数字按每4个字符1个token计算，
+// 标点单独计1个token，空白不计。结果偏保守，用于上下文预算而非计费
+func EstimateTokens(s string) int {
+	tokens := 0
+	wordLen := 0
+	flushWord := func() {
+		if wordLen > 0 {
+			tokens += (wordLen + 3) / 4
+			wordLen = 0
+		}
+	}
+
+	for _, r := range s {
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			wordLen++
+		case unicode.IsSpace(r):
+			flushWord()
+		default:
+			flushWord()
+			tokens++
+		}
+	}
+	flushWord()
+	return tokens
+}
+
+// EstimateMessageTokens 估算单条对话消息占用的token数
+func EstimateMessageTokens(role, content string) int {
+	return messageTokenOverhead + EstimateTokens(role) + EstimateTokens(content)
+}